@@ -0,0 +1,220 @@
+package main
+
+// This is the admin API of the signalling server, served on the -debug listener.
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bingoohuang/gowormhole/wormhole"
+)
+
+const adminPage = `<!doctype html>
+<meta charset=utf-8>
+<title>gowormhole admin</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+</style>
+<h1>gowormhole slots</h1>
+<p id=status></p>
+<p><button onclick="drain('POST')">Drain</button> <button onclick="drain('DELETE')">Undrain</button></p>
+<table>
+<thead><tr><th>ID<th>Slot<th>Mode<th>Age<th>Tenant<th>Peers<th>Bytes<th></tr></thead>
+<tbody id=slots></tbody>
+</table>
+<pre id=timeline></pre>
+<script>
+async function api(method, path) {
+  const r = await fetch('/admin/api/' + path, {method, headers: {'X-Gowormhole-Admin': '1'}});
+  return r.json();
+}
+async function drain(method) { await api(method, 'drain'); load(); }
+async function kill(id) { await api('DELETE', 'slots/' + id); load(); }
+async function timeline(id) {
+  const s = await api('GET', 'slots/' + id);
+  document.getElementById('timeline').textContent = JSON.stringify(s.timeline, null, 2);
+}
+async function load() {
+  const s = await api('GET', 'status');
+  document.getElementById('status').textContent = s.draining ? 'draining' : 'serving';
+  const tbody = document.getElementById('slots');
+  tbody.innerHTML = '';
+  for (const x of await api('GET', 'slots')) {
+    const tr = tbody.insertRow();
+    for (const v of [x.id, x.slot, x.mode, x.age, x.tenant, x.peers.map(p => p.ip).join(', '), x.bytes]) {
+      tr.insertCell().textContent = v;
+    }
+    tr.insertCell().innerHTML = '<button onclick="timeline(' + x.id + ')">timeline</button> <button onclick="kill(' + x.id + ')">close</button>';
+  }
+}
+load();
+setInterval(load, 5000);
+</script>
+`
+
+// adminSlot is the JSON view of a slot in the admin API.
+type adminSlot struct {
+	ID       uint64      `json:"id"`
+	Slot     string      `json:"slot"`
+	Mode     string      `json:"mode"`
+	Created  time.Time   `json:"created"`
+	Age      string      `json:"age"`
+	Deadline time.Time   `json:"deadline"`
+	Tenant   string      `json:"tenant"`
+	Peers    []*SlotPeer `json:"peers"`
+	Bytes    int64       `json:"bytes"`
+	Timeline []SlotEvent `json:"timeline,omitempty"`
+}
+
+func newAdminSlot(item *SlotItem, timeline bool) adminSlot {
+	// Mode, Deadline etc. are updated under the lock of slots.
+	slots.lock.RLock()
+	defer slots.lock.RUnlock()
+
+	s := adminSlot{
+		ID:       item.ID,
+		Slot:     item.SlotKey,
+		Mode:     item.Mode.String(),
+		Created:  item.Created,
+		Age:      time.Since(item.Created).Round(time.Second).String(),
+		Deadline: item.Deadline(),
+		Tenant:   item.Tenant.Label(),
+		Peers:    item.Peers(),
+		Bytes:    item.Bytes.Load(),
+	}
+	if s.Peers == nil {
+		s.Peers = []*SlotPeer{}
+	}
+	if timeline {
+		s.Timeline = item.Timeline()
+	}
+	return s
+}
+
+// adminCSRFHeader must be sent by the browsers changing a state of the admin API,
+// which a cross-site form can't send.
+const adminCSRFHeader = "X-Gowormhole-Admin"
+
+// registerAdmin registers the admin API on mux, authenticated by token either
+// as a bearer or as the password of basic authentication for browsers.
+func registerAdmin(mux *http.ServeMux, token string) {
+	mux.Handle("/admin/", adminAuth(token, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(adminPage))
+	})))
+	mux.Handle("/admin/api/status", adminAuth(token, http.HandlerFunc(adminStatus)))
+	mux.Handle("/admin/api/drain", adminAuth(token, http.HandlerFunc(adminDrain)))
+	mux.Handle("/admin/api/slots", adminAuth(token, http.HandlerFunc(adminSlots)))
+	mux.Handle("/admin/api/slots/", adminAuth(token, http.HandlerFunc(adminSlotHandler)))
+}
+
+func adminAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, browser := bearerToken(r), false
+		if _, password, ok := r.BasicAuth(); ok {
+			given, browser = password, true
+		}
+		if given == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gowormhole admin"`)
+			adminError(w, http.StatusUnauthorized, "not authorized")
+			return
+		}
+		// The browsers send the basic authentication of cross-site requests too.
+		if browser && !adminSameSite(r) {
+			adminError(w, http.StatusForbidden, "cross-site request")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminSameSite reports whether a request may change a state with the basic
+// authentication of a browser: it must come from the admin page, which sends
+// adminCSRFHeader and, if any, an Origin of the same host.
+func adminSameSite(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	if r.Header.Get(adminCSRFHeader) == "" {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func adminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func adminError(w http.ResponseWriter, status int, msg string) {
+	adminJSON(w, status, map[string]string{"error": msg})
+}
+
+func adminStatus(w http.ResponseWriter, r *http.Request) {
+	adminJSON(w, http.StatusOK, map[string]interface{}{
+		"draining": slots.Draining(),
+		"sessions": len(slots.Sessions()),
+	})
+}
+
+// adminDrain starts draining by POST, and stops it by DELETE.
+func adminDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		slots.SetDraining(true)
+	case http.MethodDelete:
+		slots.SetDraining(false)
+	case http.MethodGet:
+	default:
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	adminJSON(w, http.StatusOK, map[string]bool{"draining": slots.Draining()})
+}
+
+func adminSlots(w http.ResponseWriter, r *http.Request) {
+	items := slots.Sessions()
+	result := make([]adminSlot, 0, len(items))
+	for _, item := range items {
+		result = append(result, newAdminSlot(item, false))
+	}
+	adminJSON(w, http.StatusOK, result)
+}
+
+// adminSlotHandler shows a slot with its timeline by GET, and force-closes it by DELETE.
+func adminSlotHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/admin/api/slots/"), 10, 64)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "bad slot id")
+		return
+	}
+	item, ok := slots.Session(id)
+	if !ok {
+		adminError(w, http.StatusNotFound, "no such slot")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		slots.ForceClose(item, wormhole.CloseSlotClosed, "closed by admin")
+	default:
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	adminJSON(w, http.StatusOK, newAdminSlot(item, true))
+}
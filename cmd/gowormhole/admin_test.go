@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminAuthCSRF(t *testing.T) {
+	h := adminAuth("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	do := func(method string, header map[string]string, basic bool) int {
+		r := httptest.NewRequest(method, "http://debug.example.com/admin/api/drain", nil)
+		if basic {
+			r.SetBasicAuth("admin", "secret")
+		} else {
+			r.Header.Set("Authorization", "Bearer secret")
+		}
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodGet, nil, true))
+	assert.Equal(t, http.StatusNoContent, do(http.MethodPost, nil, false))
+	// A cross-site form sends the basic authentication, but no custom header.
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, nil, true))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodDelete, map[string]string{
+		adminCSRFHeader: "1", "Origin": "https://evil.example.org",
+	}, true))
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, map[string]string{
+		adminCSRFHeader: "1", "Origin": "http://debug.example.com",
+	}, true))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// apiPrefix is the path prefix of the versioned JSON API of the signalling server:
+//
+//	POST   /api/v1/slots         reserves a slot, answers a SlotReservation
+//	DELETE /api/v1/slots/{slot}  releases a reserved slot nobody joined yet, answers 204
+//	GET    /api/v1/ice           answers an ICEConfig with fresh TURN credentials
+//
+// The requests are authenticated like the WebSocket ones. POST slots takes the
+// optional GoWormhole-TTL header to ask for a shorter TTL, and the optional name
+// query parameter to reserve a named slot of the tenant, e.g. ?name=build-farm.
+// DELETE takes the release token of the reservation in the
+// GoWormhole-Release-Token header.
+//
+// The errors answer an APIError with their status:
+//
+//	400 bad_request          the request is malformed, e.g. a bad TTL or slot name
+//	401 unauthorized         the bearer is missing or not valid
+//	403 forbidden            the origin isn't allowed, or the release token is wrong
+//	404 not_found            no such endpoint, or no such slot
+//	405 method_not_allowed   the endpoint doesn't take the method
+//	409 slot_in_use          a peer already joined the slot, or the named slot is taken
+//	429 rate_limited         too many requests, see -ip-limits and -bearer-limits
+//	429 quota_exceeded       the tenant used up its slot quota
+//	503 no_more_slots        the slot space is exhausted
+//	503 draining             the server is draining for a restart
+const apiPrefix = "/api/v1/"
+
+// GowormholeReleaseTokenHeader is the request header carrying the release token of a slot.
+const GowormholeReleaseTokenHeader = "GoWormhole-Release-Token"
+
+// APIError is the body of the errors of the API.
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// SlotReservation is the body of a reserved slot.
+type SlotReservation struct {
+	Slot    string    `json:"slot"`
+	Expires time.Time `json:"expires"`
+	// ReleaseToken is the token to release the slot before anyone joins it.
+	ReleaseToken string             `json:"releaseToken"`
+	ICEServers   []webrtc.ICEServer `json:"iceServers"`
+}
+
+// ICEConfig is the body of the ICE servers.
+type ICEConfig struct {
+	ICEServers []webrtc.ICEServer `json:"iceServers"`
+}
+
+// apiHandler serves the API under apiPrefix.
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	conf := serverConf.Load()
+	tenant := tenantOf(r)
+
+	resource, slotKey, hasSlot := strings.Cut(strings.TrimPrefix(r.URL.Path, apiPrefix), "/")
+	switch {
+	case resource == "slots" && !hasSlot:
+		if r.Method != http.MethodPost {
+			apiError(w, http.StatusMethodNotAllowed, "method_not_allowed", "use POST to reserve a slot")
+			return
+		}
+		if !conf.Limiters.AllowReserve(r) {
+			rejectionCounter.WithLabelValues("ratelimited").Inc()
+			apiError(w, http.StatusTooManyRequests, "rate_limited", "too many requests")
+			return
+		}
+		var ttl time.Duration
+		if h := r.Header.Get(GowormholeTTLHeader); h != "" {
+			var err error
+			if ttl, err = time.ParseDuration(h); err != nil || ttl < 0 {
+				apiError(w, http.StatusBadRequest, "bad_request", "bad "+GowormholeTTLHeader+" header")
+				return
+			}
+		}
+
+		item, err := slots.Reserve(tenant, r.URL.Query().Get("name"), ttl)
+		switch {
+		case errors.Is(err, ErrBadSlotName):
+			apiError(w, http.StatusBadRequest, "bad_request", err.Error())
+		case errors.Is(err, ErrSlotInUse):
+			apiError(w, http.StatusConflict, "slot_in_use", err.Error())
+		case errors.Is(err, ErrSlotQuotaExceeded):
+			apiError(w, http.StatusTooManyRequests, "quota_exceeded", err.Error())
+		case errors.Is(err, ErrNoMoreSlots):
+			apiError(w, http.StatusServiceUnavailable, "no_more_slots", err.Error())
+		case errors.Is(err, ErrDraining):
+			apiError(w, http.StatusServiceUnavailable, "draining", err.Error())
+		case err != nil:
+			apiError(w, http.StatusInternalServerError, "internal", err.Error())
+		default:
+			apiJSON(w, http.StatusCreated, SlotReservation{
+				Slot:         item.SlotKey,
+				Expires:      item.Deadline(),
+				ReleaseToken: item.ReleaseToken,
+				ICEServers:   conf.ICEServers(tenant),
+			})
+		}
+	case resource == "slots" && slotKey != "":
+		if r.Method != http.MethodDelete {
+			apiError(w, http.StatusMethodNotAllowed, "method_not_allowed", "use DELETE to release a slot")
+			return
+		}
+		switch err := slots.Release(tenant, slotKey, r.Header.Get(GowormholeReleaseTokenHeader)); {
+		case errors.Is(err, ErrNoSuchSlot):
+			apiError(w, http.StatusNotFound, "not_found", err.Error())
+		case errors.Is(err, ErrBadReleaseToken):
+			apiError(w, http.StatusForbidden, "forbidden", err.Error())
+		case errors.Is(err, ErrSlotInUse):
+			apiError(w, http.StatusConflict, "slot_in_use", err.Error())
+		case err != nil:
+			apiError(w, http.StatusInternalServerError, "internal", err.Error())
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case resource == "ice" && !hasSlot:
+		if r.Method != http.MethodGet {
+			apiError(w, http.StatusMethodNotAllowed, "method_not_allowed", "use GET to get the ICE servers")
+			return
+		}
+		apiJSON(w, http.StatusOK, ICEConfig{ICEServers: conf.ICEServers(tenant)})
+	default:
+		apiError(w, http.StatusNotFound, "not_found", "no such endpoint")
+	}
+}
+
+func apiJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, code, message string) {
+	apiJSON(w, status, APIError{Code: code, Message: message})
+}
+
+// isAPI tells the requests of the API, which answer errors as APIError.
+func isAPI(r *http.Request) bool { return strings.HasPrefix(r.URL.Path, apiPrefix) }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bingoohuang/gowormhole/wordlist"
+	"github.com/stretchr/testify/assert"
+)
+
+func apiRequest(t *testing.T, method, path string, header ...string) (*httptest.ResponseRecorder, APIError) {
+	r := httptest.NewRequest(method, path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	apiHandler(w, r)
+
+	var e APIError
+	if w.Code >= 400 {
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &e))
+	}
+	return w, e
+}
+
+func TestAPISlots(t *testing.T) {
+	w, _ := apiRequest(t, http.MethodPost, apiPrefix+"slots", GowormholeTTLHeader, "10m")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var res SlotReservation
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.True(t, slots.Has(nil, res.Slot))
+	assert.NotEmpty(t, res.ReleaseToken)
+
+	_, e := apiRequest(t, http.MethodDelete, apiPrefix+"slots/"+res.Slot, GowormholeReleaseTokenHeader, "wrong")
+	assert.Equal(t, "forbidden", e.Code)
+
+	w, _ = apiRequest(t, http.MethodDelete, apiPrefix+"slots/"+res.Slot, GowormholeReleaseTokenHeader, res.ReleaseToken)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.False(t, slots.Has(nil, res.Slot))
+
+	w, e = apiRequest(t, http.MethodDelete, apiPrefix+"slots/"+res.Slot, GowormholeReleaseTokenHeader, res.ReleaseToken)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "not_found", e.Code)
+
+	// Not once a peer joined.
+	item, err := slots.Reserve(nil, "", 0)
+	assert.Nil(t, err)
+	_, _, err = slots.Setup(nil, item.SlotKey)
+	assert.Nil(t, err)
+	defer slots.Delete(item)
+	w, e = apiRequest(t, http.MethodDelete, apiPrefix+"slots/"+item.SlotKey, GowormholeReleaseTokenHeader, item.ReleaseToken)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "slot_in_use", e.Code)
+
+	_, e = apiRequest(t, http.MethodPost, apiPrefix+"slots", GowormholeTTLHeader, "soon")
+	assert.Equal(t, "bad_request", e.Code)
+	_, e = apiRequest(t, http.MethodGet, apiPrefix+"slots")
+	assert.Equal(t, "method_not_allowed", e.Code)
+	_, e = apiRequest(t, http.MethodGet, apiPrefix+"nothing")
+	assert.Equal(t, "not_found", e.Code)
+}
+
+func TestAPIICE(t *testing.T) {
+	defer serverConf.Store(serverConf.Load())
+	conf := *serverConf.Load()
+	conf.TurnURLs, conf.TurnSecret = parseTurnURLs("turn.example.com"), "secret"
+	conf.StunServers = parseStunServers("stun.example.com")
+	serverConf.Store(&conf)
+
+	w, _ := apiRequest(t, http.MethodGet, apiPrefix+"ice")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var ice ICEConfig
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &ice))
+	assert.Equal(t, 2, len(ice.ICEServers))
+	assert.Equal(t, []string{"turn:turn.example.com:3478"}, ice.ICEServers[0].URLs)
+	assert.NotEmpty(t, ice.ICEServers[0].Username)
+	assert.Equal(t, []string{"stun:stun.example.com:3478"}, ice.ICEServers[1].URLs)
+}
+
+func TestRequestCode(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(apiHandler))
+	defer s.Close()
+
+	code, err := requestCode(CodeReq{Sigserv: s.URL, SecretLength: 2})
+	assert.Nil(t, err)
+	slot, pass := wordlist.DecodeSlot(code.Code)
+	assert.Equal(t, code.Slot, slot)
+	assert.Equal(t, code.Pass, pass)
+
+	assert.Nil(t, releaseCode(ReleaseReq{Sigserv: s.URL, Code: code.Code, ReleaseToken: code.ReleaseToken}))
+	assert.ErrorContains(t, releaseCode(ReleaseReq{Sigserv: s.URL, Code: code.Code, ReleaseToken: code.ReleaseToken}), "no such slot")
+}
+
+func TestRequestCodeLegacy(t *testing.T) {
+	// A server older than the API, failing to reserve.
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("GoWormhole") != GowormholeReserveslotkey {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(reserveSlotResult{Error: ErrNoMoreSlots.Error()})
+	}))
+	defer s.Close()
+
+	_, err := requestCode(CodeReq{Sigserv: s.URL, SecretLength: 2})
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), ErrNoMoreSlots.Error()))
+}
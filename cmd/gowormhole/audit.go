@@ -0,0 +1,266 @@
+package main
+
+// The audit log of the signalling server, a JSON line per slot written once the slot is over.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/golog/pkg/rotate"
+	"github.com/bingoohuang/gowormhole/internal/util"
+	"github.com/sirupsen/logrus"
+)
+
+// AuditRecord is the audit record of a slot.
+type AuditRecord struct {
+	ID       uint64      `json:"id"`
+	Slot     string      `json:"slot"`
+	Tenant   string      `json:"tenant"`
+	Created  time.Time   `json:"created"`
+	Reserved *time.Time  `json:"reserved,omitempty"`
+	Peers    []*SlotPeer `json:"peers"`
+	// Outcome is how the slot ended, e.g. direct, relay, failed, badkey, hungup, timeout,
+	// reservationexpired, released, closed or protocolerror.
+	Outcome string `json:"outcome"`
+	// PAKE is ok or badkey, empty if the peers never got to the key exchange.
+	PAKE string `json:"pake,omitempty"`
+	// ICE is direct, relay, success (method unknown) or failed, empty if not reported.
+	ICE string `json:"ice,omitempty"`
+	// Bytes is the number of signalling bytes relayed between the peers.
+	Bytes    int64         `json:"bytes"`
+	Ended    time.Time     `json:"ended"`
+	Duration util.Duration `json:"duration"`
+}
+
+// newAuditRecord creates the audit record of the slot ended at now.
+func newAuditRecord(item *SlotItem, now time.Time) *AuditRecord {
+	r := &AuditRecord{
+		ID:       item.ID,
+		Slot:     item.SlotKey,
+		Tenant:   item.Tenant.Label(),
+		Created:  item.Created,
+		Peers:    item.Peers(),
+		Outcome:  item.Outcome(),
+		Bytes:    item.Bytes.Load(),
+		Ended:    now,
+		Duration: util.Duration(now.Sub(item.Created)),
+	}
+	if !item.Reserved.IsZero() {
+		r.Reserved = &item.Reserved
+	}
+	if r.Peers == nil {
+		r.Peers = []*SlotPeer{}
+	}
+
+	switch r.Outcome {
+	case "badkey":
+		r.PAKE = "badkey"
+	case "direct", "relay", "success", "failed":
+		r.PAKE, r.ICE = "ok", r.Outcome
+	}
+	return r
+}
+
+const (
+	// auditQueueSize is the number of records buffered for the sinks, more are dropped.
+	auditQueueSize = 1024
+	// auditWebhookTimeout bounds each POST to a webhook, and the wait for the
+	// queued records on Close.
+	auditWebhookTimeout = 10 * time.Second
+)
+
+// AuditLog writes the audit records to its sinks in the background.
+type AuditLog struct {
+	sinks  []io.WriteCloser
+	queue  chan []byte
+	done   chan struct{}
+	closed bool
+	lock   sync.RWMutex
+}
+
+// audit is the audit log of the signalling server, nil when disabled.
+var audit *AuditLog
+
+// NewAuditLog creates an audit log writing to the comma separated sinks:
+// stdout, an http(s) webhook URL receiving each record by POST, or a file
+// path rotated daily and by size.
+func NewAuditLog(sinks string) (*AuditLog, error) {
+	var writers []io.WriteCloser
+	for _, sink := range strings.Split(sinks, ",") {
+		switch sink = strings.TrimSpace(sink); {
+		case sink == "":
+		case sink == "stdout":
+			writers = append(writers, nopCloser{os.Stdout})
+		case strings.HasPrefix(sink, "http://"), strings.HasPrefix(sink, "https://"):
+			writers = append(writers, newAuditWebhook(sink))
+		default:
+			r, err := rotate.New(strings.TrimPrefix(sink, "file:"), rotate.WithMaxSize(100<<20))
+			if err != nil {
+				return nil, fmt.Errorf("create audit file %s: %w", sink, err)
+			}
+			writers = append(writers, &auditFile{r})
+		}
+	}
+	return newAuditLog(writers...), nil
+}
+
+func newAuditLog(sinks ...io.WriteCloser) *AuditLog {
+	a := &AuditLog{
+		sinks: sinks,
+		queue: make(chan []byte, auditQueueSize),
+		done:  make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// Record queues the audit record of the slot, it never blocks.
+func (a *AuditLog) Record(item *SlotItem) {
+	if a == nil {
+		return
+	}
+
+	line, err := json.Marshal(newAuditRecord(item, time.Now()))
+	if err != nil {
+		log.Printf("marshal audit record failed: %v", err)
+		return
+	}
+
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if a.closed {
+		return
+	}
+	select {
+	case a.queue <- append(line, '\n'):
+	default:
+		log.Printf("audit queue full, dropped record of slot %d", item.ID)
+	}
+}
+
+func (a *AuditLog) run() {
+	defer close(a.done)
+
+	for line := range a.queue {
+		for _, sink := range a.sinks {
+			if _, err := sink.Write(line); err != nil {
+				log.Printf("write audit record failed: %v", err)
+			}
+		}
+	}
+}
+
+// Close writes the queued records and closes the sinks.
+func (a *AuditLog) Close() {
+	if a == nil {
+		return
+	}
+
+	a.lock.Lock()
+	a.closed = true
+	close(a.queue)
+	a.lock.Unlock()
+
+	<-a.done
+	for _, sink := range a.sinks {
+		_ = sink.Close()
+	}
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// auditFile is a rotated audit file.
+type auditFile struct{ r *rotate.Rotate }
+
+func (f *auditFile) Write(p []byte) (int, error) { return f.r.Write(logrus.InfoLevel, p) }
+func (f *auditFile) Close() error                { return f.r.Close() }
+
+// auditWebhook posts each record to a URL. It has its own queue, so that a slow
+// webhook doesn't stall the other sinks.
+type auditWebhook struct {
+	url    string
+	client *http.Client
+	queue  chan []byte
+	done   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newAuditWebhook(url string) *auditWebhook {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &auditWebhook{
+		url:    url,
+		client: &http.Client{Timeout: auditWebhookTimeout},
+		queue:  make(chan []byte, auditQueueSize),
+		done:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	go w.run()
+	return w
+}
+
+// Write queues the record, it never blocks.
+func (w *auditWebhook) Write(p []byte) (int, error) {
+	select {
+	case w.queue <- p:
+		return len(p), nil
+	default:
+		return 0, fmt.Errorf("audit webhook %s: queue full, dropped record", w.url)
+	}
+}
+
+func (w *auditWebhook) run() {
+	defer close(w.done)
+
+	for p := range w.queue {
+		if err := w.post(p); err != nil && w.ctx.Err() == nil {
+			log.Printf("write audit record failed: %v", err)
+		}
+	}
+}
+
+func (w *auditWebhook) post(p []byte) error {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.url, bytes.NewReader(p))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rsp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, rsp.Body)
+	if rsp.StatusCode/100 != 2 {
+		return fmt.Errorf("audit webhook %s: %s", w.url, rsp.Status)
+	}
+	return nil
+}
+
+// Close posts the queued records, and drops those still queued after auditWebhookTimeout.
+func (w *auditWebhook) Close() error {
+	close(w.queue)
+	select {
+	case <-w.done:
+	case <-time.After(auditWebhookTimeout):
+		w.cancel()
+		<-w.done
+		log.Printf("audit webhook %s: dropped the records queued on close", w.url)
+	}
+	w.cancel()
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	a := newAuditLog(nopCloser{&buf})
+
+	now := time.Now()
+	item := newSlotItem("42", 0, &Tenant{Name: "team-a"}, now)
+	item.AddPeer(&SlotPeer{IP: "10.0.0.1", UserAgent: "test", Joined: now})
+	item.SetOutcome("relay")
+	item.SetOutcome("hungup")
+	item.Bytes.Add(100)
+	a.Record(item)
+	a.Close()
+
+	var r AuditRecord
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &r))
+	assert.Equal(t, "42", r.Slot)
+	assert.Equal(t, "team-a", r.Tenant)
+	assert.Equal(t, "relay", r.Outcome)
+	assert.Equal(t, "ok", r.PAKE)
+	assert.Equal(t, "relay", r.ICE)
+	assert.Equal(t, int64(100), r.Bytes)
+	assert.Equal(t, "10.0.0.1", r.Peers[0].IP)
+	assert.Nil(t, r.Reserved)
+
+	// Records after Close are dropped.
+	a.Record(item)
+}
+
+func TestAuditWebhookDoesNotStall(t *testing.T) {
+	unblock := make(chan struct{})
+	posted := make(chan struct{}, 2)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		posted <- struct{}{}
+	}))
+	defer s.Close()
+
+	var buf bytes.Buffer
+	a := newAuditLog(newAuditWebhook(s.URL), nopCloser{&buf})
+	item := newSlotItem("42", 0, nil, time.Now())
+	a.Record(item)
+	a.Record(item)
+
+	// The stdout sink gets the records while the webhook hangs.
+	assert.Eventually(t, func() bool {
+		a.lock.RLock()
+		defer a.lock.RUnlock()
+		return len(a.queue) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	close(unblock)
+	a.Close()
+	assert.Equal(t, 2, bytes.Count(buf.Bytes(), []byte("\n")))
+	assert.Len(t, posted, 2)
+}
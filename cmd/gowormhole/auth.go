@@ -0,0 +1,322 @@
+package main
+
+// Multi-tenant authentication of the signalling server. A bearer token is resolved
+// to a Tenant, either by a token registry file or by validating it as a JWT.
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/gowormhole/internal/util"
+)
+
+var (
+	// ErrUnauthorized is returned when the bearer token is missing or unknown.
+	ErrUnauthorized = errors.New("not authorized")
+	// ErrTenantDisabled is returned when the tenant of the token is disabled.
+	ErrTenantDisabled = errors.New("tenant disabled")
+)
+
+// defaultTenant is the tenant name used when no tenant is configured.
+const defaultTenant = "default"
+
+// Tenant is the policy attached to a bearer token.
+type Tenant struct {
+	// Name is the tenant name, used in metrics labels.
+	Name string `json:"tenant"`
+	// Token is the bearer token, only used by the token registry file.
+	Token string `json:"token,omitempty"`
+	// SlotQuota is the maximum number of busy slots of the tenant, 0 means unlimited.
+	SlotQuota int `json:"slotQuota,omitempty"`
+	// TurnServers is the list of TURN servers the tenant is allowed to use, as
+	// host, host:port or TURN URL, empty means all.
+	TurnServers []string `json:"turnServers,omitempty"`
+	// MaxSlotTTL caps the TTL of the tenant's slots, 0 means the server's TTLs.
+	MaxSlotTTL util.Duration `json:"maxSlotTTL,omitempty"`
+	// Enabled is whether the tenant may use the server, defaults to true.
+	Enabled *bool `json:"enabled,omitempty"`
+	// Webhooks receive the events of the tenant's slots, besides the ones of the server.
+	Webhooks []WebhookTarget `json:"webhooks,omitempty"`
+}
+
+// IsEnabled tells whether the tenant is enabled.
+func (t *Tenant) IsEnabled() bool { return t.Enabled == nil || *t.Enabled }
+
+// Label returns the tenant name for metrics labels.
+func (t *Tenant) Label() string {
+	if t == nil || t.Name == "" {
+		return defaultTenant
+	}
+	return t.Name
+}
+
+// CapTTL caps ttl by the tenant's MaxSlotTTL.
+func (t *Tenant) CapTTL(ttl time.Duration) time.Duration {
+	if t == nil || t.MaxSlotTTL <= 0 || (ttl > 0 && ttl <= t.MaxSlotTTL.D()) {
+		return ttl
+	}
+	return t.MaxSlotTTL.D()
+}
+
+// AllowTurn tells whether the tenant may use the TURN server URL addr: its host
+// must equal the host of one of the tenant's TURN servers, and its port too
+// when given.
+func (t *Tenant) AllowTurn(addr string) bool {
+	if t == nil || len(t.TurnServers) == 0 {
+		return true
+	}
+	host, port := turnHostPort(addr)
+	for _, s := range t.TurnServers {
+		h, p := turnHostPort(s)
+		if strings.EqualFold(h, host) && (p == "" || p == port) {
+			return true
+		}
+	}
+	return false
+}
+
+// turnHostPort returns the host and port of a TURN URL, e.g.
+// turn:host:port?transport=udp, or of a host[:port], the port is empty if not given.
+func turnHostPort(addr string) (host, port string) {
+	for _, scheme := range []string{"turn:", "turns:"} {
+		if strings.HasPrefix(addr, scheme) {
+			addr, _, _ = strings.Cut(strings.TrimPrefix(addr, scheme), "?")
+			break
+		}
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		return host, port
+	}
+	return strings.Trim(addr, "[]"), ""
+}
+
+// TokenRegistry is a set of tenants keyed by token, loaded from a JSON file.
+//
+//	{"tokens": [{"token": "xyz", "tenant": "team-a", "slotQuota": 100, "maxSlotTTL": "1h"}]}
+type TokenRegistry struct {
+	file    string
+	modTime time.Time
+	tokens  map[string]*Tenant
+	lock    sync.RWMutex
+}
+
+// NewTokenRegistry loads the token registry from file.
+func NewTokenRegistry(file string) (*TokenRegistry, error) {
+	r := &TokenRegistry{file: file}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Lookup returns the tenant of token.
+func (r *TokenRegistry) Lookup(token string) (*Tenant, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	t, ok := r.tokens[token]
+	return t, ok
+}
+
+// Reload reloads the registry file if it is modified, and reports whether it was.
+func (r *TokenRegistry) Reload() (bool, error) {
+	stat, err := os.Stat(r.file)
+	if err != nil {
+		return false, err
+	}
+
+	r.lock.RLock()
+	modified := !stat.ModTime().Equal(r.modTime)
+	r.lock.RUnlock()
+	if !modified {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(r.file)
+	if err != nil {
+		return false, err
+	}
+
+	var f struct {
+		Tokens []*Tenant `json:"tokens"`
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return false, fmt.Errorf("parse token registry %s: %w", r.file, err)
+	}
+
+	tokens := make(map[string]*Tenant, len(f.Tokens))
+	for _, t := range f.Tokens {
+		if t.Token == "" {
+			return false, fmt.Errorf("token registry %s: empty token of tenant %s", r.file, t.Name)
+		}
+		tokens[t.Token] = t
+	}
+
+	r.lock.Lock()
+	r.tokens, r.modTime = tokens, stat.ModTime()
+	r.lock.Unlock()
+	return true, nil
+}
+
+// Watch reloads the registry every interval until ctx is done.
+func (r *TokenRegistry) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if ok, err := r.Reload(); err != nil {
+				log.Printf("reload token registry failed: %v", err)
+			} else if ok {
+				log.Printf("token registry %s reloaded", r.file)
+			}
+		}
+	}
+}
+
+// jwtClaims are the claims of a tenant JWT, signed by HS256.
+type jwtClaims struct {
+	Tenant
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf"`
+}
+
+// parseJWT validates an HS256 JWT signed by key and returns its tenant.
+func parseJWT(token string, key []byte, now time.Time) (*Tenant, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed jwt: %w", ErrUnauthorized)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return nil, fmt.Errorf("unsupported jwt header: %w", ErrUnauthorized)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt signature: %w", ErrUnauthorized)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, fmt.Errorf("bad jwt signature: %w", ErrUnauthorized)
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed jwt claims: %w", ErrUnauthorized)
+	}
+	if claims.ExpiresAt > 0 && now.Unix() >= claims.ExpiresAt {
+		return nil, fmt.Errorf("jwt expired: %w", ErrUnauthorized)
+	}
+	if claims.NotBefore > 0 && now.Unix() < claims.NotBefore {
+		return nil, fmt.Errorf("jwt not valid yet: %w", ErrUnauthorized)
+	}
+
+	t := claims.Tenant
+	if t.Name == "" {
+		t.Name = claims.Subject
+	}
+	return &t, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Auth authenticates the requests to the signalling server.
+type Auth struct {
+	// Bearer is the single shared bearer token, mapped to the default tenant.
+	Bearer string
+	// Registry is the token registry, optional.
+	Registry *TokenRegistry
+	// JWTKey is the HS256 key to validate JWT tokens, optional.
+	JWTKey []byte
+}
+
+// Enabled tells whether any authentication is configured.
+func (a *Auth) Enabled() bool {
+	return a.Bearer != "" || a.Registry != nil || len(a.JWTKey) > 0
+}
+
+// Authenticate resolves the bearer token of the request to its tenant.
+func (a *Auth) Authenticate(r *http.Request) (*Tenant, error) {
+	if !a.Enabled() {
+		return &Tenant{Name: defaultTenant}, nil
+	}
+
+	token := bearerToken(r)
+	if token == "" {
+		return nil, ErrUnauthorized
+	}
+
+	t, err := a.lookup(token)
+	if err != nil {
+		return nil, err
+	}
+	if !t.IsEnabled() {
+		return nil, ErrTenantDisabled
+	}
+	return t, nil
+}
+
+func (a *Auth) lookup(token string) (*Tenant, error) {
+	if a.Bearer != "" && subtle.ConstantTimeCompare([]byte(a.Bearer), []byte(token)) == 1 {
+		return &Tenant{Name: defaultTenant}, nil
+	}
+	if a.Registry != nil {
+		if t, ok := a.Registry.Lookup(token); ok {
+			return t, nil
+		}
+	}
+	if len(a.JWTKey) > 0 && strings.Count(token, ".") == 2 {
+		return parseJWT(token, a.JWTKey, time.Now())
+	}
+	return nil, ErrUnauthorized
+}
+
+// bearerToken returns the token of the Authorization: Bearer header, the scheme is case-insensitive.
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+type tenantKey struct{}
+
+// withTenant returns a copy of the request carrying the tenant.
+func withTenant(r *http.Request, t *Tenant) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), tenantKey{}, t))
+}
+
+// tenantOf returns the tenant carried by the request, nil if none.
+func tenantOf(r *http.Request) *Tenant {
+	t, _ := r.Context().Value(tenantKey{}).(*Tenant)
+	return t
+}
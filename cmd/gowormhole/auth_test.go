@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func signJWT(key []byte, claims string) string {
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func TestParseJWT(t *testing.T) {
+	key := []byte("secret")
+	now := time.Unix(1700000000, 0)
+
+	token := signJWT(key, `{"sub":"team-a","slotQuota":10,"maxSlotTTL":"30m","exp":1700000100}`)
+	tenant, err := parseJWT(token, key, now)
+	assert.Nil(t, err)
+	assert.Equal(t, "team-a", tenant.Name)
+	assert.Equal(t, 10, tenant.SlotQuota)
+	assert.Equal(t, 30*time.Minute, tenant.MaxSlotTTL.D())
+
+	_, err = parseJWT(token, []byte("other"), now)
+	assert.True(t, errors.Is(err, ErrUnauthorized))
+
+	_, err = parseJWT(token, key, now.Add(time.Hour))
+	assert.True(t, errors.Is(err, ErrUnauthorized))
+}
+
+func TestTenantAllowTurn(t *testing.T) {
+	tenant := &Tenant{TurnServers: []string{"turn.example.com", "turn:relay.example.com:3478"}}
+	assert.True(t, tenant.AllowTurn("turn:turn.example.com:3478?transport=udp"))
+	assert.True(t, tenant.AllowTurn("turns:TURN.example.com:443?transport=tcp"))
+	assert.True(t, tenant.AllowTurn("turn:relay.example.com:3478"))
+	assert.False(t, tenant.AllowTurn("turn:relay.example.com:3479"))
+	assert.False(t, tenant.AllowTurn("turn:evilturn.example.com:3478"))
+	assert.False(t, tenant.AllowTurn("turn:turn.example.com.evil.org:3478"))
+
+	var all *Tenant
+	assert.True(t, all.AllowTurn("turn:any.example.com:3478"))
+}
@@ -0,0 +1,228 @@
+package main
+
+// The configuration file shared by the client, server and turn commands.
+//
+//	profile: work
+//	profiles:
+//	  work:
+//	    sigserv: https://wormhole.example.com
+//	    bearer: xyz
+//	    icePolicy: relay
+//	    dir: ~/Downloads
+//	    timeouts: {failedTimeout: 20s}
+//	server:
+//	  stun: [stun.example.com, stun.l.google.com:19302]
+//	  turn: turn.example.com
+//	  ip-limits: slots=0.5/20,conns=50
+//	turn:
+//	  realm: example.com
+//	  users: scott=tiger
+//	  listen: [udp://:3478, tls://:443?cert=turn.crt&key=turn.key]
+//
+// The server and turn sections hold flag values by flag name, the flags given
+// on the command line override them.
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bingoohuang/gg/pkg/ss"
+	"github.com/bingoohuang/gowormhole/wormhole"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration file, in YAML or JSON.
+type Config struct {
+	// Profile is the name of the client profile used when -profile is not given.
+	Profile string `json:"profile"`
+	// Profiles are the named client profiles.
+	Profiles map[string]*Profile `json:"profiles"`
+	// Server holds the flags of the server command.
+	Server map[string]interface{} `json:"server"`
+	// Turn holds the flags of the turn command.
+	Turn map[string]interface{} `json:"turn"`
+
+	file     string
+	optional bool
+}
+
+// Profile is a named set of client settings.
+type Profile struct {
+	Sigserv  string            `json:"sigserv"`
+	Bearer   string            `json:"bearer"`
+	Timeouts wormhole.Timeouts `json:"timeouts"`
+	// ICEPolicy is all (default) or relay to only use TURN relays.
+	ICEPolicy string `json:"icePolicy"`
+	// Dir is the directory to put received files.
+	Dir string `json:"dir"`
+}
+
+var (
+	// config is the loaded configuration file, empty if there is none.
+	config = &Config{}
+	// profile is the client profile in use, never nil.
+	profile = &Profile{}
+)
+
+// loadConfig loads the config file, or the default one if file is empty,
+// and applies the client profile.
+func loadConfig(file, profileName string) (err error) {
+	if config, err = LoadConfig(ss.Or(file, defaultConfigFile()), file == ""); err != nil {
+		return err
+	}
+	if profile, err = config.GetProfile(profileName); err != nil {
+		return err
+	}
+
+	switch profile.ICEPolicy {
+	case "", "all":
+	case "relay":
+		wormhole.ForceRelay = true
+	default:
+		return fmt.Errorf("bad icePolicy %q, should be all or relay", profile.ICEPolicy)
+	}
+	if os.Getenv("SIGSERV") == "" && profile.Sigserv != "" {
+		Sigserv = profile.Sigserv
+	}
+	return nil
+}
+
+// defaultConfigFile returns the config file in the user config dir,
+// e.g. ~/.config/gowormhole/config.yaml, config.yml or config.json.
+func defaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	dir = filepath.Join(dir, "gowormhole")
+	for _, name := range []string{"config.yaml", "config.yml", "config.json"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return filepath.Join(dir, name)
+		}
+	}
+	return filepath.Join(dir, "config.yaml")
+}
+
+// LoadConfig loads the config file. A missing file gives an empty config when
+// optional, e.g. the default file in the user config dir.
+func LoadConfig(file string, optional bool) (*Config, error) {
+	c := &Config{file: file, optional: optional}
+	if file == "" {
+		return c, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if optional && errors.Is(err, fs.ErrNotExist) {
+			return c, nil
+		}
+		return nil, err
+	}
+
+	// JSON is YAML, so decode YAML to generic values and then reuse the JSON tags.
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", file, err)
+	}
+	if data, err = json.Marshal(v); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", file, err)
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", file, err)
+	}
+	return c, nil
+}
+
+// Reload loads the config file again.
+func (c *Config) Reload() (*Config, error) {
+	return LoadConfig(c.file, c.optional)
+}
+
+// GetProfile returns the profile by name, or the default profile if name is empty.
+func (c *Config) GetProfile(name string) (*Profile, error) {
+	name = ss.Or(name, c.Profile)
+	if name == "" {
+		return &Profile{}, nil
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("no profile %q in config %s", name, c.file)
+	}
+	p.Dir = expandHome(p.Dir)
+	return p, nil
+}
+
+// expandHome expands the leading ~ of path to the home dir.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+// explicitFlags returns the names of the flags given on the command line.
+func explicitFlags(f *flag.FlagSet) map[string]bool {
+	set := map[string]bool{}
+	f.Visit(func(fl *flag.Flag) { set[fl.Name] = true })
+	return set
+}
+
+// applyConfig sets the flags of f by values from the config file, except the
+// explicit ones given on the command line. Lists are joined by commas.
+func applyConfig(f *flag.FlagSet, values map[string]interface{}, explicit map[string]bool) error {
+	for name, v := range values {
+		if explicit[name] {
+			continue
+		}
+		if f.Lookup(name) == nil {
+			return fmt.Errorf("unknown flag %q in config section of %s", name, f.Name())
+		}
+		if err := f.Set(name, configValue(v)); err != nil {
+			return fmt.Errorf("config %s of %s: %w", name, f.Name(), err)
+		}
+	}
+	return nil
+}
+
+// resetFlags resets the flags of f to their defaults, except the explicit ones,
+// so that the values removed from the config file are not kept on reload.
+func resetFlags(f *flag.FlagSet, explicit map[string]bool) {
+	f.VisitAll(func(fl *flag.Flag) {
+		if !explicit[fl.Name] {
+			_ = fl.Value.Set(fl.DefValue)
+		}
+	})
+}
+
+func configValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case []interface{}:
+		items := make([]string, len(x))
+		for i, item := range x {
+			items[i] = configValue(item)
+		}
+		return strings.Join(items, ",")
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+// defaultBearer returns $BEARER, or the bearer of the profile.
+func defaultBearer() string {
+	return ss.Or(os.Getenv("BEARER"), profile.Bearer)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, os.WriteFile(file, []byte(`
+profile: work
+profiles:
+  work:
+    sigserv: https://wormhole.example.com
+    icePolicy: relay
+    timeouts: {failedTimeout: 20s}
+server:
+  stun: [a.example.com, b.example.com]
+  waiting-ttl: 1m
+`), 0o600))
+
+	c, err := LoadConfig(file, false)
+	assert.Nil(t, err)
+
+	p, err := c.GetProfile("")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://wormhole.example.com", p.Sigserv)
+	assert.Equal(t, "relay", p.ICEPolicy)
+	assert.Equal(t, 20*time.Second, p.Timeouts.FailedTimeout.D())
+
+	_, err = c.GetProfile("home")
+	assert.NotNil(t, err)
+
+	f := flag.NewFlagSet("server", flag.ContinueOnError)
+	stun := f.String("stun", "", "")
+	waitingTTL := f.Duration("waiting-ttl", time.Hour, "")
+	assert.Nil(t, f.Parse([]string{"-waiting-ttl", "5m"}))
+
+	// The explicit flag overrides the config file.
+	assert.Nil(t, applyConfig(f, c.Server, explicitFlags(f)))
+	assert.Equal(t, "a.example.com,b.example.com", *stun)
+	assert.Equal(t, 5*time.Minute, *waitingTTL)
+
+	_, err = LoadConfig(filepath.Join(t.TempDir(), "missing.yaml"), true)
+	assert.Nil(t, err)
+}
@@ -133,10 +133,13 @@ func RecvFiles(argJSON *C.char, outParam **C.char, outLen *C.int) int {
 // (注：可选参数，可以在 JSON 中直接不传递）
 // bearer:  必须。信令服务器授权令牌码
 // sigserv:  可选。信令服务器地址，默认 http://gowormhole.d5k.co
+// room:  可选。命名房间，例如 build-farm，短码形如 build-farm+acorn-acre
 //
 // 输出 JSON 文件内容示例：
-// {"code": "", "error":""}
+// {"code": "", "expires": "", "releaseToken": "", "error":""}
 // code: 传输短码
+// expires: 传输短码过期时间
+// releaseToken: 释放传输短码的令牌 (releaseCode 操作)
 // error: 错误信息
 //
 //export CreateCode
@@ -0,0 +1,322 @@
+package main
+
+// The doctor command checks, in order, what a transfer needs: the signalling
+// server and its protocol version, the bearer, the ICE servers the server
+// gives, the NAT behavior, and a wormhole with itself. It ends with a verdict:
+//
+//	direct likely   the peers should connect peer-to-peer
+//	relay required  the peers need the TURN servers
+//	will fail       no transfer can succeed from here
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bingoohuang/gowormhole"
+	"github.com/bingoohuang/gowormhole/internal/util"
+	"github.com/bingoohuang/gowormhole/wormhole"
+	"github.com/pion/logging"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	verdictDirect = "direct likely"
+	verdictRelay  = "relay required"
+	verdictFail   = "will fail"
+
+	// doctorNATTimeout bounds each STUN request of the NAT tests.
+	doctorNATTimeout = 3 * time.Second
+	// doctorPing is the message sent through the loopback wormholes.
+	doctorPing = "gowormhole doctor"
+)
+
+// DoctorOptions are the options of the doctor command.
+type DoctorOptions struct {
+	Sigserv string
+	Bearer  string
+	// StunServer is the STUN server of the NAT tests, which must support
+	// RFC 5780, the NAT tests are skipped if empty.
+	StunServer string
+	// Timeout bounds each check.
+	Timeout time.Duration
+	// Loopback does a wormhole with itself, directly then by the TURN servers.
+	Loopback bool
+}
+
+// DoctorCheck is the result of a check of the doctor.
+type DoctorCheck struct {
+	Name string `json:"name"`
+	// Status is ok, fail or skip.
+	Status  string        `json:"status"`
+	Detail  string        `json:"detail,omitempty"`
+	Error   string        `json:"error,omitempty"`
+	Latency util.Duration `json:"latency,omitempty"`
+}
+
+// DoctorReport is the report of the doctor.
+type DoctorReport struct {
+	Sigserv string         `json:"sigserv"`
+	Checks  []*DoctorCheck `json:"checks"`
+	// Mapping and Filtering are the NAT behaviors, empty if unknown.
+	Mapping   string `json:"mapping,omitempty"`
+	Filtering string `json:"filtering,omitempty"`
+	Verdict   string `json:"verdict"`
+}
+
+func doctorSubCmd(ctx context.Context, args ...string) {
+	set := flag.NewFlagSet(args[0], flag.ExitOnError)
+	set.Usage = func() {
+		_, _ = fmt.Fprintf(set.Output(), "check the signalling server, the ICE servers and the NAT, and tell whether a transfer can succeed\n\n")
+		_, _ = fmt.Fprintf(set.Output(), "usage: %s %s\n\n", os.Args[0], args[0])
+		_, _ = fmt.Fprintf(set.Output(), "flags:\n")
+		set.PrintDefaults()
+	}
+
+	o := DoctorOptions{Sigserv: Sigserv}
+	set.StringVar(&o.Bearer, "bearer", defaultBearer(), "Bearer authentication, defaults to $BEARER or the bearer of the profile")
+	set.StringVar(&o.StunServer, "stun", "stun.voip.blackberry.com", "STUN server supporting RFC 5780 for the NAT tests, empty to skip them")
+	set.DurationVar(&o.Timeout, "timeout", 10*time.Second, "timeout of each check")
+	set.BoolVar(&o.Loopback, "loopback", true, "do a wormhole with itself through the signalling server")
+	asJSON := set.Bool("json", false, "print the report as JSON")
+	_ = set.Parse(args[1:])
+
+	r := runDoctor(ctx, o)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(r)
+	} else {
+		r.print(os.Stdout)
+	}
+	if r.Verdict == verdictFail {
+		os.Exit(1)
+	}
+}
+
+// runDoctor runs the checks of o.
+func runDoctor(ctx context.Context, o DoctorOptions) *DoctorReport {
+	r := &DoctorReport{Sigserv: o.Sigserv, Checks: []*DoctorCheck{}}
+	check := func(name string, f func() (string, error)) *DoctorCheck {
+		c := &DoctorCheck{Name: name, Status: "ok"}
+		start := time.Now()
+		detail, err := f()
+		c.Latency = util.Duration(time.Since(start))
+		c.Detail = detail
+		if err != nil {
+			c.Status, c.Error = "fail", err.Error()
+		}
+		r.Checks = append(r.Checks, c)
+		return c
+	}
+	skip := func(name, detail string) {
+		r.Checks = append(r.Checks, &DoctorCheck{Name: name, Status: "skip", Detail: detail})
+	}
+
+	// The signalling server gives the ICE servers in the InitMsg of a new slot.
+	var initMsg *wormhole.InitMsg
+	var probeErr error
+	signalling := check("signalling", func() (string, error) {
+		probeCtx, cancel := context.WithTimeout(ctx, o.Timeout)
+		defer cancel()
+		var transport string
+		initMsg, transport, probeErr = wormhole.Probe(probeCtx, o.Sigserv, o.Bearer)
+		switch {
+		case errors.Is(probeErr, wormhole.ErrUnauthorized):
+			// The server answered, the bearer check tells the rest.
+			return "reachable", nil
+		case errors.Is(probeErr, wormhole.ErrBadVersion):
+			return "", fmt.Errorf("the server runs another version of the protocol than %s, upgrade the client", wormhole.Protocol)
+		case probeErr != nil:
+			return "", probeErr
+		}
+		return fmt.Sprintf("protocol %s over %s", wormhole.Protocol, transport), nil
+	})
+	if signalling.Status != "ok" {
+		skip("bearer", "signalling failed")
+	} else {
+		check("bearer", func() (string, error) {
+			if errors.Is(probeErr, wormhole.ErrUnauthorized) {
+				return "", errors.New("rejected by the server, see -bearer")
+			}
+			return util.If(o.Bearer == "", "none needed", "accepted"), nil
+		})
+	}
+
+	// The ICE servers given by the signalling server.
+	var stunServers, turnServers []webrtc.ICEServer
+	if initMsg != nil {
+		for _, s := range initMsg.ICEServers {
+			for _, u := range s.URLs {
+				server := webrtc.ICEServer{URLs: []string{u}, Username: s.Username, Credential: s.Credential}
+				if strings.HasPrefix(u, "turn") {
+					turnServers = append(turnServers, server)
+				} else {
+					stunServers = append(stunServers, server)
+				}
+			}
+		}
+	}
+	stunOK, turnOK := false, false
+	if len(stunServers)+len(turnServers) == 0 {
+		skip("ice", "no ICE servers from the signalling server")
+	}
+	for _, c := range selfcheck(stunServers, turnServers, o.Timeout).Checks {
+		dc := &DoctorCheck{Name: c.Kind, Status: "ok", Detail: c.Server, Error: c.Error, Latency: c.Latency}
+		if c.Error != "" {
+			dc.Status = "fail"
+		} else {
+			dc.Detail += " " + util.If(c.Kind == "stun", "mapped ", "relayed ") + c.Address
+			stunOK = stunOK || c.Kind == "stun"
+			turnOK = turnOK || c.Kind == "turn"
+		}
+		r.Checks = append(r.Checks, dc)
+	}
+
+	// The NAT behavior of RFC 4787, by the RFC 5780 tests.
+	if o.StunServer == "" {
+		skip("nat", "no STUN server for the NAT tests")
+	} else {
+		n := &natCmd{
+			log:            logging.NewDefaultLeveledLoggerForScope("nat", logging.LogLevelError, io.Discard),
+			timeout:        doctorNATTimeout,
+			stunServerAddr: util.AppendPort(o.StunServer, gowormhole.DefaultStunPort),
+		}
+		check("nat mapping", func() (s string, err error) {
+			r.Mapping, err = n.mappingTests()
+			return r.Mapping, err
+		})
+		check("nat filtering", func() (s string, err error) {
+			r.Filtering, err = n.filteringTests()
+			return r.Filtering, err
+		})
+	}
+
+	// A wormhole with itself, directly then by the TURN servers only.
+	directLoopback, relayLoopback := "", ""
+	switch {
+	case !o.Loopback:
+		skip("loopback", "disabled by -loopback")
+	case signalling.Status != "ok" || initMsg == nil:
+		skip("loopback", "signalling failed")
+	default:
+		directLoopback = check("loopback", func() (string, error) {
+			return doctorLoopback(ctx, o, false)
+		}).Status
+		if len(turnServers) == 0 {
+			skip("loopback relay", "no TURN servers")
+		} else {
+			relayLoopback = check("loopback relay", func() (string, error) {
+				return doctorLoopback(ctx, o, true)
+			}).Status
+		}
+	}
+
+	r.Verdict = doctorVerdict(initMsg != nil, stunOK, turnOK && relayLoopback != "fail", directLoopback != "fail", r.Mapping)
+	return r
+}
+
+// doctorVerdict tells whether a transfer can succeed, from whether the
+// signalling works, a STUN server answers, a TURN server relays, the loopback
+// wormhole works, and the NAT mapping behavior.
+func doctorVerdict(signalling, stunOK, relayOK, loopbackOK bool, mapping string) string {
+	if !signalling || !loopbackOK {
+		return verdictFail
+	}
+	// The mapping behavior is known only if a STUN server answered.
+	stunOK = stunOK || mapping != ""
+	// The peers behind a NAT mapping per destination can't connect directly,
+	// but to the peers with no NAT.
+	symmetric := mapping == natAddressDependent || mapping == natAddressAndPortDependent
+	switch {
+	case stunOK && !symmetric:
+		return verdictDirect
+	case relayOK:
+		return verdictRelay
+	}
+	return verdictFail
+}
+
+// doctorLoopback does a wormhole with itself on a reserved code, by the TURN
+// servers only if relay, and sends a message through it.
+func doctorLoopback(ctx context.Context, o DoctorOptions, relay bool) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, o.Timeout)
+	defer cancel()
+
+	code, err := requestCode(CodeReq{Bearer: o.Bearer, Sigserv: o.Sigserv, SecretLength: 2, TTL: util.Duration(o.Timeout)})
+	if err != nil {
+		return "", err
+	}
+
+	type result struct {
+		c   *wormhole.Wormhole
+		err error
+	}
+	results := make(chan result, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			c, err := wormhole.SetupRelay(ctx, code.Slot, string(code.Pass), o.Sigserv, o.Bearer, nil, wormhole.ForceRelay || relay)
+			results <- result{c, err}
+		}()
+	}
+	var conns []*wormhole.Wormhole
+	for i := 0; i < 2; i++ {
+		if res := <-results; res.err != nil {
+			err = res.err
+		} else {
+			conns = append(conns, res.c)
+		}
+	}
+	defer func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}()
+	if err != nil {
+		return "", err
+	}
+
+	received := make(chan error, 1)
+	go func() {
+		p := make([]byte, len(doctorPing))
+		_, err := io.ReadFull(conns[1], p)
+		if err == nil && string(p) != doctorPing {
+			err = fmt.Errorf("received %q instead of %q", p, doctorPing)
+		}
+		received <- err
+	}()
+	if _, err := conns[0].Write([]byte(doctorPing)); err != nil {
+		return "", err
+	}
+	select {
+	case err := <-received:
+		if err != nil {
+			return "", err
+		}
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	return util.If(conns[0].IsRelay(), "connected by relay", "connected directly"), nil
+}
+
+// print prints the report for humans.
+func (r *DoctorReport) print(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "signalling server %s\n\n", r.Sigserv)
+	for _, c := range r.Checks {
+		line := fmt.Sprintf("%-4s  %-14s %s", strings.ToUpper(c.Status), c.Name, c.Detail)
+		if c.Error != "" {
+			line += util.If(c.Detail == "", "", ": ") + c.Error
+		}
+		if c.Status != "skip" {
+			line += fmt.Sprintf(" (%s)", c.Latency.D().Round(time.Millisecond))
+		}
+		_, _ = fmt.Fprintln(w, strings.TrimRight(line, " "))
+	}
+	_, _ = fmt.Fprintf(w, "\nverdict: %s\n", r.Verdict)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoctorVerdict(t *testing.T) {
+	assert.Equal(t, verdictDirect, doctorVerdict(true, true, false, true, ""))
+	assert.Equal(t, verdictDirect, doctorVerdict(true, false, false, true, natEndpointIndependent))
+	assert.Equal(t, verdictRelay, doctorVerdict(true, true, true, true, natAddressAndPortDependent))
+	assert.Equal(t, verdictFail, doctorVerdict(true, true, false, true, natAddressDependent))
+	assert.Equal(t, verdictFail, doctorVerdict(true, false, false, true, ""))
+	assert.Equal(t, verdictFail, doctorVerdict(false, true, true, true, ""))
+	assert.Equal(t, verdictFail, doctorVerdict(true, true, true, false, ""))
+}
+
+func TestDoctor(t *testing.T) {
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.Nil(t, err)
+	port := l.LocalAddr().(*net.UDPAddr).Port
+	_ = l.Close()
+	turnServer, err := newTurnServer(TurnOptions{PublicIP: "127.0.0.1", Port: port, Realm: "example.com", AuthSecret: "secret"}, nil)
+	assert.Nil(t, err)
+	defer turnServer.Close()
+
+	defer serverConf.Store(serverConf.Load())
+	conf := *serverConf.Load()
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+	conf.TurnURLs, conf.TurnSecret, conf.TurnTTL = parseTurnURLs(addr), "secret", time.Hour
+	conf.StunServers = parseStunServers(addr)
+	serverConf.Store(&conf)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, apiPrefix) {
+			apiHandler(w, r)
+		} else {
+			relay(w, r)
+		}
+	}))
+	defer s.Close()
+
+	r := runDoctor(context.Background(), DoctorOptions{Sigserv: s.URL + "/", Timeout: 20 * time.Second, Loopback: true})
+	statuses := map[string]string{}
+	for _, c := range r.Checks {
+		statuses[c.Name] = c.Status
+		assert.Empty(t, c.Error, c.Name)
+	}
+	assert.Equal(t, map[string]string{
+		"signalling":     "ok",
+		"bearer":         "ok",
+		"stun":           "ok",
+		"turn":           "ok",
+		"nat":            "skip",
+		"loopback":       "ok",
+		"loopback relay": "ok",
+	}, statuses)
+	assert.Equal(t, "connected by relay", r.Checks[len(r.Checks)-1].Detail)
+	assert.Equal(t, verdictDirect, r.Verdict)
+	var out strings.Builder
+	r.print(&out)
+	assert.Contains(t, out.String(), "verdict: direct likely")
+
+	// An unreachable server fails all.
+	s.Close()
+	r = runDoctor(context.Background(), DoctorOptions{Sigserv: s.URL + "/", Timeout: time.Second, Loopback: true})
+	assert.Equal(t, "fail", r.Checks[0].Status)
+	assert.Equal(t, verdictFail, r.Verdict)
+}
@@ -0,0 +1,272 @@
+package main
+
+// The health endpoints of the signalling server, on the debug listener:
+//
+//	/healthz    liveness, ok while the process serves HTTP
+//	/readyz     readiness, fails while draining or when the slot table is near exhaustion
+//	/selfcheck  STUN binding requests and a TURN allocation against the configured ICE servers
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/gowormhole"
+	"github.com/bingoohuang/gowormhole/internal/util"
+	"github.com/pion/dtls/v2"
+	"github.com/pion/logging"
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// readyOccupancy is the slot occupancy above which the server is not ready,
+	// so that the load balancer sends the new clients elsewhere.
+	readyOccupancy = 0.9
+	// selfcheckTimeout bounds each check of the self check.
+	selfcheckTimeout = 5 * time.Second
+)
+
+// registerHealth registers the health endpoints on mux.
+func registerHealth(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz)
+	mux.HandleFunc("/selfcheck", selfcheckHandler)
+}
+
+func healthz(w http.ResponseWriter, r *http.Request) {
+	adminJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func readyz(w http.ResponseWriter, r *http.Request) {
+	occupancy := slots.Occupancy()
+	status := "ok"
+	switch {
+	case slots.Draining():
+		status = "draining"
+	case occupancy >= readyOccupancy:
+		status = "slots exhausted"
+	}
+
+	adminJSON(w, util.If(status == "ok", http.StatusOK, http.StatusServiceUnavailable), map[string]interface{}{
+		"status":    status,
+		"occupancy": occupancy,
+	})
+}
+
+// CheckResult is the result of checking an ICE server.
+type CheckResult struct {
+	// Kind is stun or turn.
+	Kind   string `json:"kind"`
+	Server string `json:"server"`
+	// Address is the mapped address by STUN, or the relayed address allocated by TURN.
+	Address string        `json:"address,omitempty"`
+	Latency util.Duration `json:"latency"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// SelfCheck is the result of checking all the configured ICE servers.
+type SelfCheck struct {
+	OK     bool           `json:"ok"`
+	Checks []*CheckResult `json:"checks"`
+}
+
+// selfcheckHandler checks the configured ICE servers, it answers 503 if any
+// check fails. It allocates on the TURN servers, so it is served only on the
+// debug listener.
+func selfcheckHandler(w http.ResponseWriter, r *http.Request) {
+	conf := serverConf.Load()
+	result := selfcheck(conf.StunServers, conf.TurnServers(nil), selfcheckTimeout)
+	adminJSON(w, util.If(result.OK, http.StatusOK, http.StatusServiceUnavailable), result)
+}
+
+// selfcheck does a STUN binding request against each STUN server and a TURN
+// allocation against each TURN server concurrently.
+func selfcheck(stunServers, turnServers []webrtc.ICEServer, timeout time.Duration) *SelfCheck {
+	result := &SelfCheck{OK: true, Checks: []*CheckResult{}}
+	for _, s := range stunServers {
+		for _, u := range s.URLs {
+			result.Checks = append(result.Checks, &CheckResult{Kind: "stun", Server: u})
+		}
+	}
+	for _, s := range turnServers {
+		for _, u := range s.URLs {
+			result.Checks = append(result.Checks, &CheckResult{Kind: "turn", Server: u})
+		}
+	}
+
+	credentials := map[string]webrtc.ICEServer{}
+	for _, s := range turnServers {
+		for _, u := range s.URLs {
+			credentials[u] = s
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range result.Checks {
+		wg.Add(1)
+		go func(c *CheckResult) {
+			defer wg.Done()
+
+			s := credentials[c.Server]
+			password, _ := s.Credential.(string)
+			start := time.Now()
+			addr, err := checkICEServer(c.Kind, c.Server, s.Username, password, nil, timeout)
+			c.Latency = util.Duration(time.Since(start))
+			if err != nil {
+				c.Error = err.Error()
+			} else {
+				c.Address = addr.String()
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	for _, c := range result.Checks {
+		if c.Error != "" {
+			result.OK = false
+		}
+	}
+	return result
+}
+
+// iceServerConn connects to the ICE server of url, e.g. turn:host:port?transport=udp,
+// over its transport, and returns the conn and the server address for a pion
+// turn client. The TLS and DTLS connections are verified by tlsConfig, or
+// against the host of url if nil.
+func iceServerConn(url string, tlsConfig *tls.Config, timeout time.Duration) (net.PacketConn, string, error) {
+	scheme, addr, _ := strings.Cut(url, ":")
+	addr, query, _ := strings.Cut(addr, "?")
+	secure := scheme == "turns" || scheme == "stuns"
+	transport := util.If(secure, "tcp", "udp")
+	if _, t, ok := strings.Cut(query, "transport="); ok {
+		transport, _, _ = strings.Cut(t, "&")
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), strconv.Itoa(util.If(secure, defaultTurnsPort, gowormhole.DefaultTurnPort)))
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); !secure && transport == "udp" && (ip == nil || ip.To4() != nil) {
+		conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+		return conn, addr, err
+	}
+
+	// pion turn clients resolve the server address in udp4 only, and the conns
+	// below are connected, so they are given an address they won't use.
+	const connected = "0.0.0.0:0"
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	switch {
+	case transport == "tcp" && secure:
+		conn, err := tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+		if err != nil {
+			return nil, "", err
+		}
+		return turn.NewSTUNConn(conn), connected, nil
+	case transport == "tcp":
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			return nil, "", err
+		}
+		return turn.NewSTUNConn(conn), connected, nil
+	case secure:
+		raddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, "", err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		conn, err := dtls.DialWithContext(ctx, "udp", raddr, &dtls.Config{
+			ServerName:         tlsConfig.ServerName,
+			RootCAs:            tlsConfig.RootCAs,
+			InsecureSkipVerify: tlsConfig.InsecureSkipVerify,
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		return &connectedPacketConn{Conn: conn}, connected, nil
+	default:
+		conn, err := dialer.Dial("udp", addr)
+		if err != nil {
+			return nil, "", err
+		}
+		return &connectedPacketConn{Conn: conn}, connected, nil
+	}
+}
+
+// connectedPacketConn is a PacketConn over a connected datagram conn.
+type connectedPacketConn struct {
+	net.Conn
+}
+
+func (c *connectedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := c.Read(p)
+	return n, c.RemoteAddr(), err
+}
+
+func (c *connectedPacketConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	return c.Write(p)
+}
+
+// checkICEServer does a STUN binding request, or a TURN allocation, against
+// the server of url within timeout, and returns the mapped or relayed address.
+func checkICEServer(kind, url, username, password string, tlsConfig *tls.Config, timeout time.Duration) (net.Addr, error) {
+	conn, addr, err := iceServerConn(url, tlsConfig, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: addr,
+		TURNServerAddr: addr,
+		Conn:           conn,
+		Username:       username,
+		Password:       password,
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Closing the client fails the pending transaction on timeout.
+	defer client.Close()
+	if err := client.Listen(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		addr net.Addr
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		if kind == "stun" {
+			addr, err := client.SendBindingRequest()
+			ch <- result{addr, err}
+			return
+		}
+
+		relayConn, err := client.Allocate()
+		if err != nil {
+			ch <- result{nil, err}
+			return
+		}
+		ch <- result{relayConn.LocalAddr(), nil}
+		_ = relayConn.Close()
+	}()
+
+	select {
+	case r := <-ch:
+		return r.addr, r.err
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("timed out after %s", timeout)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadyz(t *testing.T) {
+	w := httptest.NewRecorder()
+	readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	slots.SetDraining(true)
+	defer slots.SetDraining(false)
+
+	w = httptest.NewRecorder()
+	readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), `"draining"`)
+}
+
+func TestSelfcheck(t *testing.T) {
+	// Pick a free UDP port for the TURN server.
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.Nil(t, err)
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	_ = pc.Close()
+
+	o := TurnOptions{PublicIP: "127.0.0.1", Port: port, Realm: "test", AuthSecret: "secret"}
+	s, err := newTurnServer(o, nil)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	c := &ServerConf{TurnURLs: parseTurnURLs(o.Addr()), TurnSecret: o.AuthSecret, TurnTTL: time.Hour}
+	result := selfcheck(parseStunServers(o.Addr()), c.TurnServers(nil), 2*time.Second)
+	assert.True(t, result.OK, "%+v", result.Checks)
+	assert.Len(t, result.Checks, 2)
+	for _, check := range result.Checks {
+		assert.Empty(t, check.Error)
+		assert.NotEmpty(t, check.Address)
+	}
+
+	// A bad credential fails the TURN allocation only.
+	c.TurnSecret = "bad"
+	result = selfcheck(parseStunServers(o.Addr()), c.TurnServers(nil), 2*time.Second)
+	assert.False(t, result.OK)
+	assert.Empty(t, result.Checks[0].Error)
+	assert.NotEmpty(t, result.Checks[1].Error)
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bingoohuang/gg/pkg/defaults"
@@ -21,6 +22,7 @@ import (
 	"github.com/bingoohuang/gowormhole/wordlist"
 	"github.com/bingoohuang/jj"
 	"github.com/go-resty/resty/v2"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func httpCmd(ctx context.Context, args ...string) {
@@ -38,6 +40,8 @@ func httpCmd(ctx context.Context, args ...string) {
 	godaemon.Daemonize(*pDaemon)
 	golog.Setup()
 
+	// The transfer metrics of this client, and the rest of the registry.
+	http.Handle("/metrics", promhttp.Handler())
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if err := httpService(w, r); err != nil {
 			log.Printf("error: %v", err)
@@ -86,6 +90,8 @@ func httpService(w http.ResponseWriter, r *http.Request) error {
 		switch op.String() {
 		case "createCode":
 			return responseJSON(w, createCode(body))
+		case "releaseCode":
+			return responseJSON(w, releaseCodeOp(body))
 		}
 	}
 
@@ -137,11 +143,19 @@ type CodeReq struct {
 	Bearer       string `json:"bearer"`
 	SecretLength int    `json:"secretLength" default:"2"`
 	Sigserv      string `json:"sigserv"`
+	// TTL is the requested time to live of the reserved code, capped by the server.
+	TTL util.Duration `json:"ttl"`
+	// Room is the name of the slot to reserve, a numeric one is allocated if empty.
+	Room string `json:"room"`
 }
 
 type CodeRsp struct {
-	Code string `json:"code"`
-	Err  error  `json:"error,omitempty"`
+	Code    string    `json:"code"`
+	Expires time.Time `json:"expires,omitempty"`
+	// ReleaseToken releases the code by the releaseCode operation, before anyone uses it.
+	ReleaseToken string `json:"releaseToken,omitempty"`
+	Err          error  `json:"-"`
+	ErrString    string `json:"error,omitempty"`
 }
 
 func createCode(argJSON string) (resultJSON string) {
@@ -151,6 +165,7 @@ func createCode(argJSON string) (resultJSON string) {
 	defer func() {
 		if result.Err != nil {
 			log.Printf("error occured: %+v", result.Err)
+			result.ErrString = result.Err.Error()
 		}
 
 		j, _ := json.Marshal(result)
@@ -172,34 +187,162 @@ func createCode(argJSON string) (resultJSON string) {
 	}
 
 	result.Code = code.Code
+	result.Expires = code.Expires
+	result.ReleaseToken = code.ReleaseToken
+	return
+}
+
+// ReleaseReq is the argument of the releaseCode operation.
+type ReleaseReq struct {
+	Bearer       string `json:"bearer"`
+	Sigserv      string `json:"sigserv"`
+	Code         string `json:"code"`
+	ReleaseToken string `json:"releaseToken"`
+}
+
+func releaseCodeOp(argJSON string) (resultJSON string) {
+	var req ReleaseReq
+	var result CodeRsp
+
+	defer func() {
+		if result.Err != nil {
+			log.Printf("error occured: %+v", result.Err)
+			result.ErrString = result.Err.Error()
+		}
+
+		j, _ := json.Marshal(result)
+		log.Printf("releaseCode result: %s", j)
+		resultJSON = string(j)
+	}()
+
+	if err := json.Unmarshal([]byte(argJSON), &req); err != nil {
+		result.Err = fmt.Errorf("json.Unmarshal %s: %w", argJSON, err)
+		return
+	}
+
+	result.Code = req.Code
+	if err := releaseCode(req); err != nil {
+		result.Err = fmt.Errorf("release slot failed: %w", err)
+	}
 	return
 }
 
 type CodeStruct struct {
-	SlotNum int
-	Pass    []byte
-	Code    string
+	// Slot is the number or the name of the slot.
+	Slot         string
+	Pass         []byte
+	Code         string
+	Expires      time.Time
+	ReleaseToken string
 }
 
-const GowormholeReserveslotkey = "reserve_slot_key"
+const (
+	GowormholeReserveslotkey = "reserve_slot_key"
+	// GowormholeTTLHeader is the request header to ask for the TTL of a reserved slot.
+	GowormholeTTLHeader = "GoWormhole-TTL"
+)
 
+// sigservURL returns the URL of the path on the signalling server.
+func sigservURL(sigserv, path string) string {
+	return strings.TrimSuffix(ss.Or(sigserv, Sigserv), "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+// requestCode reserves a slot by the API of the signalling server, and
+// generates the code of the slot with a new password.
 func requestCode(req CodeReq) (codeStruct CodeStruct, err error) {
+	var reservation SlotReservation
+	var apiErr APIError
+	r := rest.R().
+		SetHeader("Authorization", "Bearer "+req.Bearer).
+		SetResult(&reservation).
+		SetError(&apiErr)
+	if req.TTL > 0 {
+		r.SetHeader(GowormholeTTLHeader, req.TTL.D().String())
+	}
+	if req.Room != "" {
+		r.SetQueryParam("name", req.Room)
+	}
+	rsp, err := r.Post(sigservURL(req.Sigserv, apiPrefix+"slots"))
+	if err != nil {
+		return codeStruct, err
+	}
+	if rsp.StatusCode() == http.StatusNotFound && apiErr.Code == "" {
+		if req.Room != "" {
+			return codeStruct, fmt.Errorf("reserve slot: the server doesn't support named rooms")
+		}
+		// A server older than the API.
+		return requestCodeLegacy(req)
+	}
+	if rsp.IsError() {
+		return codeStruct, fmt.Errorf("reserve slot: %s %s", rsp.Status(), apiErr.Message)
+	}
+
+	pass := util.RandPass(req.SecretLength)
+	code := wordlist.EncodeSlot(reservation.Slot, pass)
+	if code == "" {
+		return codeStruct, fmt.Errorf("reserve slot: bad slot %q", reservation.Slot)
+	}
+	return CodeStruct{
+		Slot:         reservation.Slot,
+		Pass:         pass,
+		Code:         code,
+		Expires:      reservation.Expires,
+		ReleaseToken: reservation.ReleaseToken,
+	}, nil
+}
+
+// requestCodeLegacy reserves a slot by the GoWormhole header, for the servers older than the API.
+func requestCodeLegacy(req CodeReq) (codeStruct CodeStruct, err error) {
 	var reserveResult reserveSlotResult
-	_, err = rest.R().
+	r := rest.R().
 		SetHeader("GoWormhole", GowormholeReserveslotkey).
-		SetHeader("Authorization", "bearer "+req.Bearer).
+		SetHeader("Authorization", "Bearer "+req.Bearer).
 		SetResult(&reserveResult).
-		Get(ss.Or(req.Sigserv, Sigserv))
+		SetError(&reserveResult)
+	if req.TTL > 0 {
+		r.SetHeader(GowormholeTTLHeader, req.TTL.D().String())
+	}
+	rsp, err := r.Get(ss.Or(req.Sigserv, Sigserv))
+	if err != nil {
+		return codeStruct, err
+	}
+	if rsp.IsError() || reserveResult.Error != "" {
+		return codeStruct, fmt.Errorf("reserve slot: %s %s", rsp.Status(), reserveResult.Error)
+	}
+
+	slotNum, err := strconv.Atoi(reserveResult.Key)
+	if err != nil {
+		return codeStruct, fmt.Errorf("reserve slot: bad slot %q", reserveResult.Key)
+	}
 	pass := util.RandPass(req.SecretLength)
-	slotNum, _ := strconv.Atoi(reserveResult.Key)
-	code := wordlist.Encode(slotNum, pass)
-	codeStruct = CodeStruct{
-		SlotNum: slotNum,
+	return CodeStruct{
+		Slot:    reserveResult.Key,
 		Pass:    pass,
-		Code:    code,
+		Code:    wordlist.Encode(slotNum, pass),
+		Expires: reserveResult.Expires,
+	}, nil
+}
+
+// releaseCode releases the slot of the code reserved by requestCode.
+func releaseCode(req ReleaseReq) error {
+	slot, pass := wordlist.DecodeSlot(req.Code)
+	if pass == nil {
+		return fmt.Errorf("bad code %q", req.Code)
 	}
 
-	return
+	var apiErr APIError
+	rsp, err := rest.R().
+		SetHeader("Authorization", "Bearer "+req.Bearer).
+		SetHeader(GowormholeReleaseTokenHeader, req.ReleaseToken).
+		SetError(&apiErr).
+		Delete(sigservURL(req.Sigserv, apiPrefix+"slots/"+slot))
+	if err != nil {
+		return err
+	}
+	if rsp.IsError() {
+		return fmt.Errorf("release slot %s: %s %s", slot, rsp.Status(), apiErr.Message)
+	}
+	return nil
 }
 
 func recvFiles(argJSON string) (resultJSON string) {
@@ -0,0 +1,497 @@
+package main
+
+// The mailbox of the signalling server, storing the ciphertext bundles sent to
+// offline receivers until they fetch them once, see wormhole.MailboxPath.
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/gg/pkg/iox"
+	"github.com/bingoohuang/gowormhole/internal/util"
+	"github.com/bingoohuang/gowormhole/wordlist"
+	"github.com/bingoohuang/gowormhole/wormhole"
+)
+
+const (
+	defaultMailboxMaxSize  = 100 << 20
+	defaultMailboxMaxTotal = 1 << 30
+	defaultMailboxTTL      = 24 * time.Hour
+	// mailboxMinPass is the min length of the password of mailbox codes, the
+	// bundles can be attacked offline so it is longer than for a PAKE.
+	mailboxMinPass = 4
+)
+
+var (
+	// ErrMailboxFull is returned when the mailbox has no room for a bundle.
+	ErrMailboxFull = errors.New("mailbox full")
+	// ErrBundleTooLarge is returned when a bundle is larger than the max size.
+	ErrBundleTooLarge = errors.New("bundle too large")
+	// ErrBundleTooSmall is returned when a bundle is smaller than any sealed bundle.
+	ErrBundleTooSmall = errors.New("bundle too small")
+	// ErrNoSuchBundle is returned when a bundle doesn't exist, has expired or was fetched.
+	ErrNoSuchBundle = errors.New("no such bundle")
+	// ErrBadToken is returned when fetching a bundle with a wrong token.
+	ErrBadToken = errors.New("bad token")
+)
+
+// Mailbox stores the bundles as files of a directory.
+type Mailbox struct {
+	Dir string
+	// MaxSize is the max size of a bundle.
+	MaxSize int64
+	// MaxTotal is the max size of all the bundles.
+	MaxTotal int64
+	// TTL is the max time a bundle is kept.
+	TTL time.Duration
+
+	bundles map[string]*mailboxBundle
+	total   int64
+	lock    sync.Mutex
+}
+
+type mailboxBundle struct {
+	tenant  string
+	expires time.Time
+	// tokenHash is the hash of the token to fetch the bundle, empty until uploaded.
+	tokenHash string
+	size      int64
+	// uploading is set while the bundle is uploaded.
+	uploading bool
+	// fetching is set while the bundle is downloaded.
+	fetching bool
+}
+
+// mailbox is the mailbox of the signalling server, nil when disabled.
+var mailbox *Mailbox
+
+// NewMailbox creates a mailbox in dir, the bundles left from a previous run
+// expire ttl after they were written.
+func NewMailbox(dir string, maxSize, maxTotal int64, ttl time.Duration) (*Mailbox, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	m := &Mailbox{Dir: dir, MaxSize: maxSize, MaxTotal: maxTotal, TTL: ttl, bundles: make(map[string]*mailboxBundle)}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		id, tokenHash, ok := strings.Cut(e.Name(), ".")
+		if _, err := strconv.Atoi(id); !ok || err != nil || info.Size() < int64(wormhole.MailboxMinBundle) {
+			// Leftovers of interrupted uploads.
+			_ = os.Remove(filepath.Join(dir, e.Name()))
+			continue
+		}
+		m.bundles[id] = &mailboxBundle{tokenHash: tokenHash, size: info.Size(), expires: info.ModTime().Add(ttl)}
+		m.total += info.Size()
+	}
+	return m, nil
+}
+
+func (m *Mailbox) path(id string, b *mailboxBundle) string {
+	return filepath.Join(m.Dir, id+"."+b.tokenHash)
+}
+
+// Reserve reserves a mailbox for the tenant, ttl is capped by TTL.
+func (m *Mailbox) Reserve(tenant *Tenant, ttl time.Duration) (id string, expires time.Time, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.total >= m.MaxTotal {
+		return "", time.Time{}, ErrMailboxFull
+	}
+	if ttl <= 0 || ttl > m.TTL {
+		ttl = m.TTL
+	}
+
+	for _, bits := range []int{7, 11, 16, 21} {
+		for i := 0; i < 64; i++ {
+			id = strconv.Itoa(util.RandIntn(1 << bits))
+			if _, ok := m.bundles[id]; ok {
+				continue
+			}
+			expires = time.Now().Add(tenant.CapTTL(ttl))
+			m.bundles[id] = &mailboxBundle{tenant: tenant.Label(), expires: expires}
+			return id, expires, nil
+		}
+	}
+	return "", time.Time{}, ErrMailboxFull
+}
+
+// Put stores the bundle read from r in the mailbox id reserved by the tenant.
+func (m *Mailbox) Put(tenant *Tenant, id, tokenHash string, r io.Reader) error {
+	if len(tokenHash) != 64 || strings.Trim(tokenHash, "0123456789abcdef") != "" {
+		return ErrBadToken
+	}
+	m.lock.Lock()
+	b, ok := m.bundles[id]
+	if !ok || b.tokenHash != "" || b.tenant != tenant.Label() {
+		m.lock.Unlock()
+		return ErrNoSuchBundle
+	}
+	// Taken by this upload, another one gets ErrNoSuchBundle.
+	b.tokenHash, b.uploading = tokenHash, true
+	m.lock.Unlock()
+
+	size, err := m.write(id, b, r)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err == nil && m.total+size > m.MaxTotal {
+		err = ErrMailboxFull
+	}
+	if err != nil {
+		_ = os.Remove(m.path(id, b))
+		delete(m.bundles, id)
+		return err
+	}
+	b.size, b.uploading = size, false
+	m.total += size
+	return nil
+}
+
+// write writes the bundle to a temporary file first, so that it is never found partially written.
+func (m *Mailbox) write(id string, b *mailboxBundle, r io.Reader) (int64, error) {
+	f, err := os.CreateTemp(m.Dir, ".upload-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	size, err := io.Copy(f, io.LimitReader(r, m.MaxSize+1))
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return 0, err
+	}
+	if size > m.MaxSize {
+		return 0, ErrBundleTooLarge
+	}
+	if size < int64(wormhole.MailboxMinBundle) {
+		return 0, ErrBundleTooSmall
+	}
+	return size, os.Rename(f.Name(), m.path(id, b))
+}
+
+// Open opens the bundle to fetch it with the token, done must be called with
+// whether the whole bundle was sent, then the bundle is deleted.
+func (m *Mailbox) Open(id, token string) (f *os.File, size int64, done func(sent bool), err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	b, ok := m.bundles[id]
+	if !ok || b.tokenHash == "" || b.uploading || b.fetching {
+		return nil, 0, nil, ErrNoSuchBundle
+	}
+	if subtle.ConstantTimeCompare([]byte(wormhole.MailboxTokenHash(token)), []byte(b.tokenHash)) != 1 {
+		return nil, 0, nil, ErrBadToken
+	}
+	if f, err = os.Open(m.path(id, b)); err != nil {
+		return nil, 0, nil, err
+	}
+
+	b.fetching = true
+	return f, b.size, func(sent bool) {
+		_ = f.Close()
+
+		m.lock.Lock()
+		defer m.lock.Unlock()
+
+		b.fetching = false
+		if sent {
+			m.remove(id, b)
+		}
+	}, nil
+}
+
+// Len returns the number of bundles, reserved or stored.
+func (m *Mailbox) Len() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return len(m.bundles)
+}
+
+// remove deletes the bundle, this assumes the mailbox is locked.
+func (m *Mailbox) remove(id string, b *mailboxBundle) {
+	if m.bundles[id] != b {
+		return
+	}
+	delete(m.bundles, id)
+	m.total -= b.size
+	if b.tokenHash != "" {
+		_ = os.Remove(m.path(id, b))
+	}
+}
+
+// Reap deletes the expired bundles, but the ones being fetched or uploaded.
+func (m *Mailbox) Reap(now time.Time) (reaped int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for id, b := range m.bundles {
+		if now.Before(b.expires) || b.fetching || b.uploading {
+			continue
+		}
+		m.remove(id, b)
+		reaped++
+	}
+	return reaped
+}
+
+// RunReaper reaps the mailbox every interval until ctx is done.
+func (m *Mailbox) RunReaper(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			if n := m.Reap(now); n > 0 {
+				log.Printf("reaped %d mailbox bundles", n)
+			}
+		}
+	}
+}
+
+type mailboxResult struct {
+	ID      string    `json:"id,omitempty"`
+	Expires time.Time `json:"expires,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// mailboxHandler serves the mailbox under wormhole.MailboxPath.
+func mailboxHandler(w http.ResponseWriter, r *http.Request) {
+	if mailbox == nil {
+		http.Error(w, "mailbox disabled", http.StatusNotFound)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/"+wormhole.MailboxPath)
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		if !serverConf.Load().Limiters.AllowSlot(r) {
+			rejectionCounter.WithLabelValues("ratelimited").Inc()
+			mailboxJSON(w, http.StatusTooManyRequests, mailboxResult{Error: "too many requests"})
+			return
+		}
+		ttl, _ := time.ParseDuration(r.Header.Get(GowormholeTTLHeader))
+		id, expires, err := mailbox.Reserve(tenantOf(r), ttl)
+		if err != nil {
+			mailboxJSON(w, http.StatusInsufficientStorage, mailboxResult{Error: err.Error()})
+			return
+		}
+		mailboxJSON(w, http.StatusOK, mailboxResult{ID: id, Expires: expires})
+	case id != "" && r.Method == http.MethodPut:
+		err := mailbox.Put(tenantOf(r), id, r.Header.Get(wormhole.MailboxTokenHeader), r.Body)
+		switch {
+		case err == nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errors.Is(err, ErrBundleTooLarge):
+			mailboxJSON(w, http.StatusRequestEntityTooLarge, mailboxResult{Error: err.Error()})
+		case errors.Is(err, ErrMailboxFull):
+			mailboxJSON(w, http.StatusInsufficientStorage, mailboxResult{Error: err.Error()})
+		case errors.Is(err, ErrNoSuchBundle):
+			mailboxJSON(w, http.StatusNotFound, mailboxResult{Error: err.Error()})
+		default:
+			mailboxJSON(w, http.StatusBadRequest, mailboxResult{Error: err.Error()})
+		}
+	case id != "" && r.Method == http.MethodGet:
+		f, size, done, err := mailbox.Open(id, r.Header.Get(wormhole.MailboxTokenHeader))
+		switch {
+		case errors.Is(err, ErrBadToken):
+			mailboxJSON(w, http.StatusForbidden, mailboxResult{Error: err.Error()})
+			return
+		case err != nil:
+			mailboxJSON(w, http.StatusNotFound, mailboxResult{Error: ErrNoSuchBundle.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		n, err := io.Copy(w, f)
+		done(err == nil && n == size)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func mailboxJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// sendMailbox uploads the files to a mailbox on the signalling server, and returns the code to fetch them.
+func sendMailbox(sigserv, bearer string, length int, ttl time.Duration, files []string) (code string, expires time.Time, err error) {
+	var reserved mailboxResult
+	req := rest.R().SetHeader("Authorization", "Bearer "+bearer).SetResult(&reserved).SetError(&reserved)
+	if ttl > 0 {
+		req.SetHeader(GowormholeTTLHeader, ttl.String())
+	}
+	rsp, err := req.Post(sigservURL(sigserv, wormhole.MailboxPath))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if rsp.IsError() {
+		return "", time.Time{}, fmt.Errorf("reserve mailbox: %s %s", rsp.Status(), reserved.Error)
+	}
+
+	pass := util.RandPass(util.If(length < mailboxMinPass, mailboxMinPass, length))
+	id, _ := strconv.Atoi(reserved.ID)
+	key, token := wormhole.MailboxKeys(reserved.ID, pass)
+
+	// Stream the bundle of the files, sealed while uploaded.
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(writeBundle(pw, key, files)) }()
+
+	put, err := http.NewRequest(http.MethodPut, sigservURL(sigserv, wormhole.MailboxPath+reserved.ID), pr)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	put.Header.Set("Authorization", "Bearer "+bearer)
+	put.Header.Set(wormhole.MailboxTokenHeader, wormhole.MailboxTokenHash(token))
+	put.Header.Set("Content-Type", "application/octet-stream")
+	putRsp, err := http.DefaultClient.Do(put)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer iox.Close(putRsp.Body)
+
+	if putRsp.StatusCode != http.StatusNoContent {
+		var result mailboxResult
+		_ = json.NewDecoder(putRsp.Body).Decode(&result)
+		return "", time.Time{}, fmt.Errorf("upload mailbox: %s %s", putRsp.Status, result.Error)
+	}
+	return wordlist.Encode(id, pass), reserved.Expires, nil
+}
+
+// writeBundle writes the files as a tar sealed by key.
+func writeBundle(w io.Writer, key *[32]byte, files []string) error {
+	sealer, err := wormhole.SealBundle(w, key)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(sealer)
+	for _, file := range files {
+		if err := addTarFile(tw, file); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return sealer.Close()
+}
+
+func addTarFile(tw *tar.Writer, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer iox.Close(f)
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", file)
+	}
+
+	hdr := &tar.Header{Name: filepath.Base(file), Mode: 0o644, Size: info.Size(), ModTime: info.ModTime()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	n, err := io.Copy(tw, f)
+	transferBytesCounter.WithLabelValues("sent").Add(float64(n))
+	return err
+}
+
+// receiveMailbox fetches the bundle of the code from the mailbox on the
+// signalling server, and extracts the files into dir.
+func receiveMailbox(sigserv, bearer, code, dir string) (files []string, err error) {
+	slot, pass := wordlist.Decode(code)
+	if pass == nil {
+		return nil, errors.New("bad code, could not decode password")
+	}
+	id := strconv.Itoa(slot)
+	key, token := wormhole.MailboxKeys(id, pass)
+
+	req, err := http.NewRequest(http.MethodGet, sigservURL(sigserv, wormhole.MailboxPath+id), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+bearer)
+	req.Header.Set(wormhole.MailboxTokenHeader, token)
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer iox.Close(rsp.Body)
+
+	if rsp.StatusCode != http.StatusOK {
+		var result mailboxResult
+		_ = json.NewDecoder(rsp.Body).Decode(&result)
+		return nil, fmt.Errorf("fetch mailbox %s: %s %s", id, rsp.Status, result.Error)
+	}
+
+	plain, err := wormhole.OpenBundle(rsp.Body, key)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(plain)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		} else if err != nil {
+			return files, err
+		}
+
+		base := filepath.Base(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || base == "." || base == ".." || base == string(filepath.Separator) {
+			return files, fmt.Errorf("bad file name %q in bundle", hdr.Name)
+		}
+		name := filepath.Join(dir, base)
+		if err := extractTarFile(tr, name); err != nil {
+			return files, err
+		}
+		files = append(files, name)
+	}
+}
+
+func extractTarFile(r io.Reader, name string) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	transferBytesCounter.WithLabelValues("received").Add(float64(n))
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bingoohuang/gowormhole/wordlist"
+	"github.com/bingoohuang/gowormhole/wormhole"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMailboxSendReceive(t *testing.T) {
+	m, err := NewMailbox(t.TempDir(), 1<<20, 1<<20, time.Hour)
+	assert.Nil(t, err)
+	mailbox = m
+	defer func() { mailbox = nil }()
+
+	s := httptest.NewServer(http.HandlerFunc(mailboxHandler))
+	defer s.Close()
+
+	src := filepath.Join(t.TempDir(), "hello.txt")
+	assert.Nil(t, os.WriteFile(src, []byte("hello mailbox"), 0o644))
+
+	code, expires, err := sendMailbox(s.URL, "", 2, time.Minute, []string{src})
+	assert.Nil(t, err)
+	assert.True(t, time.Until(expires) <= time.Minute)
+
+	// The server only has the ciphertext.
+	p, err := os.ReadFile(filepath.Join(m.Dir, firstFile(t, m.Dir)))
+	assert.Nil(t, err)
+	assert.NotContains(t, string(p), "hello mailbox")
+
+	// A wrong password neither decrypts nor deletes the bundle.
+	slot, _ := wordlist.Decode(code)
+	_, err = receiveMailbox(s.URL, "", wordlist.Encode(slot, []byte("wrong")), t.TempDir())
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, m.Len())
+
+	dir := t.TempDir()
+	files, err := receiveMailbox(s.URL, "", code, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "hello.txt")}, files)
+	p, _ = os.ReadFile(files[0])
+	assert.Equal(t, "hello mailbox", string(p))
+
+	// Deleted after the first fetch, once the server saw it all sent.
+	assert.Eventually(t, func() bool { return m.Len() == 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "", firstFile(t, m.Dir))
+	_, err = receiveMailbox(s.URL, "", code, dir)
+	assert.ErrorContains(t, err, "404")
+}
+
+func TestMailboxExpireAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewMailbox(dir, 50, 100, time.Hour)
+	assert.Nil(t, err)
+
+	hash := wormhole.MailboxTokenHash("token")
+	bundle := strings.Repeat("b", wormhole.MailboxMinBundle)
+	id, _, err := m.Reserve(nil, time.Minute)
+	assert.Nil(t, err)
+	assert.ErrorIs(t, m.Put(&Tenant{Name: "team-a"}, id, hash, strings.NewReader(bundle)), ErrNoSuchBundle)
+	assert.Nil(t, m.Put(nil, id, hash, strings.NewReader(bundle)))
+	assert.ErrorIs(t, m.Put(nil, id, hash, strings.NewReader(bundle)), ErrNoSuchBundle)
+
+	big, _, _ := m.Reserve(nil, 0)
+	assert.ErrorIs(t, m.Put(nil, big, hash, strings.NewReader(strings.Repeat("b", 51))), ErrBundleTooLarge)
+	// An empty bundle is refused, and its mailbox reaped like any other.
+	empty, _, _ := m.Reserve(nil, 0)
+	assert.ErrorIs(t, m.Put(nil, empty, hash, strings.NewReader("")), ErrBundleTooSmall)
+	assert.Equal(t, int64(wormhole.MailboxMinBundle), m.total)
+
+	// Restored after a restart, with the expiry from the file time.
+	m, err = NewMailbox(dir, 50, 100, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, m.Len())
+	_, _, _, err = m.Open(id, "bad")
+	assert.ErrorIs(t, err, ErrBadToken)
+
+	assert.Equal(t, 0, m.Reap(time.Now()))
+	assert.Equal(t, 1, m.Reap(time.Now().Add(2*time.Hour)))
+	assert.Equal(t, int64(0), m.total)
+	assert.Equal(t, "", firstFile(t, dir))
+}
+
+func firstFile(t *testing.T, dir string) string {
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	if len(entries) == 0 {
+		return ""
+	}
+	return entries[0].Name()
+}
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"strconv"
 
 	"github.com/bingoohuang/gg/pkg/ss"
 	"github.com/bingoohuang/gg/pkg/v"
@@ -29,6 +28,7 @@ var subcmds = map[string]func(ctx context.Context, args ...string){
 	"http":        httpCmd,
 	"turn":        turnServerSubCmd,
 	"turn-client": turnClientSubCmd,
+	"doctor":      doctorSubCmd,
 }
 
 // Sigserv use env $SIGSERV to set signalling server to use
@@ -49,6 +49,8 @@ func usage() {
 func main() {
 	showVersion := flag.Bool("version", false, "show version and exit")
 	verbose := flag.Bool("verbose", util.GetEnvBool("VERBOSE", true), "verbose logging")
+	configFile := flag.String("config", os.Getenv("GOWORMHOLE_CONFIG"), "config file, defaults to gowormhole/config.yaml in the user config dir")
+	profileName := flag.String("profile", os.Getenv("GOWORMHOLE_PROFILE"), "client profile in the config file")
 	flag.Usage = usage
 	flag.Parse()
 	if *showVersion {
@@ -61,6 +63,10 @@ func main() {
 		os.Exit(2)
 	}
 
+	if err := loadConfig(*configFile, *profileName); err != nil {
+		log.Fatalf("load config failed: %v", err)
+	}
+
 	wormhole.Verbose = *verbose
 	cmd, ok := subcmds[flag.Arg(0)]
 	if !ok {
@@ -72,24 +78,30 @@ func main() {
 
 var ErrRetryUnsupported = errors.New("retry Unsupported")
 
-func newConn(ctx context.Context, sigserv, bearer, code string, length int, timeouts *wormhole.Timeouts) (*wormhole.Wormhole, error) {
-	slotKey, pass := "", ""
+// newConn dials the wormhole of code, or opens a new one with a new password of
+// length bytes if code is empty, in the named room if room isn't empty.
+func newConn(ctx context.Context, sigserv, bearer, room, code string, length int, timeouts *wormhole.Timeouts) (*wormhole.Wormhole, error) {
+	slotKey, pass := room, ""
 	if code == "" {
 		pass = string(util.RandPass(length))
 	} else {
-		slot, pass1 := wordlist.Decode(code)
+		slot, pass1 := wordlist.DecodeSlot(code)
 		if pass1 == nil {
 			return nil, fmt.Errorf("bad code, could not decode password: %w", ErrRetryUnsupported)
 		}
-		slotKey = strconv.Itoa(slot)
+		slotKey = slot
 		pass = string(pass1)
 	}
 
 	c, err := wormhole.Setup(ctx, slotKey, pass, ss.Or(sigserv, Sigserv), bearer, timeouts)
-	if err != nil {
+	if errors.Is(err, wormhole.ErrNoSuchSlot) {
+		return nil, fmt.Errorf("code %s expired: %w", code, ErrRetryUnsupported)
+	} else if err != nil {
 		return nil, fmt.Errorf("could not dial: %w", err)
 	}
 
-	log.Printf("connected: %s", util.If(c.IsRelay(), "relay", "direct"))
+	method := util.If(c.IsRelay(), "relay", "direct")
+	connectionCounter.WithLabelValues(method).Inc()
+	log.Printf("connected: %s", method)
 	return c, nil
 }
@@ -37,10 +37,10 @@ func natSubCmd(ctx context.Context, args ...string) {
 		stunServerAddr: util.AppendPort(*stunServer, gowormhole.DefaultStunPort),
 	}
 
-	if err := cmd.mappingTests(); err != nil {
+	if _, err := cmd.mappingTests(); err != nil {
 		log.Warn("NAT mapping behavior: inconclusive")
 	}
-	if err := cmd.filteringTests(); err != nil {
+	if _, err := cmd.filteringTests(); err != nil {
 		log.Warn("NAT filtering behavior: inconclusive")
 	}
 }
@@ -91,13 +91,22 @@ var (
 	errNoOtherAddress  = errors.New("no OTHER-ADDRESS in message")
 )
 
+// The NAT mapping and filtering behaviors of RFC 4787.
+const (
+	natNoNAT                   = "no NAT"
+	natEndpointIndependent     = "endpoint independent"
+	natAddressDependent        = "address dependent"
+	natAddressAndPortDependent = "address and port dependent"
+)
+
 // RFC5780: 4.3.  Determining NAT Mapping Behavior
-func (n *natCmd) mappingTests() error {
+func (n *natCmd) mappingTests() (string, error) {
 	mapTestConn, err := n.connect(n.stunServerAddr)
 	if err != nil {
 		n.log.Warnf("Error creating STUN connection: %s", err.Error())
-		return err
+		return "", err
 	}
+	defer mapTestConn.Close()
 
 	// Test I: Regular binding request
 	n.log.Info("Mapping Test I: Regular binding request")
@@ -105,19 +114,19 @@ func (n *natCmd) mappingTests() error {
 
 	resp, err := mapTestConn.roundTrip(request, mapTestConn.RemoteAddr)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// Parse response message for XOR-MAPPED-ADDRESS and make sure OTHER-ADDRESS valid
 	resps1 := n.parse(resp)
 	if resps1.xorAddr == nil || resps1.otherAddr == nil {
 		n.log.Info("Error: NAT discovery feature not supported by this server")
-		return errNoOtherAddress
+		return "", errNoOtherAddress
 	}
 	addr, err := net.ResolveUDPAddr("udp4", resps1.otherAddr.String())
 	if err != nil {
 		n.log.Infof("Failed resolving OTHER-ADDRESS: %v", resps1.otherAddr)
-		return err
+		return "", err
 	}
 	mapTestConn.OtherAddr = addr
 	n.log.Infof("Received XOR-MAPPED-ADDRESS: %v", resps1.xorAddr)
@@ -125,7 +134,7 @@ func (n *natCmd) mappingTests() error {
 	// Assert mapping behavior
 	if resps1.xorAddr.String() == mapTestConn.LocalAddr.String() {
 		n.log.Warn("=> NAT mapping behavior: endpoint independent (no NAT)")
-		return nil
+		return natNoNAT, nil
 	}
 
 	// Test II: Send binding request to the other address but primary port
@@ -134,7 +143,7 @@ func (n *natCmd) mappingTests() error {
 	otherAddr.Port = mapTestConn.RemoteAddr.Port
 	resp, err = mapTestConn.roundTrip(request, &otherAddr)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// Assert mapping behavior
@@ -142,14 +151,14 @@ func (n *natCmd) mappingTests() error {
 	n.log.Infof("Received XOR-MAPPED-ADDRESS: %v", resps2.xorAddr)
 	if resps2.xorAddr.String() == resps1.xorAddr.String() {
 		n.log.Warn("=> NAT mapping behavior: endpoint independent")
-		return nil
+		return natEndpointIndependent, nil
 	}
 
 	// Test III: Send binding request to the other address and port
 	n.log.Info("Mapping Test III: Send binding request to the other address and port")
 	resp, err = mapTestConn.roundTrip(request, mapTestConn.OtherAddr)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// Assert mapping behavior
@@ -157,20 +166,20 @@ func (n *natCmd) mappingTests() error {
 	n.log.Infof("Received XOR-MAPPED-ADDRESS: %v", resps3.xorAddr)
 	if resps3.xorAddr.String() == resps2.xorAddr.String() {
 		n.log.Warn("=> NAT mapping behavior: address dependent")
-	} else {
-		n.log.Warn("=> NAT mapping behavior: address and port dependent")
+		return natAddressDependent, nil
 	}
-
-	return mapTestConn.Close()
+	n.log.Warn("=> NAT mapping behavior: address and port dependent")
+	return natAddressAndPortDependent, nil
 }
 
 // RFC5780: 4.4.  Determining NAT Filtering Behavior
-func (n *natCmd) filteringTests() error {
+func (n *natCmd) filteringTests() (string, error) {
 	mapTestConn, err := n.connect(n.stunServerAddr)
 	if err != nil {
 		n.log.Warnf("Error creating STUN connection: %s", err.Error())
-		return err
+		return "", err
 	}
+	defer mapTestConn.Close()
 
 	// Test I: Regular binding request
 	n.log.Info("Filtering Test I: Regular binding request")
@@ -178,17 +187,17 @@ func (n *natCmd) filteringTests() error {
 
 	resp, err := mapTestConn.roundTrip(request, mapTestConn.RemoteAddr)
 	if err != nil || errors.Is(err, errTimedOut) {
-		return err
+		return "", err
 	}
 	resps := n.parse(resp)
 	if resps.xorAddr == nil || resps.otherAddr == nil {
 		n.log.Warn("Error: NAT discovery feature not supported by this server")
-		return errNoOtherAddress
+		return "", errNoOtherAddress
 	}
 	addr, err := net.ResolveUDPAddr("udp4", resps.otherAddr.String())
 	if err != nil {
 		n.log.Infof("Failed resolving OTHER-ADDRESS: %v", resps.otherAddr)
-		return err
+		return "", err
 	}
 	mapTestConn.OtherAddr = addr
 
@@ -201,9 +210,9 @@ func (n *natCmd) filteringTests() error {
 	if err == nil {
 		n.parse(resp) // just to print out the resp
 		n.log.Warn("=> NAT filtering behavior: endpoint independent")
-		return nil
+		return natEndpointIndependent, nil
 	} else if !errors.Is(err, errTimedOut) {
-		return err // something else went wrong
+		return "", err // something else went wrong
 	}
 
 	// Test III: Request to change port only
@@ -215,11 +224,12 @@ func (n *natCmd) filteringTests() error {
 	if err == nil {
 		n.parse(resp) // just to print out the resp
 		n.log.Warn("=> NAT filtering behavior: address dependent")
+		return natAddressDependent, nil
 	} else if errors.Is(err, errTimedOut) {
 		n.log.Warn("=> NAT filtering behavior: address and port dependent")
+		return natAddressAndPortDependent, nil
 	}
-
-	return mapTestConn.Close()
+	return "", err
 }
 
 // Parse a STUN message
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/bingoohuang/gowormhole/wormhole"
+)
+
+// Origins is the Origin policy of the signalling endpoints, a list of host
+// patterns as of path.Match, e.g. "example.com", "*.example.com" or "localhost:*".
+// An empty policy allows any origin.
+type Origins []string
+
+// parseOrigins parses the comma separated list of origin patterns.
+func parseOrigins(list string) (Origins, error) {
+	var o Origins
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.ToLower(strings.TrimSpace(p)); p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("bad origin pattern %q: %w", p, err)
+		}
+		o = append(o, p)
+	}
+	return o, nil
+}
+
+// Allow reports whether the origin of r may use the signalling endpoints.
+// Non-browser clients send no Origin, and the site itself is always allowed.
+func (o Origins) Allow(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(o) == 0 || origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := strings.ToLower(u.Host)
+	if host == strings.ToLower(r.Host) {
+		return true
+	}
+	for _, p := range o {
+		if ok, _ := path.Match(p, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ConnectSrc returns the connect-src sources of the CSP for the hosts of the
+// site and the allowed origins.
+func (o Origins) ConnectSrc(hosts []string) string {
+	src := "'self' ws://localhost/"
+	seen := map[string]bool{}
+	for _, host := range append(append([]string{}, hosts...), o...) {
+		if host != "" && !seen[host] {
+			seen[host] = true
+			src += fmt.Sprintf(" wss://%v ws://%v", host, host)
+		}
+	}
+	return src
+}
+
+// isSignalling tells the requests of the signalling endpoints from the ones of the static files.
+func isSignalling(r *http.Request) bool {
+	return strings.ToLower(r.Header.Get("Upgrade")) == "websocket" ||
+		r.Header.Get("GoWormhole") == GowormholeReserveslotkey ||
+		strings.HasPrefix(r.URL.Path, "/"+wormhole.PollPath) ||
+		strings.HasPrefix(r.URL.Path, "/"+wormhole.MailboxPath) ||
+		isAPI(r)
+}
+
+// rejectOrigin answers the request of a disallowed origin.
+func rejectOrigin(w http.ResponseWriter, r *http.Request) {
+	rejectionCounter.WithLabelValues("origin").Inc()
+	log.Printf("rejected origin %q from %s", r.Header.Get("Origin"), r.RemoteAddr)
+	if isAPI(r) {
+		apiError(w, http.StatusForbidden, "forbidden", "origin not allowed")
+		return
+	}
+	http.Error(w, "Origin Not Allowed", http.StatusForbidden)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOriginsAllow(t *testing.T) {
+	o, err := parseOrigins("*.example.com, localhost:*")
+	assert.Nil(t, err)
+
+	for origin, allowed := range map[string]bool{
+		"":                             true, // non-browser clients
+		"https://app.example.com":      true,
+		"https://APP.example.com":      true,
+		"http://localhost:8080":        true,
+		"https://wormhole.test":        true, // the site itself
+		"https://example.com":          false,
+		"https://evil.com":             false,
+		"https://app.example.com.evil": false,
+		"null":                         false,
+	} {
+		r := httptest.NewRequest("GET", "https://wormhole.test/", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		assert.Equal(t, allowed, o.Allow(r), origin)
+	}
+
+	// Any origin without a policy.
+	r := httptest.NewRequest("GET", "https://wormhole.test/", nil)
+	r.Header.Set("Origin", "https://evil.com")
+	assert.True(t, Origins(nil).Allow(r))
+
+	_, err = parseOrigins("[")
+	assert.NotNil(t, err)
+}
+
+func TestOriginsConnectSrc(t *testing.T) {
+	o, _ := parseOrigins("*.example.com,wormhole.test")
+	assert.Equal(t, "'self' ws://localhost/ wss://wormhole.test ws://wormhole.test wss://*.example.com ws://*.example.com",
+		o.ConnectSrc([]string{"wormhole.test", ""}))
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 
+	"github.com/bingoohuang/gg/pkg/defaults"
 	"github.com/bingoohuang/gowormhole/internal/util"
 )
 
@@ -19,7 +20,7 @@ func pipeSubCmd(ctx context.Context, args ...string) {
 		set.PrintDefaults()
 	}
 	length := set.Int("length", 2, "length of generated secret, if generating")
-	pBearer := set.String("bearer", os.Getenv("BEARER"), "Bearer authentication")
+	pBearer := set.String("bearer", defaultBearer(), "Bearer authentication, defaults to $BEARER or the bearer of the profile")
 
 	_ = set.Parse(args[1:])
 
@@ -27,7 +28,9 @@ func pipeSubCmd(ctx context.Context, args ...string) {
 		set.Usage()
 		os.Exit(2)
 	}
-	c, err := newConn(context.TODO(), Sigserv, *pBearer, set.Arg(0), *length, nil)
+	timeouts := profile.Timeouts
+	_ = defaults.Set(&timeouts)
+	c, err := newConn(context.TODO(), Sigserv, *pBearer, "", set.Arg(0), *length, &timeouts)
 	util.FatalfIf(err != nil, "new connection failed: %v", err)
 
 	done := make(chan struct{})
@@ -0,0 +1,353 @@
+package main
+
+// The HTTP long-poll binding of the signalling protocol, for networks whose
+// proxies strip the WebSocket upgrade. A peer opens a session on a slot, then
+// sends its frames by POST and receives the frames of the other peer by
+// long-poll GET, see wormhole.PollPath for the endpoints. The frames and close
+// codes are the same as on a WebSocket.
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bingoohuang/gowormhole/internal/util"
+	"github.com/bingoohuang/gowormhole/wormhole"
+	"nhooyr.io/websocket"
+)
+
+const (
+	// pollWait is how long a GET waits for a frame before answering 204 No Content.
+	pollWait = 25 * time.Second
+	// pollSessionTimeout is how long a session lives without any request of its peer,
+	// the peer is then taken as hung up.
+	pollSessionTimeout = time.Minute
+	// pollQueueSize is the number of frames buffered in each direction.
+	pollQueueSize = 16
+)
+
+type pollFrame struct {
+	typ websocket.MessageType
+	p   []byte
+}
+
+// pollConn is a peer connected by an HTTP long-poll session.
+type pollConn struct {
+	token string
+	// in holds the frames sent by the peer, out the frames to the peer.
+	in, out chan pollFrame
+	// done is closed when the session is closed by either side, with closeErr.
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  websocket.CloseError
+	// remote tells the peer closed the session.
+	remote bool
+	// seen is the unix nano time of the last request of the peer.
+	seen atomic.Int64
+	// recvLock serializes the recv of the peer. sent is the frame answered last,
+	// kept until the peer acknowledges its sequence number seq.
+	recvLock sync.Mutex
+	sent     *pollFrame
+	seq      uint64
+}
+
+func newPollConn() *pollConn {
+	token := make([]byte, 24)
+	util.RandFull(token)
+	c := &pollConn{
+		token: base64.RawURLEncoding.EncodeToString(token),
+		in:    make(chan pollFrame, pollQueueSize),
+		out:   make(chan pollFrame, pollQueueSize),
+		done:  make(chan struct{}),
+	}
+	c.touch()
+	return c
+}
+
+func (c *pollConn) touch() { c.seen.Store(time.Now().UnixNano()) }
+
+// ReadFrame reads a frame sent by the peer, the frames sent before the peer
+// closed the session are read before the close.
+func (c *pollConn) ReadFrame(ctx context.Context, max int64) (websocket.MessageType, []byte, error) {
+	select {
+	case f := <-c.in:
+		return f.frame(max)
+	default:
+	}
+
+	select {
+	case f := <-c.in:
+		return f.frame(max)
+	case <-c.done:
+		select {
+		case f := <-c.in:
+			return f.frame(max)
+		default:
+			return 0, nil, c.err()
+		}
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+func (f pollFrame) frame(max int64) (websocket.MessageType, []byte, error) {
+	if int64(len(f.p)) > max {
+		return f.typ, nil, errFrameTooLarge
+	}
+	return f.typ, f.p, nil
+}
+
+// err returns the error of using the closed session, like the ones of a closed WebSocket.
+func (c *pollConn) err() error {
+	if c.remote {
+		return fmt.Errorf("received close frame: %w", c.closeErr)
+	}
+	return fmt.Errorf("sent close frame: %w", c.closeErr)
+}
+
+// Write queues a frame for the peer.
+func (c *pollConn) Write(ctx context.Context, typ websocket.MessageType, p []byte) error {
+	select {
+	case <-c.done:
+		return c.err()
+	default:
+	}
+
+	select {
+	case c.out <- pollFrame{typ: typ, p: p}:
+		return nil
+	case <-c.done:
+		return c.err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Ping does nothing, the peer keeps the session alive by its requests.
+func (c *pollConn) Ping(context.Context) error { return nil }
+
+// Close closes the session, the peer receives the close after the queued frames.
+func (c *pollConn) Close(code websocket.StatusCode, reason string) error {
+	c.close(code, reason, false)
+	return nil
+}
+
+func (c *pollConn) close(code websocket.StatusCode, reason string, remote bool) {
+	c.closeOnce.Do(func() {
+		c.closeErr = websocket.CloseError{Code: code, Reason: reason}
+		c.remote = remote
+		close(c.done)
+	})
+}
+
+// PollSessions holds the open long-poll sessions by token.
+type PollSessions struct {
+	m    map[string]*pollConn
+	lock sync.RWMutex
+}
+
+var pollSessions = &PollSessions{m: make(map[string]*pollConn)}
+
+func (s *PollSessions) add(c *pollConn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.m[c.token] = c
+	pollSessionsGauge.Inc()
+}
+
+func (s *PollSessions) get(token string) (*pollConn, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	c, ok := s.m[token]
+	return c, ok
+}
+
+func (s *PollSessions) remove(c *pollConn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.m[c.token]; ok {
+		delete(s.m, c.token)
+		pollSessionsGauge.Dec()
+	}
+}
+
+// expire closes the session when its peer hasn't made a request for timeout,
+// and forgets it then, so that the peer gets the close code of a closed session
+// until it stops polling.
+func (s *PollSessions) expire(c *pollConn, timeout time.Duration) {
+	t := time.NewTicker(timeout / 4)
+	defer t.Stop()
+
+	for range t.C {
+		if time.Since(time.Unix(0, c.seen.Load())) >= timeout {
+			c.close(websocket.StatusGoingAway, "poll session timed out", true)
+			s.remove(c)
+			return
+		}
+	}
+}
+
+// pollHandler serves the long-poll binding under wormhole.PollPath.
+func pollHandler(w http.ResponseWriter, r *http.Request) {
+	op, slotKey, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"+wormhole.PollPath), "/")
+	switch {
+	case op == "open" && r.Method == http.MethodPost:
+		pollOpen(w, r, slotKey)
+		return
+	case op == "open":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c, ok := pollSessions.get(r.Header.Get(wormhole.PollSessionHeader))
+	if !ok {
+		protocolErrorCounter.WithLabelValues("nosession", tenantOf(r).Label()).Inc()
+		http.Error(w, "no such session", http.StatusNotFound)
+		return
+	}
+	c.touch()
+	defer c.touch()
+
+	switch {
+	case op == "send" && r.Method == http.MethodPost:
+		pollSend(w, r, c)
+	case op == "recv" && r.Method == http.MethodGet:
+		pollRecv(w, r, c)
+	case op == "close" && r.Method == http.MethodPost:
+		code, err := strconv.Atoi(r.URL.Query().Get("code"))
+		if err != nil {
+			code = int(websocket.StatusNormalClosure)
+		}
+		c.close(websocket.StatusCode(code), r.URL.Query().Get("reason"), true)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// pollOpen opens a session on the slot, the rejections are the close code of the session.
+func pollOpen(w http.ResponseWriter, r *http.Request, slotKey string) {
+	tenant := tenantOf(r)
+	conf := serverConf.Load()
+
+	c := newPollConn()
+	pollSessions.add(c)
+	go pollSessions.expire(c, pollSessionTimeout)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]string{"token": c.token})
+
+	if r.URL.Query().Get("protocol") != wormhole.Protocol {
+		rejectWrongVersion(tenant, c)
+		return
+	}
+
+	release := admit(r, conf, slotKey, c)
+	if release == nil {
+		return
+	}
+
+	peer := newSlotPeer(r, conf, c)
+	go func() {
+		defer release()
+
+		relayPeer(context.Background(), conf, tenant, slotKey, peer)
+		// Like a dropped WebSocket, when the relay ends without closing the session.
+		_ = c.Close(websocket.StatusGoingAway, "relay ended")
+	}()
+}
+
+// pollSend queues the frame in the body for the relay.
+func pollSend(w http.ResponseWriter, r *http.Request, c *pollConn) {
+	max := serverConf.Load().Protocol.MaxFrame
+	p, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	typ := websocket.MessageText
+	if r.Header.Get("Content-Type") == "application/octet-stream" {
+		typ = websocket.MessageBinary
+	}
+
+	select {
+	case c.in <- pollFrame{typ: typ, p: p}:
+		w.WriteHeader(http.StatusNoContent)
+	case <-c.done:
+		pollClosed(w, c)
+	case <-r.Context().Done():
+	}
+}
+
+// pollRecv answers the next frame for the peer, waiting up to pollWait for one.
+// The frames queued before the session was closed are answered before the close.
+// The frame answered last is answered again until the peer acknowledges it.
+func pollRecv(w http.ResponseWriter, r *http.Request, c *pollConn) {
+	c.recvLock.Lock()
+	defer c.recvLock.Unlock()
+
+	// No ack acknowledges all, for the clients which don't send it.
+	if ack, err := strconv.ParseUint(r.URL.Query().Get("ack"), 10, 64); err != nil || ack >= c.seq {
+		c.sent = nil
+	}
+	if c.sent == nil {
+		f, ok := pollNext(w, r, c)
+		if !ok {
+			return
+		}
+		c.sent = &f
+		c.seq++
+	}
+
+	w.Header().Set("Content-Type", util.If(c.sent.typ == websocket.MessageBinary, "application/octet-stream", "text/plain"))
+	w.Header().Set(wormhole.PollSeqHeader, strconv.FormatUint(c.seq, 10))
+	_, _ = w.Write(c.sent.p)
+}
+
+// pollNext takes the next frame for the peer, or answers 204 or the close
+// when none comes.
+func pollNext(w http.ResponseWriter, r *http.Request, c *pollConn) (f pollFrame, ok bool) {
+	t := time.NewTimer(pollWait)
+	defer t.Stop()
+
+	select {
+	case f = <-c.out:
+		return f, true
+	default:
+	}
+
+	select {
+	case f = <-c.out:
+		return f, true
+	case <-c.done:
+		select {
+		case f = <-c.out:
+			return f, true
+		default:
+			pollClosed(w, c)
+		}
+	case <-t.C:
+		w.WriteHeader(http.StatusNoContent)
+	case <-r.Context().Done():
+	}
+	return f, false
+}
+
+// pollClosed answers the close code of the session.
+func pollClosed(w http.ResponseWriter, c *pollConn) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusGone)
+	_ = json.NewEncoder(w).Encode(wormhole.PollClose{Code: int(c.closeErr.Code), Reason: c.closeErr.Reason})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bingoohuang/gowormhole/wormhole"
+	"github.com/stretchr/testify/assert"
+	"nhooyr.io/websocket"
+)
+
+// pollClient speaks the long-poll binding by plain HTTP requests.
+type pollClient struct {
+	t     *testing.T
+	url   string
+	token string
+}
+
+func (c *pollClient) do(method, path, body string) (int, string) {
+	req, _ := http.NewRequest(method, c.url+"/"+wormhole.PollPath+path, strings.NewReader(body))
+	req.Header.Set(wormhole.PollSessionHeader, c.token)
+	rsp, err := http.DefaultClient.Do(req)
+	assert.Nil(c.t, err)
+	defer rsp.Body.Close()
+	p, _ := io.ReadAll(rsp.Body)
+	return rsp.StatusCode, string(p)
+}
+
+func TestPollRelay(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/"+wormhole.PollPath) {
+			pollHandler(w, r)
+		} else {
+			relay(w, r)
+		}
+	}))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Peer A by long-poll.
+	a := &pollClient{t: t, url: s.URL}
+	code, body := a.do(http.MethodPost, "open/?protocol="+wormhole.Protocol, "")
+	assert.Equal(t, http.StatusOK, code)
+	var session struct{ Token string }
+	assert.Nil(t, json.Unmarshal([]byte(body), &session))
+	a.token = session.Token
+
+	code, body = a.do(http.MethodGet, "recv?ack=0", "")
+	assert.Equal(t, http.StatusOK, code)
+	var init wormhole.InitMsg
+	assert.Nil(t, json.Unmarshal([]byte(body), &init))
+	assert.Equal(t, wormhole.ModePeer1, init.Mode)
+
+	// Peer B by WebSocket on the same slot.
+	b, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http")+"/"+init.Slot,
+		&websocket.DialOptions{Subprotocols: []string{wormhole.Protocol}})
+	assert.Nil(t, err)
+	_, _, err = b.Read(ctx) // InitMsg
+	assert.Nil(t, err)
+
+	code, _ = a.do(http.MethodPost, "send", "cGFrZUE=")
+	assert.Equal(t, http.StatusNoContent, code)
+	_, p, err := b.Read(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "cGFrZUE=", string(p))
+
+	assert.Nil(t, b.Write(ctx, websocket.MessageText, []byte("cGFrZUI=")))
+	assert.Nil(t, b.Write(ctx, websocket.MessageText, []byte("cGFrZUM=")))
+	code, body = a.do(http.MethodGet, "recv?ack=1", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "cGFrZUI=", body)
+	// The response got lost, the frame is answered again until acknowledged.
+	code, body = a.do(http.MethodGet, "recv?ack=1", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "cGFrZUI=", body)
+	code, body = a.do(http.MethodGet, "recv?ack=2", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "cGFrZUM=", body)
+
+	// B hangs up, A gets the same close code as on a WebSocket.
+	assert.Nil(t, b.Close(websocket.StatusNormalClosure, ""))
+	code, body = a.do(http.MethodGet, "recv?ack=3", "")
+	assert.Equal(t, http.StatusGone, code)
+	var pc wormhole.PollClose
+	assert.Nil(t, json.Unmarshal([]byte(body), &pc))
+	assert.Equal(t, wormhole.ClosePeerHungUp, pc.Code)
+}
+
+func TestPollOpenWrongVersion(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(pollHandler))
+	defer s.Close()
+
+	c := &pollClient{t: t, url: s.URL}
+	code, body := c.do(http.MethodPost, "open/", "")
+	assert.Equal(t, http.StatusOK, code)
+	var session struct{ Token string }
+	assert.Nil(t, json.Unmarshal([]byte(body), &session))
+	c.token = session.Token
+
+	code, body = c.do(http.MethodGet, "recv", "")
+	assert.Equal(t, http.StatusGone, code)
+	var pc wormhole.PollClose
+	assert.Nil(t, json.Unmarshal([]byte(body), &pc))
+	assert.Equal(t, wormhole.CloseWrongProto, pc.Code)
+}
@@ -9,7 +9,7 @@ var (
 			Name:      "rendezvous_attempts",
 			Help:      "Number of attempts to rendezvous using the signalling server.",
 		},
-		[]string{"result"},
+		[]string{"result", "tenant"},
 	)
 	iceCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -17,7 +17,7 @@ var (
 			Name:      "webrtc_attempts",
 			Help:      "Number of reported ICE results sliced by ICE method used.",
 		},
-		[]string{"result", "method"},
+		[]string{"result", "method", "tenant"},
 	)
 	protocolErrorCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -25,14 +25,186 @@ var (
 			Name:      "protocol_errors",
 			Help:      "Number of bad requests to the signalling server.",
 		},
-		[]string{"kind"},
+		[]string{"kind", "tenant"},
+	)
+	rateLimitCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gowormhole",
+			Name:      "rate_limited",
+			Help:      "Number of requests rejected by rate limits sliced by client scope and limit kind.",
+		},
+		[]string{"scope", "kind"},
+	)
+	turnAuthCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gowormhole",
+			Name:      "turn_auth",
+			Help:      "Number of authentications to the TURN server sliced by result.",
+		},
+		[]string{"result"},
+	)
+	turnAllocationsGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "gowormhole",
+			Name:      "turn_allocations",
+			Help:      "Number of current allocations of the TURN server.",
+		},
+		[]string{"tenant"},
+	)
+	turnRelayedBytesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gowormhole",
+			Name:      "turn_relayed_bytes",
+			Help:      "Number of bytes relayed by the TURN server sliced by direction: sent to or received from the peers.",
+		},
+		[]string{"direction", "tenant"},
+	)
+	turnRequestCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gowormhole",
+			Name:      "turn_requests",
+			Help:      "Number of requests to the TURN server sliced by method and result: success or the error code.",
+		},
+		[]string{"method", "result"},
+	)
+	turnQuotaCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gowormhole",
+			Name:      "turn_quota_exceeded",
+			Help:      "Number of allocations or packets rejected by the TURN quotas sliced by scope and limit.",
+		},
+		[]string{"scope", "limit"},
 	)
-	slotsGuage = prometheus.NewGauge(
+	slotsGuage = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "gowormhole",
 			Name:      "busy_slots",
 			Help:      "Number of currently busy slots.",
 		},
+		[]string{"tenant"},
+	)
+	webhookCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gowormhole",
+			Name:      "webhooks",
+			Help:      "Number of webhook deliveries sliced by result: delivered, retried, failed or dropped.",
+		},
+		[]string{"result"},
+	)
+	rejectionCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gowormhole",
+			Name:      "rejections",
+			Help:      "Number of requests rejected by the signalling server sliced by reason.",
+		},
+		[]string{"reason"},
+	)
+	websocketsGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "gowormhole",
+			Name:      "websockets",
+			Help:      "Number of currently open WebSocket connections.",
+		},
+	)
+	pollSessionsGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "gowormhole",
+			Name:      "poll_sessions",
+			Help:      "Number of currently open HTTP long-poll signalling sessions.",
+		},
+	)
+	reservationsGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "gowormhole",
+			Name:      "reservations_outstanding",
+			Help:      "Number of reserved slots nobody has joined yet.",
+		},
+		[]string{"tenant"},
+	)
+	slotOccupancyGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "gowormhole",
+			Name:      "slot_occupancy",
+			Help:      "Fraction of the numeric slots in use sliced by code length, the number of words of the slot.",
+		},
+		[]string{"length"},
+	)
+	slotCapacityGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "gowormhole",
+			Name:      "slot_capacity",
+			Help:      "Number of numeric slots sliced by code length, the number of words of the slot.",
+		},
+		[]string{"length"},
+	)
+	reservationCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gowormhole",
+			Name:      "reservations",
+			Help:      "Number of reservations sliced by result: reserved, joined, expired or released.",
+		},
+		[]string{"result", "tenant"},
+	)
+	rendezvousHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gowormhole",
+			Name:      "rendezvous_seconds",
+			Help:      "Time from the first peer joining a slot until the second peer joins.",
+			Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+		},
+		[]string{"tenant"},
+	)
+	handshakeHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gowormhole",
+			Name:      "handshake_seconds",
+			Help:      "Time from the first peer joining until the WebRTC result close, sliced by result.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+		},
+		[]string{"result"},
+	)
+	slotMessagesHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "gowormhole",
+			Name:      "slot_messages",
+			Help:      "Number of signalling messages relayed per slot.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+		},
+	)
+	slotBytesHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "gowormhole",
+			Name:      "slot_bytes",
+			Help:      "Number of signalling bytes relayed per slot.",
+			Buckets:   prometheus.ExponentialBuckets(256, 4, 8),
+		},
+	)
+
+	// Client metrics, exposed by the http daemon.
+	transferBytesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gowormhole",
+			Name:      "transfer_bytes",
+			Help:      "Number of file bytes transferred sliced by direction: sent or received.",
+		},
+		[]string{"direction"},
+	)
+	fileHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "gowormhole",
+			Name:      "file_seconds",
+			Help:      "Time to transfer a file sliced by direction and result.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 4, 10),
+		},
+		[]string{"direction", "result"},
+	)
+	connectionCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gowormhole",
+			Name:      "connections",
+			Help:      "Number of wormhole connections sliced by method: direct or relay.",
+		},
+		[]string{"method"},
 	)
 )
 
@@ -40,5 +212,26 @@ func init() {
 	prometheus.MustRegister(rendezvousCounter)
 	prometheus.MustRegister(iceCounter)
 	prometheus.MustRegister(protocolErrorCounter)
+	prometheus.MustRegister(rateLimitCounter)
+	prometheus.MustRegister(turnAuthCounter)
+	prometheus.MustRegister(turnAllocationsGauge)
+	prometheus.MustRegister(turnRelayedBytesCounter)
+	prometheus.MustRegister(turnRequestCounter)
+	prometheus.MustRegister(turnQuotaCounter)
 	prometheus.MustRegister(slotsGuage)
+	prometheus.MustRegister(rejectionCounter)
+	prometheus.MustRegister(webhookCounter)
+	prometheus.MustRegister(websocketsGauge)
+	prometheus.MustRegister(pollSessionsGauge)
+	prometheus.MustRegister(reservationsGauge)
+	prometheus.MustRegister(reservationCounter)
+	prometheus.MustRegister(slotOccupancyGauge)
+	prometheus.MustRegister(slotCapacityGauge)
+	prometheus.MustRegister(rendezvousHistogram)
+	prometheus.MustRegister(handshakeHistogram)
+	prometheus.MustRegister(slotMessagesHistogram)
+	prometheus.MustRegister(slotBytesHistogram)
+	prometheus.MustRegister(transferBytesCounter)
+	prometheus.MustRegister(fileHistogram)
+	prometheus.MustRegister(connectionCounter)
 }
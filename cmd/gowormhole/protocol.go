@@ -0,0 +1,153 @@
+package main
+
+// Protocol checks of the frames the peers relay through the signalling server.
+// After the init message the peers only send base64 text: the PAKE messages,
+// then the sealed offer, answer and ICE candidates, until both report the
+// WebRTC result by the close code.
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/bingoohuang/gowormhole/wormhole"
+	"nhooyr.io/websocket"
+)
+
+const (
+	defaultMaxFrame   = 32 << 10
+	defaultMaxFrames  = 256
+	defaultFrameRate  = "10/100"
+	defaultResultIdle = 10 * time.Second
+)
+
+// ProtocolLimits bound what a peer may send through the signalling server.
+type ProtocolLimits struct {
+	// MaxFrame is the max size of a frame in bytes.
+	MaxFrame int64
+	// MaxFrames is the max number of frames relayed per slot by both peers, 0 for unlimited.
+	MaxFrames int64
+	// FrameRate limits the frames per connection.
+	FrameRate Rate
+	// ResultIdle is how long a connection may stay idle once a peer of the slot
+	// reported the WebRTC result, 0 for unlimited.
+	ResultIdle time.Duration
+}
+
+// peerConn is the connection of a peer to the signalling server, a WebSocket
+// or an HTTP long-poll session.
+type peerConn interface {
+	// ReadFrame reads a frame of at most max bytes, errFrameTooLarge if it is larger.
+	ReadFrame(ctx context.Context, max int64) (websocket.MessageType, []byte, error)
+	Write(ctx context.Context, typ websocket.MessageType, p []byte) error
+	Ping(ctx context.Context) error
+	Close(code websocket.StatusCode, reason string) error
+}
+
+var errFrameTooLarge = errors.New("frame too large")
+
+// wsConn is a peer connected by a WebSocket.
+type wsConn struct{ *websocket.Conn }
+
+// ReadFrame reads a frame of at most max bytes.
+func (c wsConn) ReadFrame(ctx context.Context, max int64) (websocket.MessageType, []byte, error) {
+	c.SetReadLimit(max + 1) // Leave one more byte to tell too large frames apart.
+	typ, r, err := c.Reader(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	p, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if int64(len(p)) > max {
+		return typ, nil, errFrameTooLarge
+	}
+	return typ, p, nil
+}
+
+// checkFrame validates a frame read from a peer of the slot, and returns the
+// kind of the violation, empty if the frame is valid.
+func (l *ProtocolLimits) checkFrame(slot *SlotItem, paired bool, limiter *RateLimiter, typ websocket.MessageType, p []byte) string {
+	switch {
+	case !paired:
+		// Receiving anything before the other peer joined is a protocol violation.
+		return "unpaired"
+	case typ != websocket.MessageText:
+		return "binary"
+	case !isBase64(p):
+		return "badbase64"
+	case !limiter.Allow(""):
+		return "framerate"
+	case l.MaxFrames > 0 && slot.Messages.Load() >= l.MaxFrames:
+		return "toomanyframes"
+	}
+	return ""
+}
+
+// isBase64 tells whether p is non-empty and only made of base64 characters,
+// in either the standard or the URL alphabet.
+func isBase64(p []byte) bool {
+	for _, c := range p {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+		case c == '+', c == '/', c == '-', c == '_', c == '=':
+		default:
+			return false
+		}
+	}
+	return len(p) > 0
+}
+
+// protocolError counts the violation of kind and closes the connection of the
+// offending peer, telling the other peer that it hung up.
+func protocolError(slot *SlotItem, tenant *Tenant, conn, rconn peerConn, kind string) {
+	protocolErrorCounter.WithLabelValues(kind, tenant.Label()).Inc()
+	if slot != nil {
+		slot.SetOutcome("protocolerror")
+		slot.Event("protocolerror", kind)
+	}
+
+	log.Printf("protocol error: %s", kind)
+	code := websocket.StatusPolicyViolation
+	if kind == "toolarge" {
+		code = websocket.StatusMessageTooBig
+	}
+	_ = conn.Close(code, "protocol error: "+kind)
+	closeConn(rconn, wormhole.ClosePeerHungUp, "peer hung up")
+}
+
+// watchIdle closes conn when it stays idle for timeout once a peer of the slot
+// reported the WebRTC result, a frame read from conn is signalled on activity.
+func watchIdle(ctx context.Context, slot *SlotItem, tenant *Tenant, conn peerConn, timeout time.Duration,
+	activity <-chan struct{}, closed *atomic.Bool,
+) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-slot.Reported():
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-activity:
+			if !t.Stop() {
+				<-t.C
+			}
+			t.Reset(timeout)
+		case <-t.C:
+			closed.Store(true)
+			protocolErrorCounter.WithLabelValues("idle", tenant.Label()).Inc()
+			slot.Event("idle", "closed after "+timeout.String())
+			_ = conn.Close(websocket.StatusNormalClosure, "idle after WebRTC result")
+			return
+		}
+	}
+}
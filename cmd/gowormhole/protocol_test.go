@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bingoohuang/gowormhole/wormhole"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestIsBase64(t *testing.T) {
+	assert.True(t, isBase64([]byte("aGVsbG8-_w==")))
+	assert.True(t, isBase64([]byte("aGVsbG8+/w==")))
+	assert.False(t, isBase64([]byte("")))
+	assert.False(t, isBase64([]byte(`{"sdp": "x"}`)))
+}
+
+// dialPeers connects two peers to the same slot of the signalling server at url.
+func dialPeers(t *testing.T, ctx context.Context, url string) (a, b *websocket.Conn) {
+	dial := func(slot string) (*websocket.Conn, wormhole.InitMsg) {
+		c, _, err := websocket.Dial(ctx, url+"/"+slot, &websocket.DialOptions{Subprotocols: []string{wormhole.Protocol}})
+		assert.Nil(t, err)
+		var init wormhole.InitMsg
+		assert.Nil(t, wsjson.Read(ctx, c, &init))
+		return c, init
+	}
+
+	a, init := dial("")
+	b, _ = dial(init.Slot)
+	return a, b
+}
+
+func TestRelayRejectsBinaryFrames(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(relay))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	url := "ws" + strings.TrimPrefix(s.URL, "http")
+	before := testutil.ToFloat64(protocolErrorCounter.WithLabelValues("binary", defaultTenant))
+
+	a, b := dialPeers(t, ctx, url)
+	assert.Nil(t, a.Write(ctx, websocket.MessageText, []byte("cGFrZQ==")))
+	_, p, err := b.Read(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "cGFrZQ==", string(p))
+
+	assert.Nil(t, a.Write(ctx, websocket.MessageBinary, []byte{1, 2, 3}))
+	_, _, err = a.Read(ctx)
+	assert.Equal(t, websocket.StatusPolicyViolation, websocket.CloseStatus(err))
+	_, _, err = b.Read(ctx)
+	assert.Equal(t, websocket.StatusCode(wormhole.ClosePeerHungUp), websocket.CloseStatus(err))
+	assert.Equal(t, before+1, testutil.ToFloat64(protocolErrorCounter.WithLabelValues("binary", defaultTenant)))
+}
+
+func TestRelayClosesIdleAfterResult(t *testing.T) {
+	conf := *serverConf.Load()
+	conf.Protocol.ResultIdle = 100 * time.Millisecond
+	defer serverConf.Store(serverConf.Swap(&conf))
+
+	s := httptest.NewServer(http.HandlerFunc(relay))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	a, b := dialPeers(t, ctx, "ws"+strings.TrimPrefix(s.URL, "http"))
+	assert.Nil(t, a.Close(wormhole.CloseWebRTCSuccessDirect, ""))
+
+	start := time.Now()
+	_, _, err := b.Read(ctx)
+	assert.Equal(t, websocket.StatusNormalClosure, websocket.CloseStatus(err))
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimits is the set of limits applied to one client scope, e.g. a client IP or a bearer.
+// A zero value means unlimited.
+type RateLimits struct {
+	// Slots limits new slot allocations, in slots per second with burst.
+	Slots Rate
+	// Reserve limits reservation requests, in requests per second with burst.
+	Reserve Rate
+	// Conns limits the concurrent open WebSockets.
+	Conns int
+}
+
+// Rate is a token bucket rate, written as rate/burst, e.g. 0.5/10.
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+func (r Rate) String() string {
+	if r.PerSecond == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(r.PerSecond, 'f', -1, 64) + "/" + strconv.Itoa(r.Burst)
+}
+
+// Set parses rate/burst, implementing flag.Value. Empty means unlimited.
+func (r *Rate) Set(s string) (err error) {
+	if s == "" {
+		*r = Rate{}
+		return nil
+	}
+	*r, err = ParseRate(s)
+	return err
+}
+
+// ParseRate parses rate/burst, the burst defaults to max(1, rate).
+func ParseRate(s string) (r Rate, err error) {
+	rate, burst, hasBurst := strings.Cut(s, "/")
+	if r.PerSecond, err = strconv.ParseFloat(rate, 64); err != nil {
+		return r, fmt.Errorf("bad rate %q: %w", s, err)
+	}
+	if hasBurst {
+		if r.Burst, err = strconv.Atoi(burst); err != nil {
+			return r, fmt.Errorf("bad burst %q: %w", s, err)
+		}
+	} else {
+		r.Burst = int(math.Max(1, math.Ceil(r.PerSecond)))
+	}
+	return r, nil
+}
+
+// String formats the limits as slots=rate/burst,reserve=rate/burst,conns=n.
+func (l *RateLimits) String() string {
+	var parts []string
+	if s := l.Slots.String(); s != "" {
+		parts = append(parts, "slots="+s)
+	}
+	if s := l.Reserve.String(); s != "" {
+		parts = append(parts, "reserve="+s)
+	}
+	if l.Conns > 0 {
+		parts = append(parts, "conns="+strconv.Itoa(l.Conns))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set parses the limits from slots=rate/burst,reserve=rate/burst,conns=n, implementing flag.Value.
+// The limits not given are reset to unlimited.
+func (l *RateLimits) Set(s string) (err error) {
+	*l = RateLimits{}
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(kv, "=")
+		switch k {
+		case "slots":
+			l.Slots, err = ParseRate(v)
+		case "reserve":
+			l.Reserve, err = ParseRate(v)
+		case "conns":
+			l.Conns, err = strconv.Atoi(v)
+		default:
+			err = fmt.Errorf("unknown limit %q", k)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tokenBucket holds the available tokens of one key.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a set of token buckets keyed by client.
+type RateLimiter struct {
+	rate    Rate
+	buckets map[string]*tokenBucket
+	swept   time.Time
+	lock    sync.Mutex
+}
+
+// NewRateLimiter creates a RateLimiter, a nil limiter allows everything.
+func NewRateLimiter(rate Rate) *RateLimiter {
+	if rate.PerSecond <= 0 {
+		return nil
+	}
+	return newRateLimiter(rate)
+}
+
+// newRateLimiter creates a RateLimiter even if unlimited, for SetRate.
+func newRateLimiter(rate Rate) *RateLimiter {
+	return &RateLimiter{rate: rate, buckets: make(map[string]*tokenBucket)}
+}
+
+// SetRate changes the rate, keeping the tokens taken so far.
+func (l *RateLimiter) SetRate(rate Rate) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.rate = rate
+}
+
+// Allow takes a token from the bucket of key, and reports whether one was available.
+func (l *RateLimiter) Allow(key string) bool { return l.AllowN(key, 1) }
+
+// AllowN takes n tokens from the bucket of key, and reports whether they were available.
+func (l *RateLimiter) AllowN(key string, n int) bool {
+	if l == nil {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.rate.PerSecond <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.rate.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(l.rate.Burst), b.tokens+now.Sub(b.last).Seconds()*l.rate.PerSecond)
+	b.last = now
+	if b.tokens < float64(n) {
+		return false
+	}
+
+	b.tokens -= float64(n)
+	return true
+}
+
+// sweep forgets the buckets which are full again, at most once a minute.
+// This assumes the limiter is locked.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+
+	l.swept = now
+	refill := time.Duration(float64(l.rate.Burst) / l.rate.PerSecond * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// ConnLimiter limits the number of concurrent connections per key.
+type ConnLimiter struct {
+	max   int
+	conns map[string]int
+	lock  sync.Mutex
+}
+
+// NewConnLimiter creates a ConnLimiter, a nil limiter allows everything.
+func NewConnLimiter(max int) *ConnLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return newConnLimiter(max)
+}
+
+// newConnLimiter creates a ConnLimiter even if unlimited, for SetMax.
+// It counts the connections anyway, so a later limit applies to them.
+func newConnLimiter(max int) *ConnLimiter {
+	return &ConnLimiter{max: max, conns: make(map[string]int)}
+}
+
+// SetMax changes the limit, keeping the connections acquired so far.
+func (l *ConnLimiter) SetMax(max int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.max = max
+}
+
+// Acquire reserves a connection for key, and reports whether the limit allows it.
+// Each successful Acquire must be paired with a Release.
+func (l *ConnLimiter) Acquire(key string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.max > 0 && l.conns[key] >= l.max {
+		return false
+	}
+	l.conns[key]++
+	return true
+}
+
+// Release releases a connection acquired for key.
+func (l *ConnLimiter) Release(key string) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.conns[key]--; l.conns[key] <= 0 {
+		delete(l.conns, key)
+	}
+}
+
+// scopeLimiter applies RateLimits to one scope of clients.
+type scopeLimiter struct {
+	scope   string
+	slots   *RateLimiter
+	reserve *RateLimiter
+	conns   *ConnLimiter
+}
+
+func newScopeLimiter(scope string, l RateLimits) *scopeLimiter {
+	return &scopeLimiter{
+		scope:   scope,
+		slots:   newRateLimiter(l.Slots),
+		reserve: newRateLimiter(l.Reserve),
+		conns:   newConnLimiter(l.Conns),
+	}
+}
+
+func (s *scopeLimiter) set(l RateLimits) {
+	s.slots.SetRate(l.Slots)
+	s.reserve.SetRate(l.Reserve)
+	s.conns.SetMax(l.Conns)
+}
+
+// Limiters holds the limiters per client IP and per bearer.
+type Limiters struct {
+	ip     *scopeLimiter
+	bearer *scopeLimiter
+	// realIP tells how to read the client IP when behind a reverse proxy.
+	realIP atomic.Pointer[RealIP]
+}
+
+// RealIP tells how to read the client IP from a header set by a reverse proxy.
+type RealIP struct {
+	// Header is the header to read the client IP from, e.g. X-Real-IP or X-Forwarded-For.
+	Header string
+	// Proxies are the networks of the reverse proxies trusted to set Header.
+	Proxies []*net.IPNet
+}
+
+// ParseProxies parses a comma separated list of IPs or CIDRs.
+func ParseProxies(list string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("bad proxy IP %q", p)
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("bad proxy network %q: %w", p, err)
+		}
+		proxies = append(proxies, n)
+	}
+	return proxies, nil
+}
+
+// trusted reports whether ip is a trusted reverse proxy.
+func (p RealIP) trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, n := range p.Proxies {
+		if parsed != nil && n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewLimiters creates the limiters per client IP and per bearer.
+func NewLimiters(ip, bearer RateLimits, realIP RealIP) *Limiters {
+	l := &Limiters{ip: newScopeLimiter("ip", ip), bearer: newScopeLimiter("bearer", bearer)}
+	l.realIP.Store(&realIP)
+	return l
+}
+
+// Set changes the limits on a reload, keeping the buckets and the open
+// connections counted so far.
+func (l *Limiters) Set(ip, bearer RateLimits, realIP RealIP) {
+	l.ip.set(ip)
+	l.bearer.set(bearer)
+	l.realIP.Store(&realIP)
+}
+
+// ClientIP returns the IP of the client of the request.
+func (l *Limiters) ClientIP(r *http.Request) string {
+	return clientIP(r, *l.realIP.Load())
+}
+
+// keys returns the limiting keys of the request in each scope, empty if not applicable.
+func (l *Limiters) keys(r *http.Request) (ip, bearer string) {
+	return l.ClientIP(r), bearerToken(r)
+}
+
+// allow checks a rate limiter of both scopes, picked by kind.
+func (l *Limiters) allow(r *http.Request, kind string, pick func(*scopeLimiter) *RateLimiter) bool {
+	ip, bearer := l.keys(r)
+	for _, s := range []struct {
+		*scopeLimiter
+		key string
+	}{{l.ip, ip}, {l.bearer, bearer}} {
+		if s.key != "" && !pick(s.scopeLimiter).Allow(s.key) {
+			rateLimitCounter.WithLabelValues(s.scope, kind).Inc()
+			return false
+		}
+	}
+	return true
+}
+
+// AllowSlot reports whether the client may allocate a new slot.
+func (l *Limiters) AllowSlot(r *http.Request) bool {
+	return l.allow(r, "slots", func(s *scopeLimiter) *RateLimiter { return s.slots })
+}
+
+// AllowReserve reports whether the client may reserve a slot.
+func (l *Limiters) AllowReserve(r *http.Request) bool {
+	return l.allow(r, "reserve", func(s *scopeLimiter) *RateLimiter { return s.reserve })
+}
+
+// AcquireConn reserves an open WebSocket for the client, it returns the release
+// function, or nil when the limit is exceeded.
+func (l *Limiters) AcquireConn(r *http.Request) (release func()) {
+	ip, bearer := l.keys(r)
+	if !l.ip.conns.Acquire(ip) {
+		rateLimitCounter.WithLabelValues(l.ip.scope, "conns").Inc()
+		return nil
+	}
+	if bearer != "" && !l.bearer.conns.Acquire(bearer) {
+		l.ip.conns.Release(ip)
+		rateLimitCounter.WithLabelValues(l.bearer.scope, "conns").Inc()
+		return nil
+	}
+
+	return func() {
+		l.ip.conns.Release(ip)
+		if bearer != "" {
+			l.bearer.conns.Release(bearer)
+		}
+	}
+}
+
+// clientIP returns the IP of the client. When the request comes from a trusted
+// proxy, it is the rightmost address of the header not added by a trusted
+// proxy, as the client may send the header itself with any address.
+func clientIP(r *http.Request, realIP RealIP) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if realIP.Header == "" || !realIP.trusted(host) {
+		return host
+	}
+
+	// X-Forwarded-For: client, proxy1, proxy2, possibly on several lines.
+	values := r.Header.Values(realIP.Header)
+	for i := len(values) - 1; i >= 0; i-- {
+		addrs := strings.Split(values[i], ",")
+		for j := len(addrs) - 1; j >= 0; j-- {
+			addr := strings.TrimSpace(addrs[j])
+			if net.ParseIP(addr) == nil {
+				return host
+			}
+			if host = addr; !realIP.trusted(addr) {
+				return addr
+			}
+		}
+	}
+	return host
+}
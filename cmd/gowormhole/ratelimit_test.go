@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitsSet(t *testing.T) {
+	var l RateLimits
+	assert.Nil(t, l.Set("slots=0.5/20,reserve=2,conns=50"))
+	assert.Equal(t, RateLimits{Slots: Rate{PerSecond: 0.5, Burst: 20}, Reserve: Rate{PerSecond: 2, Burst: 2}, Conns: 50}, l)
+	assert.Equal(t, "slots=0.5/20,reserve=2/2,conns=50", l.String())
+	assert.NotNil(t, l.Set("foo=1"))
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := NewRateLimiter(Rate{PerSecond: 0.001, Burst: 2})
+	assert.True(t, l.Allow("a"))
+	assert.True(t, l.Allow("a"))
+	assert.False(t, l.Allow("a"))
+	assert.True(t, l.Allow("b"))
+
+	var unlimited *RateLimiter
+	assert.True(t, unlimited.Allow("a"))
+
+	c := NewConnLimiter(1)
+	assert.True(t, c.Acquire("a"))
+	assert.False(t, c.Acquire("a"))
+	c.Release("a")
+	assert.True(t, c.Acquire("a"))
+}
+
+func TestLimitersSet(t *testing.T) {
+	l := NewLimiters(RateLimits{Slots: Rate{PerSecond: 0.001, Burst: 1}}, RateLimits{}, RealIP{})
+	r := httptest.NewRequest("GET", "/", nil)
+	assert.True(t, l.AllowSlot(r))
+	assert.False(t, l.AllowSlot(r))
+	release := l.AcquireConn(r)
+	assert.NotNil(t, release)
+
+	// The reload keeps the taken tokens and the open connections.
+	l.Set(RateLimits{Slots: Rate{PerSecond: 0.001, Burst: 1}, Conns: 1}, RateLimits{}, RealIP{})
+	assert.False(t, l.AllowSlot(r))
+	assert.Nil(t, l.AcquireConn(r))
+	release()
+	assert.NotNil(t, l.AcquireConn(r))
+
+	l.Set(RateLimits{}, RateLimits{}, RealIP{})
+	assert.True(t, l.AllowSlot(r))
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseProxies("10.0.0.0/8, 192.168.1.1")
+	assert.Nil(t, err)
+	realIP := RealIP{Header: "X-Forwarded-For", Proxies: proxies}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Add("X-Forwarded-For", "1.1.1.1, 2.2.2.2")
+	r.Header.Add("X-Forwarded-For", "192.168.1.1")
+	assert.Equal(t, "2.2.2.2", clientIP(r, realIP))
+
+	// An untrusted client can't spoof the header.
+	r.RemoteAddr = "3.3.3.3:1234"
+	assert.Equal(t, "3.3.3.3", clientIP(r, realIP))
+	assert.Equal(t, "3.3.3.3", clientIP(r, RealIP{Header: "X-Forwarded-For"}))
+
+	// Only trusted proxies in the chain.
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "10.0.0.2")
+	assert.Equal(t, "10.0.0.2", clientIP(r, realIP))
+
+	_, err = ParseProxies("foo")
+	assert.NotNil(t, err)
+}
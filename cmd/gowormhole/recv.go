@@ -13,19 +13,33 @@ import (
 	"github.com/bingoohuang/gg/pkg/codec"
 	"github.com/bingoohuang/gg/pkg/defaults"
 	"github.com/bingoohuang/gg/pkg/iox"
+	"github.com/bingoohuang/gg/pkg/ss"
 	"github.com/bingoohuang/gowormhole/internal/util"
 	"github.com/bingoohuang/gowormhole/wormhole"
 )
 
 func receiveSubCmd(ctx context.Context, args ...string) {
-	dir, code, bearer, passLength := parseFlags(args)
+	dir, code, room, bearer, passLength, fromMailbox := parseFlags(args)
+	if fromMailbox {
+		files, err := receiveMailbox(Sigserv, bearer, code, dir)
+		for _, f := range files {
+			log.Printf("received %s from the mailbox", f)
+		}
+		if err != nil {
+			log.Fatalf("receiving from the mailbox failed: %v", err)
+		}
+		return
+	}
+
 	if err := receiveRetry(ctx, &receiveFileArg{
 		BaseArg: BaseArg{
 			Bearer:       bearer,
 			Code:         code,
+			Room:         room,
 			SecretLength: passLength,
 			Progress:     true,
 			Sigserv:      Sigserv,
+			Timeouts:     profile.Timeouts,
 			RetryTimes:   1,
 		},
 		Dir: dir,
@@ -37,6 +51,7 @@ func receiveSubCmd(ctx context.Context, args ...string) {
 type BaseArg struct {
 	Bearer         string            `json:"bearer"`
 	Code           string            `json:"code"`
+	Room           string            `json:"room"` // the named slot to wait in when Code is empty
 	SecretLength   int               `json:"secretLength" default:"2"`
 	Progress       bool              `json:"progress"`
 	Sigserv        string            `json:"sigserv"`
@@ -78,7 +93,7 @@ func receiveRetry(ctx context.Context, arg *receiveFileArg) error {
 }
 
 func receiveOnce(ctx context.Context, arg *receiveFileArg) error {
-	c, err := newConn(ctx, arg.Sigserv, arg.Bearer, arg.Code, arg.SecretLength, &arg.Timeouts)
+	c, err := newConn(ctx, arg.Sigserv, arg.Bearer, arg.Room, arg.Code, arg.SecretLength, &arg.Timeouts)
 	if err != nil {
 		return err
 	}
@@ -144,7 +159,7 @@ func receiveByWormhole(ctx context.Context, c io.ReadWriter, arg *receiveFileArg
 	}
 }
 
-func parseFlags(args []string) (dir, code, bearer string, passLength int) {
+func parseFlags(args []string) (dir, code, room, bearer string, passLength int, fromMailbox bool) {
 	set := flag.NewFlagSet(args[0], flag.ExitOnError)
 	set.Usage = func() {
 		_, _ = fmt.Fprintf(set.Output(), "receive files\n\n")
@@ -153,19 +168,23 @@ func parseFlags(args []string) (dir, code, bearer string, passLength int) {
 		set.PrintDefaults()
 	}
 	length := set.Int("length", 2, "length of generated secret, if generating")
-	directory := set.String("dir", ".", "directory to put downloaded files")
-	pBearer := set.String("bearer", os.Getenv("BEARER"), "Bearer authentication")
+	directory := set.String("dir", ss.Or(profile.Dir, "."), "directory to put downloaded files")
+	pBearer := set.String("bearer", defaultBearer(), "Bearer authentication, defaults to $BEARER or the bearer of the profile")
+	pMailbox := set.Bool("mailbox", false, "fetch the files left in the mailbox of the signalling server")
+	pRoom := set.String("room", "", "wait in the named room, e.g. build-farm, with a new password if no code is given")
 	_ = set.Parse(args[1:])
 
-	if set.NArg() > 1 {
+	if set.NArg() > 1 || *pMailbox && set.NArg() != 1 {
 		set.Usage()
 		os.Exit(2)
 	}
 
 	dir = *directory
 	code = set.Arg(0)
+	room = *pRoom
 	passLength = *length
 	bearer = *pBearer
+	fromMailbox = *pMailbox
 	return
 }
 
@@ -192,7 +211,10 @@ func (file *FileMetaRsp) receiving(ctx context.Context, c io.Reader, pb util.Pro
 	}
 
 	remainSize := int64(file.Size - file.Pos)
+	start := time.Now()
 	written, err := io.CopyN(f, util.NewProxyReader(c, pb), remainSize)
+	transferBytesCounter.WithLabelValues("received").Add(float64(written))
+	fileHistogram.WithLabelValues("received", util.If(err == nil, "success", "failure")).Observe(time.Since(start).Seconds())
 	if err != nil {
 		return fmt.Errorf("create receive file %+v failed: %w", *file, err)
 	}
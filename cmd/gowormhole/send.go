@@ -8,6 +8,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"time"
 
 	"github.com/bingoohuang/gg/pkg/codec"
 	"github.com/bingoohuang/gg/pkg/defaults"
@@ -32,19 +33,34 @@ func createCodeCmd(ctx context.Context, args ...string) {
 		set.PrintDefaults()
 	}
 	length := set.Int("length", 2, "length of generated secret")
-	pBearer := set.String("bearer", os.Getenv("BEARER"), "Bearer authentication")
+	pBearer := set.String("bearer", defaultBearer(), "Bearer authentication, defaults to $BEARER or the bearer of the profile")
+	ttl := set.Duration("ttl", 0, "requested time to live of the code, capped by the server")
+	release := set.String("release", "", "release this code instead of creating one, with -release-token")
+	releaseToken := set.String("release-token", "", "release token printed when the code was created")
+	room := set.String("room", "", "reserve the named room, e.g. build-farm, instead of a numeric slot")
 	_ = set.Parse(args[1:])
 
+	if *release != "" {
+		if err := releaseCode(ReleaseReq{Bearer: *pBearer, Sigserv: Sigserv, Code: *release, ReleaseToken: *releaseToken}); err != nil {
+			log.Fatalf("release code failed: %v", err)
+		}
+		fmt.Printf("code %s released\n", *release)
+		return
+	}
+
 	code, err := requestCode(CodeReq{
 		Bearer:       *pBearer,
 		SecretLength: *length,
 		Sigserv:      Sigserv,
+		TTL:          util.Duration(*ttl),
+		Room:         *room,
 	})
 	if err != nil {
-		panic(err)
+		log.Fatalf("create code failed: %v", err)
 	}
 
-	fmt.Printf("code: %s, slotNum: %d\n", code.Code, code.SlotNum)
+	fmt.Printf("code: %s, slot: %s, expires: %s, releaseToken: %s\n",
+		code.Code, code.Slot, code.Expires.Format(time.RFC3339), code.ReleaseToken)
 }
 
 func sendSubCmd(ctx context.Context, args ...string) {
@@ -57,7 +73,10 @@ func sendSubCmd(ctx context.Context, args ...string) {
 	}
 	length := set.Int("length", 2, "length of generated secret")
 	code := set.String("code", "", "use a wormhole code instead of generating one")
-	pBearer := set.String("bearer", os.Getenv("BEARER"), "Bearer authentication")
+	room := set.String("room", "", "wait in the named room, e.g. build-farm, with a new password instead of a numeric slot")
+	pBearer := set.String("bearer", defaultBearer(), "Bearer authentication, defaults to $BEARER or the bearer of the profile")
+	toMailbox := set.Bool("mailbox", false, "leave the files in the mailbox of the signalling server, for a receiver offline now")
+	ttl := set.Duration("ttl", 0, "requested time to keep the files in the mailbox, capped by the server")
 
 	_ = set.Parse(args[1:])
 
@@ -66,13 +85,24 @@ func sendSubCmd(ctx context.Context, args ...string) {
 		os.Exit(2)
 	}
 
+	if *toMailbox {
+		code, expires, err := sendMailbox(Sigserv, *pBearer, *length, *ttl, set.Args())
+		if err != nil {
+			log.Fatalf("sending to the mailbox failed: %v", err)
+		}
+		fmt.Printf("mailbox code: %s, expires: %s\n", code, expires.Format(time.RFC3339))
+		return
+	}
+
 	if err := sendFilesRetry(&sendFileArg{
 		BaseArg: BaseArg{
 			Bearer:       *pBearer,
 			Code:         *code,
+			Room:         *room,
 			SecretLength: *length,
 			Progress:     true,
 			Sigserv:      Sigserv,
+			Timeouts:     profile.Timeouts,
 			RetryTimes:   1,
 		},
 		Files: set.Args(),
@@ -112,7 +142,7 @@ func sendFilesRetry(arg *sendFileArg) error {
 }
 
 func sendFilesOnce(arg *sendFileArg) error {
-	c, err := newConn(context.TODO(), arg.Sigserv, arg.Bearer, arg.Code, arg.SecretLength, &arg.Timeouts)
+	c, err := newConn(context.TODO(), arg.Sigserv, arg.Bearer, arg.Room, arg.Code, arg.SecretLength, &arg.Timeouts)
 	if err != nil {
 		return err
 	}
@@ -181,7 +211,10 @@ func (file *FileMetaRsp) sendFile(c io.Writer, pb util.ProgressBar) error {
 		return nil
 	}
 
-	return file.sendFilePos(c, pb)
+	start := time.Now()
+	err := file.sendFilePos(c, pb)
+	fileHistogram.WithLabelValues("sent", util.If(err == nil, "success", "failure")).Observe(time.Since(start).Seconds())
+	return err
 }
 
 func (file *FileMetaRsp) sendFilePos(c io.Writer, pb util.ProgressBar) error {
@@ -201,6 +234,7 @@ func (file *FileMetaRsp) sendFilePos(c io.Writer, pb util.ProgressBar) error {
 	remainSize := file.Size - file.Pos
 	r := io.LimitReader(f, int64(remainSize))
 	n, err := io.CopyBuffer(c, r, make([]byte, msgChunkSize))
+	transferBytesCounter.WithLabelValues("sent").Add(float64(n))
 	if err != nil {
 		return fmt.Errorf("send file %s failed: %w", file.FullName, err)
 	}
@@ -5,17 +5,21 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/NYTimes/gziphandler"
 	"github.com/bingoohuang/gg/pkg/ss"
 	"github.com/bingoohuang/godaemon"
 	"github.com/bingoohuang/golog"
@@ -50,34 +54,116 @@ work, please file a bug report.
 `
 )
 
-var (
-	turnUser    string
-	turnServer  string
-	stunServers []webrtc.ICEServer
-)
+// ServerConf is the part of the signalling server configuration which is
+// reloaded on SIGHUP, without dropping the open connections.
+type ServerConf struct {
+	Auth     *Auth
+	Limiters *Limiters
+	// TurnURLs are the URLs of the TURN servers, e.g. turn:host:3478?transport=udp.
+	TurnURLs []string
+	// TurnUser is the static user:password of the TURN server, used without TurnSecret.
+	TurnUser string
+	// TurnSecret is the secret shared with the TURN server to issue ephemeral credentials.
+	TurnSecret string
+	// TurnTTL is the lifetime of the ephemeral credentials.
+	TurnTTL     time.Duration
+	StunServers []webrtc.ICEServer
+	// Protocol bounds what the peers may send.
+	Protocol ProtocolLimits
+	// Origins are the origins allowed to use the signalling endpoints.
+	Origins Origins
+	// Web is the web UI.
+	Web *WebSite
+}
+
+// serverConf is the configuration in use, open and unlimited by default.
+var serverConf atomic.Pointer[ServerConf]
+
+func init() {
+	serverConf.Store(&ServerConf{
+		Auth:     &Auth{},
+		Limiters: NewLimiters(RateLimits{}, RateLimits{}, RealIP{}),
+		Protocol: ProtocolLimits{MaxFrame: defaultMaxFrame},
+	})
+}
 
-// turnServers return the configured TURN server with HMAC-based ephemeral
-// credentials generated as described in:
+// TurnServers return the configured TURN servers the tenant may use with
+// HMAC-based ephemeral credentials generated as described in:
 // https://tools.ietf.org/html/draft-uberti-behave-turn-rest-00
-func turnServers() []webrtc.ICEServer {
-	if turnServer == "" {
+// or with the static TURN user if there is no shared secret.
+func (c *ServerConf) TurnServers(tenant *Tenant) []webrtc.ICEServer {
+	var urls []string
+	for _, u := range c.TurnURLs {
+		if tenant.AllowTurn(u) {
+			urls = append(urls, u)
+		}
+	}
+	if len(urls) == 0 {
 		return nil
 	}
 
-	username, credential := ss.Split2(turnUser, ss.WithSeps(":"))
+	var username, credential string
+	if c.TurnSecret != "" {
+		username, credential = turnCredentials(c.TurnSecret, tenant.Label(), c.TurnTTL, time.Now())
+	} else {
+		username, credential = ss.Split2(c.TurnUser, ss.WithSeps(":"))
+	}
 
 	return []webrtc.ICEServer{{
-		URLs:     []string{util.Prefix("turn:", util.AppendPort(turnServer, gowormhole.DefaultTurnPort))},
+		URLs:     urls,
 		Username: username, Credential: credential,
 	}}
 }
 
+// ICEServers returns the TURN servers with fresh credentials for the tenant, then the STUN servers.
+func (c *ServerConf) ICEServers(tenant *Tenant) []webrtc.ICEServer {
+	return append(c.TurnServers(tenant), c.StunServers...)
+}
+
+// parseTurnURLs parses the comma separated list of TURN servers, either
+// turn: or turns: URLs, or host[:port] for turn:host:port.
+func parseTurnURLs(list string) (urls []string) {
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.HasPrefix(s, "turns:") {
+			s = util.Prefix("turn:", util.AppendPort(s, gowormhole.DefaultTurnPort))
+		}
+		urls = append(urls, s)
+	}
+	return urls
+}
+
+// parseStunServers parses the comma separated list of STUN server addresses.
+func parseStunServers(list string) (servers []webrtc.ICEServer) {
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			servers = append(servers, webrtc.ICEServer{
+				URLs: []string{util.Prefix("stun:", util.AppendPort(s, gowormhole.DefaultStunPort))},
+			})
+		}
+	}
+	return servers
+}
+
+// webIndex returns the data of the templated index.html, the ICE servers without credentials.
+func (c *ServerConf) webIndex(serverName string) WebIndex {
+	index := WebIndex{ServerName: serverName}
+	for _, s := range c.StunServers {
+		index.StunServers = append(index.StunServers, s.URLs...)
+	}
+	index.TurnServers = c.TurnURLs
+	return index
+}
+
 // relay sets up a rendezvous on a slot and pipes the two websockets together.
 func relay(w http.ResponseWriter, r *http.Request) {
-	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		// This sounds nasty but checking origin only matters if requests
-		// change any user state on the server, aka CSRF. We don't have any
-		// user state other than this ephemeral connection. So it's fine.
+	tenant := tenantOf(r)
+	conf := serverConf.Load()
+	ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		// The handler already checked the origin against ServerConf.Origins,
+		// the same way as for the long-poll binding.
 		InsecureSkipVerify: true,
 		Subprotocols:       []string{wormhole.Protocol},
 	})
@@ -86,25 +172,85 @@ func relay(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if conn.Subprotocol() != wormhole.Protocol {
+	websocketsGauge.Inc()
+	defer websocketsGauge.Dec()
+
+	conn := wsConn{ws}
+	if ws.Subprotocol() != wormhole.Protocol {
 		// Make sure we negotiated the right protocol, since "blank" is also a default one.
-		protocolErrorCounter.WithLabelValues("wrongversion").Inc()
-		_ = conn.Close(wormhole.CloseWrongProto, "wrong protocol, please upgrade client")
+		rejectWrongVersion(tenant, conn)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), slotTimeout)
-	initMsg := wormhole.InitMsg{ICEServers: append(turnServers(), stunServers...)}
 	slotKey := r.URL.Path[1:] // strip leading slash
+	release := admit(r, conf, slotKey, conn)
+	if release == nil {
+		return
+	}
+	defer release()
 
-	var rconn atomic.Pointer[websocket.Conn]
+	relayPeer(r.Context(), conf, tenant, slotKey, newSlotPeer(r, conf, conn))
+}
+
+// rejectWrongVersion closes the connection of a client running another version of the signalling protocol.
+func rejectWrongVersion(tenant *Tenant, conn peerConn) {
+	protocolErrorCounter.WithLabelValues("wrongversion", tenant.Label()).Inc()
+	rejectionCounter.WithLabelValues("wrongversion").Inc()
+	_ = conn.Close(wormhole.CloseWrongProto, "wrong protocol, please upgrade client")
+}
+
+// admit applies the connection and slot rate limits to the peer connection of r.
+// It returns the func to release the connection, or nil after closing conn when
+// the peer is rejected.
+func admit(r *http.Request, conf *ServerConf, slotKey string, conn peerConn) (release func()) {
+	if release = conf.Limiters.AcquireConn(r); release == nil {
+		rejectionCounter.WithLabelValues("ratelimited").Inc()
+		_ = conn.Close(wormhole.CloseNoMoreSlots, "too many connections")
+		return nil
+	}
+
+	if !validSlotKey(slotKey) {
+		release()
+		rejectionCounter.WithLabelValues("badslot").Inc()
+		_ = conn.Close(wormhole.CloseNoSuchSlot, "invalid slot")
+		return nil
+	}
 
-	if rc, err := joinPeers(ctx, slotKey, conn, initMsg); err != nil {
+	if (slotKey == "" || !slots.Has(tenantOf(r), slotKey)) && !conf.Limiters.AllowSlot(r) {
+		release()
+		rejectionCounter.WithLabelValues("ratelimited").Inc()
+		_ = conn.Close(wormhole.CloseNoMoreSlots, "too many slots")
+		return nil
+	}
+	return release
+}
+
+func newSlotPeer(r *http.Request, conf *ServerConf, conn peerConn) *SlotPeer {
+	return &SlotPeer{Conn: conn, IP: conf.Limiters.ClientIP(r), UserAgent: r.UserAgent(), Joined: time.Now()}
+}
+
+// relayPeer sets up a rendezvous on the slot and pipes the connections of the two peers together.
+func relayPeer(ctx context.Context, conf *ServerConf, tenant *Tenant, slotKey string, peer *SlotPeer) {
+	conn := peer.Conn
+	ctx, cancel := context.WithTimeout(ctx, slotTimeout)
+	initMsg := wormhole.InitMsg{ICEServers: conf.ICEServers(tenant)}
+
+	// rconn holds the peerConn of the other peer once paired.
+	var rconn atomic.Value
+	otherConn := func() peerConn {
+		c, _ := rconn.Load().(peerConn)
+		return c
+	}
+
+	slot, join, rc, err := joinPeers(ctx, tenant, slotKey, peer, initMsg)
+	if slot != nil {
+		defer slots.Leave(slot)
+	}
+	if err != nil {
 		log.Printf("join peers failed: %v", err)
 		if se, ok := err.(*slotError); ok {
 			if se.CloseReason != "" {
 				_ = conn.Close(se.CloseCode, se.CloseReason)
-				slots.Delete(slotKey)
 			}
 		}
 	} else {
@@ -112,44 +258,90 @@ func relay(w http.ResponseWriter, r *http.Request) {
 	}
 
 	defer cancel()
+
+	limits := conf.Protocol
+	limiter := NewRateLimiter(limits.FrameRate)
+	activity := make(chan struct{}, 1)
+	var idleClosed atomic.Bool
+	if slot != nil && limits.ResultIdle > 0 {
+		go watchIdle(ctx, slot, tenant, conn, limits.ResultIdle, activity, &idleClosed)
+	}
+
 	for {
-		msgType, p, err := conn.Read(ctx)
+		msgType, p, err := conn.ReadFrame(ctx, limits.MaxFrame)
+		if errors.Is(err, errFrameTooLarge) {
+			protocolError(slot, tenant, conn, otherConn(), "toolarge")
+			return
+		}
 		if err != nil {
 			log.Printf("read error: %v", err)
+			if idleClosed.Load() {
+				return
+			}
+
+			outcome := "hungup"
 			switch websocket.CloseStatus(err) {
 			case wormhole.CloseBadKey:
-				iceCounter.WithLabelValues("fail", "badkey").Inc()
-				closeConn(rconn.Load(), wormhole.CloseBadKey, "bad key")
+				outcome = "badkey"
+				iceCounter.WithLabelValues("fail", "badkey", tenant.Label()).Inc()
+				closeConn(otherConn(), wormhole.CloseBadKey, "bad key")
 			case wormhole.CloseWebRTCFailed:
-				iceCounter.WithLabelValues("fail", "unknown").Inc()
+				outcome = "failed"
+				iceCounter.WithLabelValues("fail", "unknown", tenant.Label()).Inc()
 			case wormhole.CloseWebRTCSuccess:
-				iceCounter.WithLabelValues("success", "unknown").Inc()
+				outcome = "success"
+				iceCounter.WithLabelValues("success", "unknown", tenant.Label()).Inc()
 			case wormhole.CloseWebRTCSuccessDirect:
-				iceCounter.WithLabelValues("success", "direct").Inc()
+				outcome = "direct"
+				iceCounter.WithLabelValues("success", "direct", tenant.Label()).Inc()
 			case wormhole.CloseWebRTCSuccessRelay:
-				iceCounter.WithLabelValues("success", "relay").Inc()
+				outcome = "relay"
+				iceCounter.WithLabelValues("success", "relay", tenant.Label()).Inc()
 			default:
-				iceCounter.WithLabelValues("unknown", "unknown").Inc()
-				closeConn(rconn.Load(), wormhole.ClosePeerHungUp, "peer hung up")
+				iceCounter.WithLabelValues("unknown", "unknown", tenant.Label()).Inc()
+				closeConn(otherConn(), wormhole.ClosePeerHungUp, "peer hung up")
+			}
+			if slot != nil {
+				if slot.SetOutcome(outcome) {
+					if outcome != "hungup" {
+						handshakeHistogram.WithLabelValues(outcome).Observe(time.Since(join.Joined).Seconds())
+					}
+					switch outcome {
+					case "badkey":
+						webhooks.Emit(EventKeyMismatch, slot, nil)
+					case "direct", "relay", "success":
+						webhooks.Emit(EventWebRTCSuccess, slot, func(e *WebhookEvent) { e.Method = webrtcMethod(outcome) })
+					}
+				}
+				if outcome != "hungup" && outcome != "badkey" {
+					slot.report()
+				}
+				slot.Event("closed", fmt.Sprintf("peer from %s closed with %d", peer.IP, websocket.CloseStatus(err)))
 			}
 
 			return
 		}
 
-		rc := rconn.Load()
-		if rc == nil {
-			// We could synchronise with the rendezvous goroutine above and wait for  B to connect,
-			// but receiving anything at this stage is a protocol violation, so we should just bail out.
+		select {
+		case activity <- struct{}{}:
+		default:
+		}
+
+		rc := otherConn()
+		if kind := limits.checkFrame(slot, rc != nil, limiter, msgType, p); kind != "" {
+			protocolError(slot, tenant, conn, rc, kind)
 			return
 		}
 		if err := rc.Write(ctx, msgType, p); err != nil {
 			log.Printf("write error: %v", err)
 			return
 		}
+		slot.Bytes.Add(int64(len(p)))
+		slot.Messages.Add(1)
 	}
 }
 
-func writeConn(ctx context.Context, c *websocket.Conn, initMsg wormhole.InitMsg) error {
+func writeConn(ctx context.Context, c peerConn, initMsg wormhole.InitMsg) error {
 	buf, err := json.Marshal(initMsg)
 	if err != nil {
 		return NewSlotError(initMsg.Slot, wormhole.CloseBadKey, "", err)
@@ -162,57 +354,70 @@ func writeConn(ctx context.Context, c *websocket.Conn, initMsg wormhole.InitMsg)
 	return nil
 }
 
-func closeConn(c *websocket.Conn, code websocket.StatusCode, reason string) {
+func closeConn(c peerConn, code websocket.StatusCode, reason string) {
 	if c != nil {
 		_ = c.Close(code, reason)
 	}
 }
 
-func joinPeers(ctx context.Context, slotKey string, conn *websocket.Conn, initMsg wormhole.InitMsg) (*websocket.Conn, error) {
-	slot, err := slots.Setup(slotKey)
+// joinPeers joins the slot and waits for the other peer. The slot is returned
+// whenever it was joined, so that the caller leaves it, even on errors.
+func joinPeers(ctx context.Context, tenant *Tenant, slotKey string, peer *SlotPeer, initMsg wormhole.InitMsg) (*SlotItem, SlotJoin, peerConn, error) {
+	slot, join, err := slots.Setup(tenant, slotKey)
 	if err != nil {
-		return nil, err
+		return nil, join, nil, err
 	}
+	slot.AddPeer(peer)
+
+	conn := peer.Conn
 	initMsg.Slot = slot.SlotKey
-	initMsg.Mode = slot.Mode
+	initMsg.Mode = join.Mode
 	if err := writeConn(ctx, conn, initMsg); err != nil {
-		return nil, err
+		if join.Mode == wormhole.ModePeer1 {
+			slots.Delete(slot)
+		}
+		return slot, join, nil, err
 	}
 
-	log.Printf("slot: %s mode: %s", slot.SlotKey, slot.Mode)
+	log.Printf("slot: %s mode: %s tenant: %s", slot.SlotKey, join.Mode, tenant.Label())
 
-	if slot.Mode == wormhole.ModePeer1 {
+	if join.Mode == wormhole.ModePeer1 {
 		// write current conn to slot.C
-		if err := waitPair(ctx, conn, slot.C, slotKey); err != nil {
-			return nil, err
+		if err := waitPair(ctx, conn, slot); err != nil {
+			slots.Delete(slot)
+			return slot, join, nil, err
 		}
 
-		return <-slot.C, nil
+		return slot, join, <-slot.C, nil
 	}
 
 	// Join an existing slot.
-	var rconn *websocket.Conn
+	var rconn peerConn
 	select {
 	case <-ctx.Done():
-		return nil, NewSlotError(slotKey, wormhole.CloseSlotTimedOut, "timed out", nil)
+		return slot, join, nil, NewSlotError(slot.SlotKey, wormhole.CloseSlotTimedOut, "timed out", nil)
 	case rconn = <-slot.C: // 收到对端连接
 	}
 
 	slot.C <- conn
-	rendezvousCounter.WithLabelValues("success").Inc()
-	return rconn, nil
+	slot.Event("paired", "")
+	rendezvousCounter.WithLabelValues("success", tenant.Label()).Inc()
+	return slot, join, rconn, nil
 }
 
-func waitPair(ctx context.Context, conn *websocket.Conn, sc chan *websocket.Conn, slotKey string) error {
+func waitPair(ctx context.Context, conn peerConn, slot *SlotItem) error {
 	for {
 		select {
 		case <-ctx.Done():
-			rendezvousCounter.WithLabelValues("timeout").Inc()
-			return NewSlotError(slotKey, wormhole.CloseSlotTimedOut, "timed out", nil)
+			slot.SetOutcome("timeout")
+			rendezvousCounter.WithLabelValues("timeout", slot.Tenant.Label()).Inc()
+			return NewSlotError(slot.SlotKey, wormhole.CloseSlotTimedOut, "timed out", nil)
+		case <-slot.Expired(): // Reaped, already counted by the reaper.
+			return NewSlotError(slot.SlotKey, wormhole.CloseSlotTimedOut, "timed out", ErrSlotExpired)
 		case <-time.After(30 * time.Second): // Do a WebSocket Ping every 30 seconds.
 			_ = conn.Ping(ctx)
-		case sc <- conn:
-			rendezvousCounter.WithLabelValues("success").Inc()
+		case slot.C <- conn:
+			rendezvousCounter.WithLabelValues("success", slot.Tenant.Label()).Inc()
 			return nil
 		}
 	}
@@ -229,48 +434,280 @@ func signallingServerCmd(ctx context.Context, args ...string) {
 	httpAddr := f.String("http", ":http", "http listen address")
 	httpsAddr := f.String("https", "", "https listen address")
 	debugAddr := f.String("debug", "", "debug and metrics listen address")
+	drainTimeout := f.Duration("drain-timeout", 30*time.Second, "max time to let in-flight handshakes finish on SIGTERM before closing them")
+	webhookURLs := f.String("webhooks", "", "comma separated URLs to post the slot events of all the tenants to, the tenants of the token registry may add their own")
+	webhookSecret := f.String("webhook-secret", "", "secret to sign the webhooks of -webhooks by HMAC-SHA256")
+	webhookRetry := f.Duration("webhook-retry", defaultWebhookRetry, "how long a failing webhook is retried with exponential backoff")
+	auditSinks := f.String("audit", "", "comma separated sinks of the JSON lines audit log, one record per slot: stdout, a file path rotated daily, or an http(s) webhook URL")
+	adminToken := f.String("admin-token", "", "token to access the admin API under /admin/ on the debug listener, the API is disabled if empty")
 	hosts := f.String("hosts", "", "comma separated list of hosts by which site is accessible")
+	serverName := f.String("server-name", "", "name of the server shown by the templated index.html of the web UI, defaults to the first of -hosts")
+	webDir := f.String("web-dir", "", "directory of web UI files overlaying the embedded ones, with an optional index.html.tmpl template of index.html")
+	webReplace := f.Bool("web-replace", false, "serve the web UI of -web-dir only, instead of overlaying the embedded one")
+	allowedOrigins := f.String("allowed-origins", "", "comma separated host patterns of the web origins allowed to use the signalling endpoints, e.g. *.example.com,localhost:*, any origin if empty")
 	bearer := f.String("bearer", "", "Bearer authentication in header, e.g. Authorization: Bearer xyz")
+	tokensFile := f.String("tokens", "", `token registry JSON file, reloaded on change, e.g. {"tokens": [{"token": "xyz", "tenant": "team-a", "slotQuota": 100}]}`)
+	jwtKey := f.String("jwt-key", "", "HS256 key to validate bearer tokens as JWTs carrying tenant claims")
 	secretPath := f.String("secrets", os.Getenv("HOME")+"/keys", "path to put let's encrypt cache")
 	cert := f.String("cert", "", "https certificate (leave empty to use letsencrypt)")
 	key := f.String("key", "", "https certificate key")
 	pDaemon := f.Bool("daemon", false, "Daemonized")
+	reservedTTL := f.Duration("reserved-ttl", defaultReservedTTL, "max time a reserved code stays valid before anyone joins it")
+	waitingTTL := f.Duration("waiting-ttl", slotTimeout, "max time a peer waits in a slot for the other peer")
+	expiredTTL := f.Duration("expired-ttl", defaultExpiredTTL, "how long an expired slot is remembered to reject late comers")
+	maxSlots := f.Int("max-slots", defaultMaxSlots, "number of numeric slots, allocated from the shortest codes")
+	minCodeLength := f.Int("min-code-length", 1, "min number of words of the slot in the codes, from 1 to 4")
+	var ipLimits, bearerLimits RateLimits
+	f.Var(&ipLimits, "ip-limits", "limits per client IP, e.g. slots=0.5/20,reserve=0.2/10,conns=50 (rate per second/burst)")
+	f.Var(&bearerLimits, "bearer-limits", "limits per bearer, same format as -ip-limits")
+	maxFrame := f.Int64("max-frame", defaultMaxFrame, "max size in bytes of a signalling frame")
+	maxFrames := f.Int64("max-frames", defaultMaxFrames, "max number of signalling frames relayed per slot, 0 for unlimited")
+	var frameRate Rate
+	_ = frameRate.Set(defaultFrameRate)
+	f.Var(&frameRate, "frame-rate", "limit of signalling frames per connection (rate per second/burst), empty for unlimited")
+	resultIdle := f.Duration("result-idle", defaultResultIdle, "max time a connection may stay idle once a peer reported the WebRTC result, 0 for unlimited")
+	mailboxDir := f.String("mailbox-dir", "", "directory to store the bundles of the mailbox mode, the mailbox is disabled if empty")
+	mailboxMaxSize := f.Int64("mailbox-max-size", defaultMailboxMaxSize, "max size in bytes of a mailbox bundle")
+	mailboxMaxTotal := f.Int64("mailbox-max-total", defaultMailboxMaxTotal, "max size in bytes of all the mailbox bundles")
+	mailboxTTL := f.Duration("mailbox-ttl", defaultMailboxTTL, "max time a mailbox bundle is kept until fetched")
+	realIPHeader := f.String("real-ip-header", "", "header to read the client IP from behind a reverse proxy, e.g. X-Forwarded-For")
+	trustedProxies := f.String("trusted-proxies", "127.0.0.0/8,::1", "comma separated IPs or CIDRs of the reverse proxies trusted to set -real-ip-header")
 
 	// mondain/public-stun-list.txt https://gist.github.com/mondain/b0ec1cf5f60ae726202e
 	// https://github.com/pradt2/always-online-stun
 	stun := f.String("stun", "stun2.l.google.com:19302", "list of STUN server addresses to tell clients to use")
-	f.StringVar(&turnServer, "turn", "", "TURN server to use for relaying")
-	f.StringVar(&turnUser, "turn-user", "", "turn user in TURN server, e.g. user:password")
+	turnServer := f.String("turn", "", "TURN servers to use for relaying, comma separated host[:port] or URLs, e.g. turn:turn.example.com:3478?transport=udp,turns:turn.example.com:443?transport=tcp")
+	turnUser := f.String("turn-user", "", "turn user in TURN server, e.g. user:password")
+	turnSecret := f.String("turn-secret", "", "secret shared with the TURN server (its -authSecret) to issue ephemeral credentials, instead of -turn-user")
+	turnTTL := f.Duration("turn-ttl", defaultTurnCredTTL, "lifetime of the ephemeral TURN credentials")
+	embeddedTurn := f.Bool("embedded-turn", false, "run a TURN/STUN server in process, configured by the turn section of the config file, and advertise it to clients")
+	turnPublicIP := f.String("turn-public-ip", "", "public IP of the embedded TURN server, overrides public-ip of the turn section of the config file")
 	_ = f.Parse(args[1:])
 
+	// The flags given on the command line override the server section of the config file.
+	explicit := explicitFlags(f)
+	if err := applyConfig(f, config.Server, explicit); err != nil {
+		log.Fatal(err)
+	}
+
 	if (*cert == "") != (*key == "") {
 		log.Fatalf("-cert and -key options must be provided together or both left empty")
 	}
-	if turnServer != "" && turnUser == "" {
-		log.Fatal("cannot use a TURN server without a secret")
-	}
 
 	godaemon.Daemonize(*pDaemon)
 	golog.Setup()
 
-	for _, s := range strings.Split(*stun, ",") {
-		if s != "" {
-			stunServers = append(stunServers, webrtc.ICEServer{
-				URLs: []string{util.Prefix("stun:", util.AppendPort(s, gowormhole.DefaultStunPort))},
-			})
+	// The embedded TURN server shares the secret of the ephemeral credentials,
+	// a random one if none is configured, and is advertised as both TURN and STUN server.
+	var embedded *TurnOptions
+	if *embeddedTurn {
+		embedded = &TurnOptions{}
+		set := flag.NewFlagSet("turn", flag.ContinueOnError)
+		embedded.Flags(set)
+		if err := applyConfig(set, config.Turn, nil); err != nil {
+			log.Fatal(err)
+		}
+		embedded.PublicIP = ss.Or(*turnPublicIP, embedded.PublicIP)
+		embedded.AuthSecret = ss.Or(*turnSecret, embedded.AuthSecret)
+		if embedded.AuthSecret == "" {
+			secret := make([]byte, 32)
+			util.RandFull(secret)
+			embedded.AuthSecret = base64.RawURLEncoding.EncodeToString(secret)
+		}
+
+		ts, err := newTurnServer(*embedded, nil)
+		if err != nil {
+			log.Fatalf("start embedded TURN server failed: %v", err)
+		}
+		defer ts.Close()
+		turnURLs, _, _ := embedded.URLs("")
+		log.Printf("embedded TURN server listening on %s", strings.Join(turnURLs, " "))
+	}
+
+	// configure applies the reloadable flags: ICE servers, authentication, limits and TTLs.
+	// The limiters are kept across the reloads, which only change their limits.
+	var registry *TokenRegistry
+	var stopWatch context.CancelFunc = func() {}
+	limiters := NewLimiters(ipLimits, bearerLimits, RealIP{})
+	configure := func() error {
+		c := &ServerConf{
+			Auth:        &Auth{Bearer: *bearer},
+			Limiters:    limiters,
+			TurnURLs:    parseTurnURLs(*turnServer),
+			TurnUser:    *turnUser,
+			TurnSecret:  *turnSecret,
+			TurnTTL:     *turnTTL,
+			StunServers: parseStunServers(*stun),
+			Protocol: ProtocolLimits{
+				MaxFrame:   *maxFrame,
+				MaxFrames:  *maxFrames,
+				FrameRate:  frameRate,
+				ResultIdle: *resultIdle,
+			},
+		}
+		if c.Protocol.MaxFrame <= 0 {
+			return errors.New("-max-frame should be positive")
 		}
+		origins, err := parseOrigins(*allowedOrigins)
+		if err != nil {
+			return err
+		}
+		c.Origins = origins
+		proxies, err := ParseProxies(*trustedProxies)
+		if err != nil {
+			return err
+		}
+		if embedded != nil {
+			// -turn may still name the embedded server by a host name, advertised on each of its listeners.
+			host := *turnServer
+			if strings.ContainsAny(host, ":,") {
+				host = ""
+			}
+			turnURLs, stunURLs, err := embedded.URLs(host)
+			if err != nil {
+				return err
+			}
+			if *turnServer == "" || host != "" {
+				c.TurnURLs = turnURLs
+			}
+			c.TurnSecret = embedded.AuthSecret
+			c.StunServers = append(parseStunServers(strings.Join(stunURLs, ",")), c.StunServers...)
+		}
+		if len(c.TurnURLs) > 0 && c.TurnUser == "" && c.TurnSecret == "" {
+			return errors.New("cannot use a TURN server without a secret")
+		}
+		if *jwtKey != "" {
+			c.Auth.JWTKey = []byte(*jwtKey)
+		}
+		if *tokensFile == "" {
+			stopWatch()
+			registry = nil
+		} else if registry == nil || registry.file != *tokensFile {
+			r, err := NewTokenRegistry(*tokensFile)
+			if err != nil {
+				return fmt.Errorf("load token registry failed: %w", err)
+			}
+			stopWatch()
+			var watchCtx context.Context
+			watchCtx, stopWatch = context.WithCancel(ctx)
+			go r.Watch(watchCtx, 5*time.Second)
+			registry = r
+		}
+		c.Auth.Registry = registry
+		c.Web, err = NewWebSite(*webDir, *webReplace, c.webIndex(ss.Or(*serverName, strings.Split(*hosts, ",")[0])))
+		if err != nil {
+			return fmt.Errorf("load web UI failed: %w", err)
+		}
+
+		if err := slots.SetCapacity(*minCodeLength, *maxSlots); err != nil {
+			return err
+		}
+		slots.SetTTLs(SlotTTLs{Reserved: *reservedTTL, Waiting: *waitingTTL, Expired: *expiredTTL})
+		limiters.Set(ipLimits, bearerLimits, RealIP{Header: *realIPHeader, Proxies: proxies})
+		serverConf.Store(c)
+		return nil
+	}
+	if err := configure(); err != nil {
+		log.Fatal(err)
+	}
+
+	// reload reloads the config file on SIGHUP, the open connections keep the configuration they started with.
+	reload := func() error {
+		c, err := config.Reload()
+		if err != nil {
+			return err
+		}
+		resetFlags(f, explicit)
+		if err := applyConfig(f, c.Server, explicit); err != nil {
+			return err
+		}
+		config = c
+		return configure()
+	}
+
+	if *auditSinks != "" {
+		a, err := NewAuditLog(*auditSinks)
+		if err != nil {
+			log.Fatal(err)
+		}
+		audit = a
+		defer audit.Close()
 	}
 
-	fs := gziphandler.GzipHandler(http.FileServer(http.FS(gowormhole.Web)))
+	targets, err := parseWebhookTargets(*webhookURLs, *webhookSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Started even without targets of the server, for the ones of the tenants.
+	webhooks = NewWebhooks(targets, *webhookRetry)
+	defer webhooks.Close()
+
+	go slots.RunReaper(ctx, reapInterval)
+
+	if *mailboxDir != "" {
+		m, err := NewMailbox(*mailboxDir, *mailboxMaxSize, *mailboxMaxTotal, *mailboxTTL)
+		if err != nil {
+			log.Fatalf("create mailbox failed: %v", err)
+		}
+		mailbox = m
+		go mailbox.RunReaper(ctx, reapInterval)
+	}
 
 	handler := func(w http.ResponseWriter, r *http.Request) {
-		if *bearer != "" && "Bearer "+*bearer != r.Header.Get("Authorization") {
-			http.Error(w, "Not Authorized", http.StatusUnauthorized)
+		// The probes of load balancers and orchestrators don't authenticate.
+		switch r.URL.Path {
+		case "/healthz":
+			healthz(w, r)
+			return
+		case "/readyz":
+			readyz(w, r)
+			return
+		}
+
+		conf := serverConf.Load()
+		if isSignalling(r) && !conf.Origins.Allow(r) {
+			rejectOrigin(w, r)
 			return
 		}
 
+		tenant, err := conf.Auth.Authenticate(r)
+		if err != nil {
+			rejectionCounter.WithLabelValues("unauthorized").Inc()
+			if isAPI(r) {
+				apiError(w, http.StatusUnauthorized, "unauthorized", "not authorized")
+			} else {
+				http.Error(w, "Not Authorized", http.StatusUnauthorized)
+			}
+			return
+		}
+		r = withTenant(r, tenant)
+
+		if isAPI(r) {
+			apiHandler(w, r)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/"+wormhole.MailboxPath) {
+			mailboxHandler(w, r)
+			return
+		}
+
+		// Handle the long-poll fallback of WebSocket connections.
+		if strings.HasPrefix(r.URL.Path, "/"+wormhole.PollPath) {
+			pollHandler(w, r)
+			return
+		}
+
+		// The legacy reservation by header, kept for the older clients, see apiPrefix.
 		if r.Header.Get("GoWormhole") == GowormholeReserveslotkey {
-			reserveSlotKey(w)
+			if !conf.Limiters.AllowReserve(r) {
+				rejectionCounter.WithLabelValues("ratelimited").Inc()
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.WriteHeader(http.StatusTooManyRequests)
+				_ = json.NewEncoder(w).Encode(reserveSlotResult{Error: "too many requests"})
+				return
+			}
+			reserveSlotKey(w, r)
 			return
 		}
 
@@ -288,18 +725,9 @@ func signallingServerCmd(ctx context.Context, args ...string) {
 		// https://github.com/WebAssembly/content-security-policy/issues/7
 		// connect-src is required for safari :(
 		// https://bugs.webkit.org/show_bug.cgi?id=201591
-		csp := "default-src 'self'; script-src 'self' 'unsafe-eval'; img-src 'self' blob:; connect-src 'self' ws://localhost/"
-		for _, host := range strings.Split(*hosts, ",") {
-			if host != "" {
-				csp += fmt.Sprintf(" wss://%v", host)
-				csp += fmt.Sprintf(" ws://%v", host)
-			}
-		}
+		csp := "default-src 'self'; script-src 'self' 'unsafe-eval'; img-src 'self' blob:; connect-src " +
+			conf.Origins.ConnectSrc(strings.Split(*hosts, ","))
 		w.Header().Set("Content-Security-Policy", csp)
-		// Set a small max age for cache. We might want to switch to a content-addressed
-		// resource naming scheme and change this to immutable, but until then disable caching.
-		w.Header().Set("Cache-Control", "no-cache")
-
 		// Set HSTS header for 2 years on HTTPS connections.
 		if *httpsAddr != "" {
 			w.Header().Set("Strict-Transport-Security", "max-age=63072000")
@@ -314,12 +742,12 @@ func signallingServerCmd(ctx context.Context, args ...string) {
 		// Handle the Service Worker private prefix. A well-behaved Service Worker
 		// must *never* reach us on this path.
 		if strings.HasPrefix(r.URL.Path, "/_/") {
-			protocolErrorCounter.WithLabelValues("serviceworkererr").Inc()
+			protocolErrorCounter.WithLabelValues("serviceworkererr", tenant.Label()).Inc()
 			http.Error(w, serviceWorkerPage, http.StatusNotFound)
 			return
 		}
 
-		fs.ServeHTTP(w, r)
+		conf.Web.ServeHTTP(w, r)
 	}
 
 	m := &autocert.Manager{
@@ -329,25 +757,32 @@ func signallingServerCmd(ctx context.Context, args ...string) {
 	}
 
 	srv := &http.Server{
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 60 * time.Minute,
-		IdleTimeout:  20 * time.Second,
-		Addr:         *httpAddr,
-		Handler:      m.HTTPHandler(http.HandlerFunc(handler)),
+		// Not ReadTimeout, which would cut the uploads to the mailbox.
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      60 * time.Minute,
+		IdleTimeout:       20 * time.Second,
+		Addr:              *httpAddr,
+		Handler:           m.HTTPHandler(http.HandlerFunc(handler)),
 	}
 
+	var servers []*http.Server
 	errCh := make(chan error)
 	if *debugAddr != "" {
 		http.Handle("/metrics", promhttp.Handler())
+		registerHealth(http.DefaultServeMux)
+		if *adminToken != "" {
+			registerAdmin(http.DefaultServeMux, *adminToken)
+		}
 		go func() { errCh <- http.ListenAndServe(*debugAddr, nil) }()
 	}
 	if *httpsAddr != "" {
 		server := &http.Server{
-			ReadTimeout:  10 * time.Second,
-			WriteTimeout: 60 * time.Minute,
-			IdleTimeout:  20 * time.Second,
-			Addr:         *httpsAddr,
-			Handler:      http.HandlerFunc(handler),
+			// Not ReadTimeout, which would cut the uploads to the mailbox.
+			ReadHeaderTimeout: 10 * time.Second,
+			WriteTimeout:      60 * time.Minute,
+			IdleTimeout:       20 * time.Second,
+			Addr:              *httpsAddr,
+			Handler:           http.HandlerFunc(handler),
 			TLSConfig: &tls.Config{
 				MinVersion: tls.VersionTLS12,
 				CipherSuites: []uint16{
@@ -364,27 +799,85 @@ func signallingServerCmd(ctx context.Context, args ...string) {
 			server.TLSConfig.GetCertificate = m.GetCertificate
 		}
 		srv.Handler = m.HTTPHandler(nil) // Enable redirect to https handler.
+		servers = append(servers, server)
 		go func() { errCh <- server.ListenAndServeTLS(*cert, *key) }()
 	}
 	if *httpAddr != "" {
+		servers = append(servers, srv)
 		go func() { errCh <- srv.ListenAndServe() }()
 	}
-	log.Fatal(<-errCh)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+loop:
+	for {
+		select {
+		case err := <-errCh:
+			log.Fatal(err)
+		case sig := <-sigs:
+			if sig != syscall.SIGHUP {
+				log.Printf("received %s, draining", sig)
+				break loop
+			}
+			if err := reload(); err != nil {
+				log.Printf("reload config failed, keeping the current one: %v", err)
+			} else {
+				log.Printf("config reloaded")
+			}
+		}
+	}
+
+	drainSlots(*drainTimeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("shutdown server %s failed: %v", server.Addr, err)
+		}
+	}
+}
+
+// drainSlots stops accepting new slots, lets the in-flight handshakes finish
+// up to timeout, then closes the remaining websockets asking the clients to
+// retry on the same slot.
+func drainSlots(timeout time.Duration) {
+	slots.SetDraining(true)
+
+	deadline := time.Now().Add(timeout)
+	for n := slots.Pairing(); n > 0 && time.Now().Before(deadline); n = slots.Pairing() {
+		log.Printf("waiting for %d in-flight handshakes", n)
+		time.Sleep(time.Second)
+	}
+
+	var wg sync.WaitGroup
+	for _, item := range slots.Sessions() {
+		wg.Add(1)
+		go func(item *SlotItem) {
+			defer wg.Done()
+			slots.ForceClose(item, wormhole.CloseServerRestarting, "server restarting, please retry")
+		}(item)
+	}
+	wg.Wait()
 }
 
 type reserveSlotResult struct {
-	Error string `json:"error"`
-	Key   string `json:"key"`
+	Error   string    `json:"error"`
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires,omitempty"`
 }
 
-func reserveSlotKey(w http.ResponseWriter) {
-	item, err := slots.Reserve()
+func reserveSlotKey(w http.ResponseWriter, r *http.Request) {
+	// The client may ask for a shorter TTL than the server's default, e.g. GoWormhole-TTL: 10m
+	ttl, _ := time.ParseDuration(r.Header.Get(GowormholeTTLHeader))
+	item, err := slots.Reserve(tenantOf(r), "", ttl)
 
 	var result reserveSlotResult
 	if err != nil {
 		result.Error = err.Error()
 	} else {
 		result.Key = item.SlotKey
+		result.Expires = item.Deadline()
 	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(result)
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"log"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bingoohuang/gowormhole/internal/util"
+	"github.com/bingoohuang/gowormhole/wordlist"
 	"github.com/bingoohuang/gowormhole/wormhole"
 	"nhooyr.io/websocket"
 )
@@ -30,106 +39,699 @@ func (s slotError) Error() string {
 	return fmt.Sprintf("SlotKey: %s, CloseCode: %d, closeReason: %s, error: %v", s.SlotKey, s.CloseCode, s.CloseReason, s.Err)
 }
 
+func (s slotError) Unwrap() error { return s.Err }
+
 var _ error = (*slotError)(nil)
 
+var (
+	// ErrNoMoreSlots is returned when the slot space is exhausted.
+	ErrNoMoreSlots = errors.New("no more slots available")
+	// ErrSlotExpired is returned when a slot is used after it has been reaped.
+	ErrSlotExpired = errors.New("slot expired")
+	// ErrSlotQuotaExceeded is returned when the tenant has used up its slot quota.
+	ErrSlotQuotaExceeded = errors.New("slot quota exceeded")
+	// ErrDraining is returned when the server is draining and doesn't accept new slots.
+	ErrDraining = errors.New("server draining")
+	// ErrNoSuchSlot is returned when releasing a slot which isn't allocated.
+	ErrNoSuchSlot = errors.New("no such slot")
+	// ErrBadReleaseToken is returned when releasing a slot with a wrong release token.
+	ErrBadReleaseToken = errors.New("bad release token")
+	// ErrSlotInUse is returned when releasing a slot a peer already joined,
+	// or reserving a named slot which is already allocated.
+	ErrSlotInUse = errors.New("slot in use")
+	// ErrBadSlotName is returned when reserving a named slot with an invalid name.
+	ErrBadSlotName = errors.New("bad slot name")
+)
+
+const (
+	// defaultReservedTTL is how long a reserved code stays valid before anyone joins it.
+	defaultReservedTTL = time.Hour
+	// defaultExpiredTTL is how long the key of a reaped slot is remembered, so that
+	// late comers get CloseNoSuchSlot instead of silently becoming a new peer-1.
+	defaultExpiredTTL = time.Hour
+	// reapInterval is how often the reaper scans the slots.
+	reapInterval = 10 * time.Second
+)
+
+// SlotTTLs holds the maximum time a slot may stay in each state.
+type SlotTTLs struct {
+	// Reserved is the TTL of a ModeNone slot, reserved by the code command but not joined yet.
+	// It is also the upper bound of the TTL a client may request when reserving.
+	Reserved time.Duration
+	// Waiting is the TTL of a ModePeer1 slot, waiting for the other peer to join.
+	Waiting time.Duration
+	// Expired is how long a reaped slot key is remembered.
+	Expired time.Duration
+}
+
 type SlotItem struct {
+	// ID identifies the slot during its whole life, while SlotKey may be reused
+	// once both peers have joined.
+	ID uint64
+	// SlotKey is the number or the name of the slot.
 	SlotKey string
-	C       chan *websocket.Conn
+	C       chan peerConn
 	Mode    wormhole.SlotItemMode
+
+	// Created is when the slot was allocated.
+	Created time.Time
+	// Reserved is when the slot was reserved by the code command, zero if never reserved.
+	Reserved time.Time
+	// Joined is when the first peer joined the slot, zero if nobody joined yet.
+	Joined time.Time
+	// Paired is when the second peer joined the slot, zero if it didn't yet.
+	Paired time.Time
+	// TTL is the time to live in the current state, counted from Reserved or Joined.
+	TTL time.Duration
+	// Tenant is the tenant which allocated the slot.
+	Tenant *Tenant
+	// ReleaseToken is the token to release the slot while reserved, empty if not reserved.
+	ReleaseToken string `json:"-"`
+
+	// Bytes is the number of signalling bytes relayed between the peers.
+	Bytes atomic.Int64
+	// Messages is the number of signalling messages relayed between the peers.
+	Messages atomic.Int64
+
+	// key is the key of the slot in Slots, see slotMapKey.
+	key string
+	// expired is closed by the reaper when the slot outlives its TTL.
+	expired    chan struct{}
+	expireOnce sync.Once
+	// reported is closed when a peer reports the WebRTC result.
+	reported   chan struct{}
+	reportOnce sync.Once
+	// active is the number of peers still connected, guarded by the Slots lock.
+	active int
+
+	peers    []*SlotPeer
+	timeline []SlotEvent
+	// outcome is how the slot ended, e.g. direct, relay, failed, badkey or timeout.
+	outcome string
+	lock    sync.Mutex
+}
+
+// SlotPeer is a peer connected to a slot.
+type SlotPeer struct {
+	Conn      peerConn  `json:"-"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	Joined    time.Time `json:"joined"`
+}
+
+// SlotEvent is an entry of the signalling timeline of a slot.
+type SlotEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+func newSlotItem(slotKey string, mode wormhole.SlotItemMode, tenant *Tenant, now time.Time) *SlotItem {
+	item := &SlotItem{
+		ID:       slotIDs.Add(1),
+		SlotKey:  slotKey,
+		key:      slotMapKey(tenant, slotKey),
+		C:        make(chan peerConn),
+		Mode:     mode,
+		Created:  now,
+		Tenant:   tenant,
+		expired:  make(chan struct{}),
+		reported: make(chan struct{}),
+	}
+	item.Event("allocated", "tenant "+tenant.Label())
+	return item
+}
+
+// validSlotKey tells if the slot key requested by a client is valid: empty to
+// allocate a numeric slot, a number or a name.
+func validSlotKey(slotKey string) bool {
+	return slotKey == "" || isNumericSlot(slotKey) || wordlist.ValidName(slotKey)
+}
+
+func isNumericSlot(slotKey string) bool {
+	if slotKey == "" {
+		return false
+	}
+	for _, c := range slotKey {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// slotMapKey returns the key of a slot in Slots. The numeric slots are shared by
+// all the tenants, while the named ones are scoped by tenant, so that two teams
+// may both use a room called build-farm.
+func slotMapKey(tenant *Tenant, slotKey string) string {
+	if slotKey == "" || isNumericSlot(slotKey) {
+		return slotKey
+	}
+	return tenant.Label() + "/" + slotKey
+}
+
+// slotIDs generates the slot IDs.
+var slotIDs atomic.Uint64
+
+// Expired returns a channel which is closed when the slot is reaped.
+func (s *SlotItem) Expired() <-chan struct{} { return s.expired }
+
+// expire closes the expired channel, it is safe to call it more than once.
+func (s *SlotItem) expire() { s.expireOnce.Do(func() { close(s.expired) }) }
+
+// Reported returns a channel which is closed when a peer reports the WebRTC result.
+func (s *SlotItem) Reported() <-chan struct{} { return s.reported }
+
+// report closes the reported channel, it is safe to call it more than once.
+func (s *SlotItem) report() { s.reportOnce.Do(func() { close(s.reported) }) }
+
+// Event appends an event to the timeline of the slot.
+func (s *SlotItem) Event(event, detail string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.timeline = append(s.timeline, SlotEvent{Time: time.Now(), Event: event, Detail: detail})
+}
+
+// Timeline returns a copy of the timeline of the slot.
+func (s *SlotItem) Timeline() []SlotEvent {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]SlotEvent(nil), s.timeline...)
+}
+
+// AddPeer records a peer connected to the slot.
+func (s *SlotItem) AddPeer(peer *SlotPeer) {
+	s.lock.Lock()
+	s.peers = append(s.peers, peer)
+	n := len(s.peers)
+	s.lock.Unlock()
+
+	s.Event("joined", fmt.Sprintf("peer%d from %s", n, peer.IP))
+}
+
+// Peers returns a copy of the peers connected to the slot.
+func (s *SlotItem) Peers() []*SlotPeer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]*SlotPeer(nil), s.peers...)
+}
+
+// CloseAll closes the websockets of all peers with code and reason.
+func (s *SlotItem) CloseAll(code websocket.StatusCode, reason string) {
+	for _, p := range s.Peers() {
+		_ = p.Conn.Close(code, reason)
+	}
+}
+
+// SetOutcome records how the slot ended, the first outcome wins, and reports
+// whether it was this one.
+func (s *SlotItem) SetOutcome(outcome string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.outcome != "" {
+		return false
+	}
+	s.outcome = outcome
+	return true
+}
+
+// Outcome returns how the slot ended, empty if not known yet.
+func (s *SlotItem) Outcome() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.outcome
+}
+
+// Deadline returns the time when the slot expires in its current state.
+func (s *SlotItem) Deadline() time.Time {
+	if s.Mode == wormhole.ModeNone {
+		return s.Reserved.Add(s.TTL)
+	}
+	return s.Joined.Add(s.TTL)
 }
 
 type Slots struct {
-	m    map[string]*SlotItem
-	lock sync.RWMutex
+	// m holds the allocated slots by slotMapKey.
+	m map[string]*SlotItem
+	// sessions holds all slots by ID, from allocation until the last peer leaves.
+	sessions map[uint64]*SlotItem
+	// draining rejects allocating new slots.
+	draining atomic.Bool
+	// expired remembers the keys of reaped numeric slots with the time they were
+	// reaped. The named slots are not remembered, so that a room is reusable at once.
+	expired map[string]time.Time
+	// tenants counts the busy slots per tenant name.
+	tenants map[string]int
+	// alloc tracks the numeric slots in m or in expired.
+	alloc *SlotAllocator
+	// minLength and maxSlots are the capacity of alloc.
+	minLength, maxSlots int
+	TTLs                SlotTTLs
+	lock                sync.RWMutex
 }
 
-func (r *Slots) Delete(slotKey string) {
+// NewSlots creates a Slots with the given TTLs, and the default capacity.
+func NewSlots(ttls SlotTTLs) *Slots {
+	alloc, _ := NewSlotAllocator(1, defaultMaxSlots)
+	alloc.export()
+	return &Slots{
+		m:         make(map[string]*SlotItem),
+		sessions:  make(map[uint64]*SlotItem),
+		expired:   make(map[string]time.Time),
+		tenants:   make(map[string]int),
+		alloc:     alloc,
+		minLength: 1,
+		maxSlots:  defaultMaxSlots,
+		TTLs:      ttls,
+	}
+}
+
+// slots is a map of allocated slot numbers.
+var slots = NewSlots(SlotTTLs{
+	Reserved: defaultReservedTTL,
+	Waiting:  slotTimeout,
+	Expired:  defaultExpiredTTL,
+})
+
+// Delete removes the slot item, if it is still the one registered on its key.
+func (r *Slots) Delete(item *SlotItem) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
-	delete(r.m, slotKey)
-	slotsGuage.Set(float64(len(r.m)))
+	if r.m[item.key] == item {
+		r.remove(item)
+	}
 }
 
-// slots is a map of allocated slot numbers.
-var slots = Slots{m: make(map[string]*SlotItem)}
+// Leave records that a peer which joined the slot item by Setup has disconnected.
+func (r *Slots) Leave(item *SlotItem) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 
-func (r *Slots) Reserve() (*SlotItem, error) {
-	slotKey, _ := r.free()
-	if slotKey == "" {
-		rendezvousCounter.WithLabelValues("nomoreslots").Inc()
-		return nil, fmt.Errorf("no more slots available")
+	item.active--
+	r.forget(item)
+}
+
+// Sessions returns all the slots alive, ordered by ID.
+func (r *Slots) Sessions() []*SlotItem {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	items := make([]*SlotItem, 0, len(r.sessions))
+	for _, item := range r.sessions {
+		items = append(items, item)
 	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	return items
+}
 
-	item := &SlotItem{
-		SlotKey: slotKey,
-		C:       make(chan *websocket.Conn),
-		Mode:    wormhole.ModeNone,
+// Pairing returns the number of slots with both peers joined, which are doing the handshake.
+func (r *Slots) Pairing() (n int) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, item := range r.sessions {
+		if item.Mode == wormhole.ModePeer2 && item.active > 0 {
+			n++
+		}
 	}
+	return n
+}
+
+// Occupancy returns the fraction of the numeric slots in use, counting the
+// expired keys which can't be allocated either.
+func (r *Slots) Occupancy() float64 {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	used, capacity := r.alloc.Occupancy()
+	return float64(used) / float64(capacity)
+}
+
+// Session returns the slot alive by its ID.
+func (r *Slots) Session(id uint64) (*SlotItem, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	item, ok := r.sessions[id]
+	return item, ok
+}
 
-	r.m[slotKey] = item
+// ForceClose closes the slot with code, sent to the websockets of both peers.
+func (r *Slots) ForceClose(item *SlotItem, code websocket.StatusCode, reason string) {
+	r.Delete(item)
+	item.SetOutcome("closed")
+	item.Event("closed", reason)
+	item.CloseAll(code, reason)
+	// Expire after closing, so that a waiting peer doesn't close first with CloseSlotTimedOut.
+	item.expire()
+}
+
+// SetTTLs changes the TTLs of the slots, the slots already allocated keep their TTL.
+func (r *Slots) SetTTLs(ttls SlotTTLs) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.TTLs = ttls
+}
+
+// SetCapacity changes the numeric slots to maxSlots slots, starting with the
+// first slot of minLength words. The slots already allocated are kept, even if
+// out of the new capacity.
+func (r *Slots) SetCapacity(minLength, maxSlots int) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if minLength == r.minLength && maxSlots == r.maxSlots {
+		return nil
+	}
+	alloc, err := NewSlotAllocator(minLength, maxSlots)
+	if err != nil {
+		return err
+	}
+	for key := range r.m {
+		if n, ok := slotNumber(key); ok {
+			alloc.Take(n)
+		}
+	}
+	for key := range r.expired {
+		if n, ok := slotNumber(key); ok {
+			alloc.Take(n)
+		}
+	}
+	alloc.export()
+	r.alloc, r.minLength, r.maxSlots = alloc, minLength, maxSlots
+	return nil
+}
+
+// SetDraining sets whether the server is draining, when new slots are rejected.
+func (r *Slots) SetDraining(draining bool) { r.draining.Store(draining) }
+
+// Draining tells whether the server is draining.
+func (r *Slots) Draining() bool { return r.draining.Load() }
+
+// Has reports whether the slot key is allocated, for the tenant if it is named.
+func (r *Slots) Has(tenant *Tenant, slotKey string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	_, ok := r.m[slotMapKey(tenant, slotKey)]
+	return ok
+}
+
+// Reserve allocates a new slot in ModeNone, for a code to be handed out before
+// anyone connects. name is the name of the slot for the tenant, a free numeric
+// slot is allocated if it is empty. ttl is the time to live requested by the
+// client, it is capped by TTLs.Reserved and the tenant's MaxSlotTTL.
+func (r *Slots) Reserve(tenant *Tenant, name string, ttl time.Duration) (*SlotItem, error) {
+	if name != "" && !wordlist.ValidName(name) {
+		return nil, ErrBadSlotName
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.Draining() {
+		rejectionCounter.WithLabelValues("draining").Inc()
+		return nil, ErrDraining
+	}
+	if r.overQuota(tenant) {
+		rendezvousCounter.WithLabelValues("quotaexceeded", tenant.Label()).Inc()
+		rejectionCounter.WithLabelValues("quotaexceeded").Inc()
+		return nil, ErrSlotQuotaExceeded
+	}
+
+	slotKey := name
+	if slotKey != "" {
+		if _, ok := r.m[slotMapKey(tenant, slotKey)]; ok {
+			return nil, ErrSlotInUse
+		}
+	} else if slotKey, _ = r.free(); slotKey == "" {
+		rendezvousCounter.WithLabelValues("nomoreslots", tenant.Label()).Inc()
+		rejectionCounter.WithLabelValues("nomoreslots").Inc()
+		return nil, ErrNoMoreSlots
+	}
+
+	if ttl <= 0 || ttl > r.TTLs.Reserved {
+		ttl = r.TTLs.Reserved
+	}
+	ttl = tenant.CapTTL(ttl)
+
+	now := time.Now()
+	item := newSlotItem(slotKey, wormhole.ModeNone, tenant, now)
+	item.Reserved = now
+	item.TTL = ttl
+	token := make([]byte, 16)
+	util.RandFull(token)
+	item.ReleaseToken = base64.RawURLEncoding.EncodeToString(token)
+	item.Event("reserved", "ttl "+ttl.String())
+
+	r.add(item)
+	reservationsGauge.WithLabelValues(tenant.Label()).Inc()
+	reservationCounter.WithLabelValues("reserved", tenant.Label()).Inc()
+	webhooks.Emit(EventSlotReserved, item, func(e *WebhookEvent) {
+		expires := item.Deadline()
+		e.Expires = &expires
+	})
 	return item, nil
 }
 
-func (r *Slots) Setup(slotKey string) (*SlotItem, error) {
+// Release frees the slot of the tenant reserved with the release token, as long
+// as no peer joined it. The key of a numeric slot is remembered as expired, so
+// that late comers get CloseNoSuchSlot.
+func (r *Slots) Release(tenant *Tenant, slotKey, token string) error {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
-	item, exists := r.m[slotKey]
+	item, ok := r.m[slotMapKey(tenant, slotKey)]
+	if !ok {
+		return ErrNoSuchSlot
+	}
+	if item.ReleaseToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(item.ReleaseToken)) != 1 {
+		return ErrBadReleaseToken
+	}
+	if item.Mode != wormhole.ModeNone {
+		return ErrSlotInUse
+	}
+
+	reservationCounter.WithLabelValues("released", item.Tenant.Label()).Inc()
+	item.SetOutcome("released")
+	r.remove(item)
+	item.expire()
+	item.Event("released", "")
+	r.markExpired(slotKey, time.Now())
+	return nil
+}
+
+// SlotJoin is the state of a slot when a peer joined it, read under the Slots
+// lock: the slot changes as soon as the other peer joins.
+type SlotJoin struct {
+	Mode wormhole.SlotItemMode
+	// Joined is when the first peer joined the slot.
+	Joined time.Time
+}
+
+// Setup joins the slot slotKey, allocating a new one if it doesn't exist.
+func (r *Slots) Setup(tenant *Tenant, slotKey string) (*SlotItem, SlotJoin, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	item, exists := r.m[slotMapKey(tenant, slotKey)]
 	if !exists {
+		if _, expired := r.expired[slotKey]; expired {
+			rendezvousCounter.WithLabelValues("expired", tenant.Label()).Inc()
+			rejectionCounter.WithLabelValues("expired").Inc()
+			return nil, SlotJoin{}, NewSlotError(slotKey, wormhole.CloseNoSuchSlot, "slot expired", ErrSlotExpired)
+		}
+
+		if r.Draining() {
+			rejectionCounter.WithLabelValues("draining").Inc()
+			return nil, SlotJoin{}, NewSlotError(slotKey, wormhole.CloseNoMoreSlots, "server draining", ErrDraining)
+		}
+		if r.overQuota(tenant) {
+			rendezvousCounter.WithLabelValues("quotaexceeded", tenant.Label()).Inc()
+			rejectionCounter.WithLabelValues("quotaexceeded").Inc()
+			return nil, SlotJoin{}, NewSlotError(slotKey, wormhole.CloseNoMoreSlots, "slot quota exceeded", ErrSlotQuotaExceeded)
+		}
+
 		if slotKey == "" {
 			if slotKey, _ = r.free(); slotKey == "" {
-				rendezvousCounter.WithLabelValues("nomoreslots").Inc()
-				return nil, fmt.Errorf("no more slots available")
+				rendezvousCounter.WithLabelValues("nomoreslots", tenant.Label()).Inc()
+				rejectionCounter.WithLabelValues("nomoreslots").Inc()
+				return nil, SlotJoin{}, NewSlotError(slotKey, wormhole.CloseNoMoreSlots, "no more slots", ErrNoMoreSlots)
 			}
 		}
 
-		item = &SlotItem{
-			SlotKey: slotKey,
-			C:       make(chan *websocket.Conn),
-			Mode:    wormhole.ModePeer1,
-		}
+		item = newSlotItem(slotKey, wormhole.ModePeer1, tenant, now)
+		item.Joined = now
+		item.TTL = tenant.CapTTL(r.TTLs.Waiting)
+		item.active++
 
-		r.m[slotKey] = item
-		slotsGuage.Set(float64(len(r.m)))
-		rendezvousCounter.WithLabelValues("nosuchslot").Inc()
-		return item, nil
+		r.add(item)
+		rendezvousCounter.WithLabelValues("nosuchslot", tenant.Label()).Inc()
+		emitJoined(item)
+		return item, SlotJoin{Mode: item.Mode, Joined: item.Joined}, nil
 	}
 
+	item.active++
 	if item.Mode == wormhole.ModeNone {
 		item.Mode = wormhole.ModePeer1
-		return item, nil
+		item.Joined = now
+		item.TTL = item.Tenant.CapTTL(r.TTLs.Waiting)
+		reservationsGauge.WithLabelValues(item.Tenant.Label()).Dec()
+		reservationCounter.WithLabelValues("joined", item.Tenant.Label()).Inc()
+		emitJoined(item)
+		return item, SlotJoin{Mode: item.Mode, Joined: item.Joined}, nil
 	} else if item.Mode == wormhole.ModePeer1 {
 		item.Mode = wormhole.ModePeer2
-		delete(r.m, slotKey)
-		slotsGuage.Set(float64(len(r.m)))
+		item.Paired = now
+		rendezvousHistogram.WithLabelValues(item.Tenant.Label()).Observe(now.Sub(item.Joined).Seconds())
+		r.remove(item)
+		emitJoined(item)
 	}
 
-	return item, nil
+	return item, SlotJoin{Mode: item.Mode, Joined: item.Joined}, nil
 }
 
-// free tries to find an available numeric slot, favouring smaller numbers.
-// This assumes slots is locked.
-func (r *Slots) free() (slot string, ok bool) {
-	// Assuming varint encoding, we first t for one byte. That's 7 bits in varint.
-	tries := []struct {
-		tryTimes int
-		bits     int
-	}{
-		{64, 7},    // try for one byte. That's 7 bits in varint.
-		{1024, 11}, // try for two bytes. 11 bits.
-		{2048, 16}, // try for three bytes. 16 bits.
-		{2048, 21}, // try for four bytes. 21 bits.
-	}
-	for _, t := range tries {
-		for i := 0; i < t.tryTimes; i++ {
-			s := strconv.Itoa(util.RandIntn(1 << t.bits))
-			if _, ok := r.m[s]; !ok {
-				return s, true
+func emitJoined(item *SlotItem) {
+	webhooks.Emit(EventPeerJoined, item, func(e *WebhookEvent) { e.Mode = modeName(item.Mode) })
+}
+
+// Reap removes the slots which outlived the TTL of their current state and
+// forgets the expired keys older than TTLs.Expired.
+func (r *Slots) Reap(now time.Time) (reaped int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for key, item := range r.m {
+		if item.TTL <= 0 || now.Before(item.Deadline()) {
+			continue
+		}
+
+		result := util.If(item.Mode == wormhole.ModeNone, "reservationexpired", "timeout")
+		if item.Mode == wormhole.ModeNone {
+			reservationCounter.WithLabelValues("expired", item.Tenant.Label()).Inc()
+		}
+		item.SetOutcome(result)
+		r.remove(item)
+		item.expire()
+		item.Event("expired", "in "+item.Mode.String())
+		r.markExpired(key, now)
+		reaped++
+		rendezvousCounter.WithLabelValues(result, item.Tenant.Label()).Inc()
+		webhooks.Emit(EventSlotExpired, item, func(e *WebhookEvent) { e.Mode = modeName(item.Mode) })
+	}
+
+	for key, t := range r.expired {
+		if now.Sub(t) >= r.TTLs.Expired {
+			delete(r.expired, key)
+			if n, ok := slotNumber(key); ok {
+				r.alloc.Put(n)
+			}
+		}
+	}
+
+	return reaped
+}
+
+// RunReaper reaps the slots every interval until ctx is done.
+func (r *Slots) RunReaper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n := r.Reap(now); n > 0 {
+				log.Printf("reaped %d expired slots", n)
 			}
 		}
 	}
+}
+
+// markExpired remembers the key of a numeric slot as expired, which keeps it in use.
+// This assumes slots is locked.
+func (r *Slots) markExpired(key string, now time.Time) {
+	if n, ok := slotNumber(key); ok {
+		r.expired[key] = now
+		r.alloc.Take(n)
+	}
+}
 
-	// Give up.
-	return "", false
+// add registers the slot item and counts it for its tenant.
+// This assumes slots is locked.
+func (r *Slots) add(item *SlotItem) {
+	if n, ok := slotNumber(item.SlotKey); ok {
+		r.alloc.Take(n)
+	}
+	r.m[item.key] = item
+	r.sessions[item.ID] = item
+	r.countTenant(item.Tenant, 1)
+}
+
+// remove unregisters the slot item and uncounts it for its tenant.
+// This assumes slots is locked.
+func (r *Slots) remove(item *SlotItem) {
+	delete(r.m, item.key)
+	if n, ok := slotNumber(item.SlotKey); ok {
+		r.alloc.Put(n)
+	}
+	r.countTenant(item.Tenant, -1)
+	if item.Mode == wormhole.ModeNone {
+		reservationsGauge.WithLabelValues(item.Tenant.Label()).Dec()
+	}
+	r.forget(item)
+}
+
+// forget removes the session of the slot item once it is unregistered and all peers left,
+// and writes its audit record.
+// This assumes slots is locked.
+func (r *Slots) forget(item *SlotItem) {
+	if _, ok := r.sessions[item.ID]; !ok || item.active > 0 || r.m[item.key] == item {
+		return
+	}
+
+	delete(r.sessions, item.ID)
+	if !item.Joined.IsZero() {
+		slotMessagesHistogram.Observe(float64(item.Messages.Load()))
+		slotBytesHistogram.Observe(float64(item.Bytes.Load()))
+	}
+	audit.Record(item)
+}
+
+// countTenant updates the busy slots of the tenant, and exports it.
+// This assumes slots is locked.
+func (r *Slots) countTenant(tenant *Tenant, delta int) {
+	label := tenant.Label()
+	n := r.tenants[label] + delta
+	if n <= 0 {
+		delete(r.tenants, label)
+	} else {
+		r.tenants[label] = n
+	}
+	slotsGuage.WithLabelValues(label).Set(float64(n))
+}
+
+// overQuota tells whether the tenant has used up its slot quota.
+// This assumes slots is locked.
+func (r *Slots) overQuota(tenant *Tenant) bool {
+	return tenant != nil && tenant.SlotQuota > 0 && r.tenants[tenant.Label()] >= tenant.SlotQuota
+}
+
+// free finds an available numeric slot, favouring the shortest codes.
+// This assumes slots is locked.
+func (r *Slots) free() (slot string, ok bool) {
+	n, ok := r.alloc.Free()
+	if !ok {
+		return "", false
+	}
+	return strconv.Itoa(n), true
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bingoohuang/gowormhole/internal/util"
+	"github.com/bingoohuang/gowormhole/wormhole"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlotsReserveExpire(t *testing.T) {
+	s := NewSlots(SlotTTLs{Reserved: time.Minute, Waiting: time.Hour, Expired: time.Hour})
+
+	item, err := s.Reserve(nil, "", 2*time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, wormhole.ModeNone, item.Mode)
+	assert.Equal(t, time.Minute, item.TTL) // capped by the server
+
+	now := time.Now()
+	assert.Equal(t, 0, s.Reap(now))
+	assert.Equal(t, 1, s.Reap(now.Add(2*time.Minute)))
+
+	select {
+	case <-item.Expired():
+	default:
+		t.Fatal("reaped slot should be closed")
+	}
+
+	_, _, err = s.Setup(nil, item.SlotKey)
+	var se *slotError
+	assert.True(t, errors.As(err, &se))
+	assert.Equal(t, wormhole.CloseNoSuchSlot, int(se.CloseCode))
+
+	// The expired key is forgotten after TTLs.Expired, and may be used as a new slot.
+	s.Reap(now.Add(2 * time.Hour))
+	item2, _, err := s.Setup(nil, item.SlotKey)
+	assert.Nil(t, err)
+	assert.Equal(t, wormhole.ModePeer1, item2.Mode)
+}
+
+func TestSlotsSetupJoin(t *testing.T) {
+	s := NewSlots(SlotTTLs{Reserved: time.Minute, Waiting: time.Hour, Expired: time.Hour})
+
+	item, err := s.Reserve(nil, "", 0)
+	assert.Nil(t, err)
+
+	peer1, join1, err := s.Setup(nil, item.SlotKey)
+	assert.Nil(t, err)
+	assert.Equal(t, wormhole.ModePeer1, peer1.Mode)
+	assert.False(t, peer1.Joined.IsZero())
+	assert.Equal(t, time.Hour, peer1.TTL)
+
+	peer2, join2, err := s.Setup(nil, item.SlotKey)
+	assert.Nil(t, err)
+	assert.Equal(t, wormhole.ModePeer2, peer2.Mode)
+	assert.Empty(t, s.m)
+	// Each peer keeps the mode it joined in, though the slot changed.
+	assert.Equal(t, SlotJoin{Mode: wormhole.ModePeer1, Joined: peer1.Joined}, join1)
+	assert.Equal(t, SlotJoin{Mode: wormhole.ModePeer2, Joined: peer1.Joined}, join2)
+
+	// The session lives until both peers leave.
+	assert.Len(t, s.Sessions(), 1)
+	s.Leave(peer1)
+	assert.Len(t, s.Sessions(), 1)
+	s.Leave(peer2)
+	assert.Empty(t, s.Sessions())
+}
+
+func TestSlotsTenantQuota(t *testing.T) {
+	s := NewSlots(SlotTTLs{Reserved: time.Hour, Waiting: time.Hour, Expired: time.Hour})
+	tenant := &Tenant{Name: "team-a", SlotQuota: 1, MaxSlotTTL: util.Duration(time.Minute)}
+
+	item, err := s.Reserve(tenant, "", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute, item.TTL)
+
+	_, err = s.Reserve(tenant, "", 0)
+	assert.Equal(t, ErrSlotQuotaExceeded, err)
+
+	_, _, err = s.Setup(tenant, "")
+	assert.True(t, errors.Is(err, ErrSlotQuotaExceeded))
+
+	// Other tenants are not affected.
+	_, err = s.Reserve(nil, "", 0)
+	assert.Nil(t, err)
+}
+
+func TestSlotsReservationMetrics(t *testing.T) {
+	s := NewSlots(SlotTTLs{Reserved: time.Minute, Waiting: time.Hour, Expired: time.Hour})
+	tenant := &Tenant{Name: "metrics"}
+	outstanding := reservationsGauge.WithLabelValues(tenant.Label())
+
+	joined, err := s.Reserve(tenant, "", 0)
+	assert.Nil(t, err)
+	_, err = s.Reserve(tenant, "", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2.0, testutil.ToFloat64(outstanding))
+
+	_, _, err = s.Setup(tenant, joined.SlotKey)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(outstanding))
+
+	s.Reap(time.Now().Add(2 * time.Minute))
+	assert.Equal(t, 0.0, testutil.ToFloat64(outstanding))
+	assert.Equal(t, 1.0, testutil.ToFloat64(reservationCounter.WithLabelValues("expired", tenant.Label())))
+}
+
+func TestSlotsNamed(t *testing.T) {
+	s := NewSlots(SlotTTLs{Reserved: time.Minute, Waiting: time.Hour, Expired: time.Hour})
+	teamA, teamB := &Tenant{Name: "team-a"}, &Tenant{Name: "team-b"}
+
+	_, err := s.Reserve(teamA, "Build_Farm", 0)
+	assert.True(t, errors.Is(err, ErrBadSlotName))
+
+	a, err := s.Reserve(teamA, "build-farm", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "build-farm", a.SlotKey)
+	_, err = s.Reserve(teamA, "build-farm", 0)
+	assert.True(t, errors.Is(err, ErrSlotInUse))
+
+	// The names are scoped by tenant.
+	b, err := s.Reserve(teamB, "build-farm", 0)
+	assert.Nil(t, err)
+	assert.NotEqual(t, a.ID, b.ID)
+	assert.False(t, s.Has(nil, "build-farm"))
+
+	joined, _, err := s.Setup(teamB, "build-farm")
+	assert.Nil(t, err)
+	assert.Equal(t, b.ID, joined.ID)
+	assert.True(t, errors.Is(s.Release(teamB, "build-farm", b.ReleaseToken), ErrSlotInUse))
+
+	// A named slot is not remembered once released or reaped, so that the room is reusable at once.
+	assert.Nil(t, s.Release(teamA, "build-farm", a.ReleaseToken))
+	_, err = s.Reserve(teamA, "build-farm", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, s.Reap(time.Now().Add(2*time.Hour)))
+	_, _, err = s.Setup(teamA, "build-farm")
+	assert.Nil(t, err)
+}
+
+func TestValidSlotKey(t *testing.T) {
+	for key, valid := range map[string]bool{
+		"": true, "42": true, "build-farm": true,
+		"-1": false, "build farm": false, "Build": false, "a/b": false, "x": false,
+	} {
+		assert.Equal(t, valid, validSlotKey(key), key)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+
+	"github.com/bingoohuang/gowormhole/internal/util"
+)
+
+const (
+	// defaultMaxSlots is the default number of numeric slots.
+	defaultMaxSlots = 1 << 21
+	// maxSlotLength is the longest varint of a slot, in bytes.
+	maxSlotLength = 4
+)
+
+// SlotAllocator allocates the numeric slots, preferring the shortest codes.
+//
+// The slots are split by the length of their varint, which is the number of
+// words of the slot in the codes: 0 to 127 take one word, 128 to 16383 two, and
+// so on. Each length has a bitmap of the slots in use, so that a free slot is
+// always found in the shortest length which has one, and the slots run out
+// exactly when all the bitmaps are full.
+//
+// SlotAllocator is not safe for concurrent use, it is guarded by the Slots lock.
+type SlotAllocator struct {
+	classes []*slotClass
+}
+
+// slotClass is the bitmap of the slots of a varint length.
+type slotClass struct {
+	length int
+	// lo and hi bound the slots of the class, [lo, hi).
+	lo, hi int
+	used   int
+	bits   []uint64
+	label  string
+}
+
+// NewSlotAllocator creates an allocator of maxSlots numeric slots, starting
+// with the first slot of minLength words.
+func NewSlotAllocator(minLength, maxSlots int) (*SlotAllocator, error) {
+	if minLength < 1 || minLength > maxSlotLength {
+		return nil, fmt.Errorf("min code length should be from 1 to %d", maxSlotLength)
+	}
+	lo, limit := varintStart(minLength), varintStart(maxSlotLength+1)
+	if maxSlots <= 0 || maxSlots > limit-lo {
+		return nil, fmt.Errorf("max slots should be from 1 to %d", limit-lo)
+	}
+
+	a := &SlotAllocator{}
+	for length, end := minLength, lo+maxSlots; lo < end; length++ {
+		hi := varintStart(length + 1)
+		if hi > end {
+			hi = end
+		}
+		c := &slotClass{length: length, lo: lo, hi: hi, label: strconv.Itoa(length)}
+		c.bits = make([]uint64, (hi-lo+63)/64)
+		// The bits past hi are in use, so that they are never free.
+		if tail := (hi - lo) % 64; tail != 0 {
+			c.bits[len(c.bits)-1] = math.MaxUint64 << tail
+		}
+		a.classes = append(a.classes, c)
+		lo = hi
+	}
+	return a, nil
+}
+
+// varintStart returns the first slot whose varint takes length bytes.
+func varintStart(length int) int {
+	if length <= 1 {
+		return 0
+	}
+	return 1 << (7 * (length - 1))
+}
+
+// Free returns a free slot of the shortest length which has one, at random in
+// the length. It returns false if all the slots are in use.
+func (a *SlotAllocator) Free() (int, bool) {
+	for _, c := range a.classes {
+		if slot, ok := c.free(); ok {
+			return slot, true
+		}
+	}
+	return 0, false
+}
+
+func (c *slotClass) free() (int, bool) {
+	if c.used >= c.hi-c.lo {
+		return 0, false
+	}
+	n, r := len(c.bits), util.RandIntn(64)
+	start := util.RandIntn(n)
+	for i := 0; i < n; i++ {
+		w := (start + i) % n
+		if c.bits[w] == math.MaxUint64 {
+			continue
+		}
+		// Start from a random bit of the word, too.
+		b := (bits.TrailingZeros64(bits.RotateLeft64(^c.bits[w], -r)) + r) % 64
+		return c.lo + w*64 + b, true
+	}
+	return 0, false
+}
+
+// Take marks the slot in use, it does nothing if the slot is out of the range
+// of the allocator or already in use.
+func (a *SlotAllocator) Take(slot int) { a.set(slot, true) }
+
+// Put marks the slot free, it does nothing if the slot is out of the range of
+// the allocator or already free.
+func (a *SlotAllocator) Put(slot int) { a.set(slot, false) }
+
+func (a *SlotAllocator) set(slot int, used bool) {
+	for _, c := range a.classes {
+		if slot < c.lo || slot >= c.hi {
+			continue
+		}
+		i, mask := (slot-c.lo)/64, uint64(1)<<((slot-c.lo)%64)
+		if (c.bits[i]&mask != 0) == used {
+			return
+		}
+		c.bits[i] ^= mask
+		c.used += util.If(used, 1, -1)
+		c.export()
+		return
+	}
+}
+
+// Occupancy returns the number of slots in use and the number of slots.
+func (a *SlotAllocator) Occupancy() (used, capacity int) {
+	for _, c := range a.classes {
+		used += c.used
+		capacity += c.hi - c.lo
+	}
+	return used, capacity
+}
+
+// export exports the occupancy and the capacity of the allocator.
+func (a *SlotAllocator) export() {
+	slotOccupancyGauge.Reset()
+	slotCapacityGauge.Reset()
+	for _, c := range a.classes {
+		c.export()
+		slotCapacityGauge.WithLabelValues(c.label).Set(float64(c.hi - c.lo))
+	}
+}
+
+func (c *slotClass) export() {
+	slotOccupancyGauge.WithLabelValues(c.label).Set(float64(c.used) / float64(c.hi-c.lo))
+}
+
+// slotNumber returns the number of a numeric slot key.
+func slotNumber(slotKey string) (int, bool) {
+	if !isNumericSlot(slotKey) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(slotKey)
+	return n, err == nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlotAllocatorShortestFirst(t *testing.T) {
+	a, err := NewSlotAllocator(1, 200)
+	assert.Nil(t, err)
+
+	seen := make(map[int]bool)
+	for i := 0; i < 200; i++ {
+		n, ok := a.Free()
+		assert.True(t, ok)
+		assert.False(t, seen[n])
+		// The 128 slots of one word come first.
+		if i < 128 {
+			assert.Less(t, n, 128)
+		} else {
+			assert.GreaterOrEqual(t, n, 128)
+			assert.Less(t, n, 200)
+		}
+		seen[n] = true
+		a.Take(n)
+	}
+	_, ok := a.Free()
+	assert.False(t, ok)
+	used, capacity := a.Occupancy()
+	assert.Equal(t, 200, used)
+	assert.Equal(t, 200, capacity)
+
+	a.Put(150)
+	n, ok := a.Free()
+	assert.True(t, ok)
+	assert.Equal(t, 150, n)
+	a.Take(150)
+	a.Take(150) // already in use
+	a.Take(5000)
+	used, _ = a.Occupancy()
+	assert.Equal(t, 200, used)
+}
+
+func TestSlotAllocatorMinLength(t *testing.T) {
+	a, err := NewSlotAllocator(2, 10)
+	assert.Nil(t, err)
+	n, ok := a.Free()
+	assert.True(t, ok)
+	assert.True(t, n >= 128 && n < 138, n)
+
+	_, err = NewSlotAllocator(0, 10)
+	assert.NotNil(t, err)
+	_, err = NewSlotAllocator(4, 1<<28)
+	assert.NotNil(t, err)
+}
+
+func TestSlotsCapacityConcurrent(t *testing.T) {
+	s := NewSlots(SlotTTLs{Reserved: time.Minute, Waiting: time.Hour, Expired: time.Hour})
+	assert.Nil(t, s.SetCapacity(1, 300))
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	keys := make(map[string]bool)
+	exhausted := 0
+	for i := 0; i < 400; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var item *SlotItem
+			var err error
+			if i%2 == 0 {
+				item, err = s.Reserve(nil, "", 0)
+			} else {
+				item, _, err = s.Setup(nil, "")
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			if errors.Is(err, ErrNoMoreSlots) {
+				exhausted++
+				return
+			}
+			assert.Nil(t, err)
+			assert.False(t, keys[item.SlotKey], item.SlotKey)
+			keys[item.SlotKey] = true
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 300, len(keys))
+	assert.Equal(t, 100, exhausted)
+	assert.Equal(t, 1.0, s.Occupancy())
+
+	// The expired slots stay in use until forgotten, even after a new capacity.
+	s.Reap(time.Now().Add(2 * time.Hour))
+	assert.Equal(t, 1.0, s.Occupancy())
+	assert.Nil(t, s.SetCapacity(1, 600))
+	assert.Equal(t, 0.5, s.Occupancy())
+	s.Reap(time.Now().Add(4 * time.Hour))
+	assert.Equal(t, 0.0, s.Occupancy())
+
+	// A slot dialled by its number is taken too.
+	_, _, err := s.Setup(nil, strconv.Itoa(42))
+	assert.Nil(t, err)
+	_, err = s.Reserve(nil, "", 0)
+	assert.Nil(t, err)
+	used, _ := s.alloc.Occupancy()
+	assert.Equal(t, 2, used)
+}
@@ -0,0 +1,617 @@
+package main
+
+// Quotas and accounting of the TURN server. pion/turn has no hooks on the
+// allocations, so the accounting watches the STUN messages going through the
+// listeners, and wraps the relay sockets made by the RelayAddressGenerator.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2"
+)
+
+const (
+	// defaultTurnQuotaPeriod is the default period of the TurnLimits.Bytes quotas.
+	defaultTurnQuotaPeriod = 24 * time.Hour
+	// turnPendingTimeout is how long an Allocate request waits for its response
+	// before its allocation is released.
+	turnPendingTimeout = 30 * time.Second
+	// minTurnBurst lets a full datagram through a bandwidth limit, however low.
+	minTurnBurst = 64 << 10
+)
+
+// TurnLimits limits the use of the TURN server by a user or a tenant.
+// A zero value means unlimited.
+type TurnLimits struct {
+	// Allocations limits the concurrent allocations.
+	Allocations int
+	// Bandwidth limits the relayed bytes per second.
+	Bandwidth int64
+	// Bytes limits the relayed bytes per quota period.
+	Bytes int64
+}
+
+// String formats the limits as allocations=n,bandwidth=n,bytes=n.
+func (l *TurnLimits) String() string {
+	var parts []string
+	if l.Allocations > 0 {
+		parts = append(parts, "allocations="+strconv.Itoa(l.Allocations))
+	}
+	if l.Bandwidth > 0 {
+		parts = append(parts, "bandwidth="+strconv.FormatInt(l.Bandwidth, 10))
+	}
+	if l.Bytes > 0 {
+		parts = append(parts, "bytes="+strconv.FormatInt(l.Bytes, 10))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set parses the limits from allocations=n,bandwidth=n,bytes=n, implementing flag.Value.
+// The limits not given are reset to unlimited.
+func (l *TurnLimits) Set(s string) (err error) {
+	*l = TurnLimits{}
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(kv, "=")
+		switch k {
+		case "allocations":
+			l.Allocations, err = strconv.Atoi(v)
+		case "bandwidth":
+			l.Bandwidth, err = strconv.ParseInt(v, 10, 64)
+		case "bytes":
+			l.Bytes, err = strconv.ParseInt(v, 10, 64)
+		default:
+			err = fmt.Errorf("unknown limit %q", k)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bandwidthLimiter returns the limiter of the bandwidth, nil if unlimited.
+func (l TurnLimits) bandwidthLimiter() *RateLimiter {
+	burst := l.Bandwidth
+	if burst < minTurnBurst {
+		burst = minTurnBurst
+	}
+	return NewRateLimiter(Rate{PerSecond: float64(l.Bandwidth), Burst: int(burst)})
+}
+
+// turnIdentity is the user of an allocation and its tenant.
+type turnIdentity struct {
+	user, tenant string
+}
+
+// turnIdentityOf returns the identity of a TURN username. The ephemeral
+// usernames of turnCredentials are expiry:tenant, the other users belong to
+// the default tenant.
+func turnIdentityOf(username string) turnIdentity {
+	if _, tenant, ok := strings.Cut(username, ":"); ok && tenant != "" {
+		return turnIdentity{user: username, tenant: tenant}
+	}
+	return turnIdentity{user: username, tenant: defaultTenant}
+}
+
+type turnPending struct {
+	id    turnIdentity
+	since time.Time
+}
+
+// turnVolume is the relayed bytes of a user or a tenant in the current period.
+type turnVolume struct {
+	start time.Time
+	bytes int64
+}
+
+// TurnAccounting applies the quotas of the users and the tenants to a TURN
+// server, and exports the allocations, the relayed bytes and the requests.
+type TurnAccounting struct {
+	User, Tenant TurnLimits
+	// Period is the period of the Bytes quotas.
+	Period time.Duration
+	// MaxLifetime caps the lifetime of the allocations, however refreshed, zero for unlimited.
+	MaxLifetime time.Duration
+
+	// key returns the key of a user, to sign the rejections.
+	key                      turn.AuthHandler
+	userAllocs, tenantAllocs *ConnLimiter
+	userRate, tenantRate     *RateLimiter
+
+	// volumes holds the turnVolume by user: or tenant: key.
+	volumes map[string]*turnVolume
+	swept   time.Time
+	// pending holds the identity of the Allocate requests waiting for their response.
+	pending map[[stun.TransactionIDSize]byte]*turnPending
+	// relays holds the relay sockets by relayed address until their allocation succeeds.
+	relays map[string]*turnRelay
+	// clients holds the relay sockets of the allocations by client address.
+	clients map[string]*turnRelay
+	lock    sync.Mutex
+}
+
+// NewTurnAccounting creates the accounting of the TURN server, key returns the
+// key of the users.
+func NewTurnAccounting(user, tenant TurnLimits, period, maxLifetime time.Duration, key turn.AuthHandler) *TurnAccounting {
+	if period <= 0 {
+		period = defaultTurnQuotaPeriod
+	}
+	return &TurnAccounting{
+		User:         user,
+		Tenant:       tenant,
+		Period:       period,
+		MaxLifetime:  maxLifetime,
+		key:          key,
+		userAllocs:   NewConnLimiter(user.Allocations),
+		tenantAllocs: NewConnLimiter(tenant.Allocations),
+		userRate:     user.bandwidthLimiter(),
+		tenantRate:   tenant.bandwidthLimiter(),
+		volumes:      make(map[string]*turnVolume),
+		pending:      make(map[[stun.TransactionIDSize]byte]*turnPending),
+		relays:       make(map[string]*turnRelay),
+		clients:      make(map[string]*turnRelay),
+	}
+}
+
+// inbound inspects a packet from a client, replying itself to the requests
+// over quota. It reports whether the packet should go on to the server.
+func (a *TurnAccounting) inbound(p []byte, from net.Addr, reply func([]byte)) bool {
+	if !stun.IsMessage(p) {
+		return true
+	}
+	m := &stun.Message{Raw: p}
+	if err := m.Decode(); err != nil || m.Type.Class != stun.ClassRequest {
+		return true
+	}
+
+	switch m.Type.Method {
+	case stun.MethodAllocate:
+		var username stun.Username
+		if username.GetFrom(m) != nil {
+			// The first attempt, challenged by the server.
+			return true
+		}
+		if scope, limit := a.admit(m.TransactionID, turnIdentityOf(username.String())); limit != "" {
+			turnQuotaCounter.WithLabelValues(scope, limit).Inc()
+			a.reject(m, from, stun.CodeAllocQuotaReached, scope+" "+limit+" quota reached", reply)
+			return false
+		}
+	case stun.MethodRefresh:
+		a.lock.Lock()
+		r := a.clients[from.String()]
+		a.lock.Unlock()
+		if r != nil && r.expired.Load() {
+			a.reject(m, from, stun.CodeAllocMismatch, "allocation lifetime exceeded", reply)
+			return false
+		}
+	}
+	return true
+}
+
+// admit takes an allocation of the identity for the Allocate request txID,
+// or returns the scope and the limit over quota.
+func (a *TurnAccounting) admit(txID [stun.TransactionIDSize]byte, id turnIdentity) (scope, limit string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := time.Now()
+	a.sweep(now)
+	if _, ok := a.pending[txID]; ok {
+		// A retransmission.
+		return "", ""
+	}
+
+	switch {
+	case a.exhausted("user:"+id.user, a.User.Bytes, now):
+		return "user", "bytes"
+	case a.exhausted("tenant:"+id.tenant, a.Tenant.Bytes, now):
+		return "tenant", "bytes"
+	case !a.userAllocs.Acquire(id.user):
+		return "user", "allocations"
+	case !a.tenantAllocs.Acquire(id.tenant):
+		a.userAllocs.Release(id.user)
+		return "tenant", "allocations"
+	}
+	a.pending[txID] = &turnPending{id: id, since: now}
+	return "", ""
+}
+
+// reject answers the request by an error, signed by the key of its user if known.
+func (a *TurnAccounting) reject(req *stun.Message, from net.Addr, code stun.ErrorCode, reason string, reply func([]byte)) {
+	setters := []stun.Setter{
+		stun.NewTransactionIDSetter(req.TransactionID),
+		stun.NewType(req.Type.Method, stun.ClassErrorResponse),
+		&stun.ErrorCodeAttribute{Code: code, Reason: []byte(reason)},
+	}
+	var username stun.Username
+	var realm stun.Realm
+	if a.key != nil && username.GetFrom(req) == nil && realm.GetFrom(req) == nil {
+		if key, ok := a.key(username.String(), realm.String(), from); ok {
+			setters = append(setters, stun.MessageIntegrity(key))
+		}
+	}
+	res, err := stun.Build(setters...)
+	if err != nil {
+		return
+	}
+	turnRequestCounter.WithLabelValues(turnMethodName(req.Type.Method), strconv.Itoa(int(code))).Inc()
+	reply(res.Raw)
+}
+
+// outbound inspects a packet from the server to a client.
+func (a *TurnAccounting) outbound(p []byte, to net.Addr) {
+	if !stun.IsMessage(p) {
+		return
+	}
+	m := &stun.Message{Raw: p}
+	if err := m.Decode(); err != nil {
+		return
+	}
+
+	result := "success"
+	switch m.Type.Class {
+	case stun.ClassSuccessResponse:
+	case stun.ClassErrorResponse:
+		var code stun.ErrorCodeAttribute
+		_ = code.GetFrom(m)
+		result = strconv.Itoa(int(code.Code))
+	default:
+		return
+	}
+	turnRequestCounter.WithLabelValues(turnMethodName(m.Type.Method), result).Inc()
+	if m.Type.Method == stun.MethodAllocate {
+		a.allocated(m, to, m.Type.Class == stun.ClassSuccessResponse)
+	}
+}
+
+// allocated binds the relay socket of a successful allocation to its user and
+// client, or releases the allocation taken by admit if it failed.
+func (a *TurnAccounting) allocated(res *stun.Message, to net.Addr, ok bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	p := a.pending[res.TransactionID]
+	if p == nil {
+		return
+	}
+	delete(a.pending, res.TransactionID)
+
+	var relayed stun.XORMappedAddress
+	var r *turnRelay
+	if ok && relayed.GetFromAs(res, stun.AttrXORRelayedAddress) == nil {
+		r = a.relays[relayKey(relayed.IP, relayed.Port)]
+	}
+	if r == nil {
+		a.userAllocs.Release(p.id.user)
+		a.tenantAllocs.Release(p.id.tenant)
+		return
+	}
+
+	delete(a.relays, r.key)
+	id := p.id
+	r.id.Store(&id)
+	r.client = to.String()
+	a.clients[r.client] = r
+	turnAllocationsGauge.WithLabelValues(id.tenant).Inc()
+	if a.MaxLifetime > 0 {
+		r.timer = time.AfterFunc(a.MaxLifetime, func() { a.expire(r) })
+	}
+}
+
+// release releases the allocation of the relay socket, once.
+func (a *TurnAccounting) release(r *turnRelay) {
+	r.releaseOnce.Do(func() {
+		id := r.id.Load()
+		if id == nil {
+			return
+		}
+		a.userAllocs.Release(id.user)
+		a.tenantAllocs.Release(id.tenant)
+		turnAllocationsGauge.WithLabelValues(id.tenant).Dec()
+	})
+}
+
+// expire ends the allocation of the relay socket which outlived MaxLifetime.
+// The server keeps the allocation until it times out, but it relays nothing
+// and its refreshes are rejected.
+func (a *TurnAccounting) expire(r *turnRelay) {
+	r.expired.Store(true)
+	turnQuotaCounter.WithLabelValues("server", "lifetime").Inc()
+	a.release(r)
+	_ = r.PacketConn.Close()
+}
+
+// relay accounts n bytes relayed by the relay socket, and reports whether
+// the quotas allow them.
+func (a *TurnAccounting) relay(r *turnRelay, n int, direction string) bool {
+	id := r.id.Load()
+	if id == nil {
+		return true
+	}
+
+	switch {
+	case !a.userRate.AllowN(id.user, n):
+		turnQuotaCounter.WithLabelValues("user", "bandwidth").Inc()
+		return false
+	case !a.tenantRate.AllowN(id.tenant, n):
+		turnQuotaCounter.WithLabelValues("tenant", "bandwidth").Inc()
+		return false
+	}
+
+	a.lock.Lock()
+	now := time.Now()
+	scope := ""
+	if !a.count("user:"+id.user, a.User.Bytes, n, now) {
+		scope = "user"
+	} else if !a.count("tenant:"+id.tenant, a.Tenant.Bytes, n, now) {
+		scope = "tenant"
+	}
+	a.lock.Unlock()
+	if scope != "" {
+		turnQuotaCounter.WithLabelValues(scope, "bytes").Inc()
+		return false
+	}
+
+	turnRelayedBytesCounter.WithLabelValues(direction, id.tenant).Add(float64(n))
+	return true
+}
+
+// count adds n bytes to the volume of key, unless it would exceed limit.
+// This assumes the accounting is locked.
+func (a *TurnAccounting) count(key string, limit int64, n int, now time.Time) bool {
+	if limit <= 0 {
+		return true
+	}
+	v := a.volumes[key]
+	if v == nil || now.Sub(v.start) >= a.Period {
+		v = &turnVolume{start: now}
+		a.volumes[key] = v
+	}
+	if v.bytes+int64(n) > limit {
+		return false
+	}
+	v.bytes += int64(n)
+	return true
+}
+
+// exhausted tells whether the volume of key reached limit in the current period.
+// This assumes the accounting is locked.
+func (a *TurnAccounting) exhausted(key string, limit int64, now time.Time) bool {
+	v := a.volumes[key]
+	return limit > 0 && v != nil && now.Sub(v.start) < a.Period && v.bytes >= limit
+}
+
+// sweep forgets the volumes of the past periods and the Allocate requests
+// never answered, at most once a minute.
+// This assumes the accounting is locked.
+func (a *TurnAccounting) sweep(now time.Time) {
+	if now.Sub(a.swept) < time.Minute {
+		return
+	}
+
+	a.swept = now
+	for key, v := range a.volumes {
+		if now.Sub(v.start) >= a.Period {
+			delete(a.volumes, key)
+		}
+	}
+	for txID, p := range a.pending {
+		if now.Sub(p.since) >= turnPendingTimeout {
+			delete(a.pending, txID)
+			a.userAllocs.Release(p.id.user)
+			a.tenantAllocs.Release(p.id.tenant)
+		}
+	}
+}
+
+func turnMethodName(m stun.Method) string { return strings.ToLower(m.String()) }
+
+// turnPacketConn is a UDP listener of the TURN server watched by the accounting
+// and the inspector.
+type turnPacketConn struct {
+	net.PacketConn
+	acct *TurnAccounting
+	insp *TurnInspector
+}
+
+func (c *turnPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		if n, addr, err = c.PacketConn.ReadFrom(p); err != nil {
+			return n, addr, err
+		}
+		c.insp.inbound(p[:n], c.LocalAddr(), addr)
+		reply := func(b []byte) { _, _ = c.PacketConn.WriteTo(c.insp.outbound(b, c.LocalAddr(), addr), addr) }
+		if c.acct.inbound(p[:n], addr, reply) {
+			return n, addr, nil
+		}
+	}
+}
+
+func (c *turnPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.acct.outbound(p, addr)
+	if _, err := c.PacketConn.WriteTo(c.insp.outbound(p, c.LocalAddr(), addr), addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// turnListener is a TCP, TLS or DTLS listener of the TURN server watched by
+// the accounting and the inspector.
+type turnListener struct {
+	net.Listener
+	acct *TurnAccounting
+	insp *TurnInspector
+}
+
+func (l *turnListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &turnStreamConn{Conn: c, acct: l.acct, insp: l.insp}, nil
+}
+
+// turnStreamConn splits the stream of a TCP connection into its STUN and
+// ChannelData frames, to watch them like the datagrams of a turnPacketConn.
+type turnStreamConn struct {
+	net.Conn
+	acct    *TurnAccounting
+	insp    *TurnInspector
+	buf     [4096]byte
+	in, out []byte
+}
+
+func (c *turnStreamConn) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		n, err := c.Conn.Read(c.buf[:])
+		c.in = append(c.in, c.buf[:n]...)
+		c.frames()
+		if err != nil && len(c.out) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+// frames moves the complete frames read to out, unless the accounting drops them.
+func (c *turnStreamConn) frames() {
+	for len(c.in) >= 4 {
+		size := turnFrameSize(c.in)
+		if size < 0 {
+			// Not TURN, leave it to the server.
+			c.out, c.in = append(c.out, c.in...), c.in[:0]
+			return
+		}
+		if len(c.in) < size {
+			return
+		}
+		c.insp.inbound(c.in[:size], c.LocalAddr(), c.RemoteAddr())
+		reply := func(b []byte) { _, _ = c.Conn.Write(c.insp.outbound(b, c.LocalAddr(), c.RemoteAddr())) }
+		if c.acct.inbound(c.in[:size], c.RemoteAddr(), reply) {
+			c.out = append(c.out, c.in[:size]...)
+		}
+		c.in = c.in[size:]
+	}
+}
+
+func (c *turnStreamConn) Write(p []byte) (int, error) {
+	c.acct.outbound(p, c.RemoteAddr())
+	if _, err := c.Conn.Write(c.insp.outbound(p, c.LocalAddr(), c.RemoteAddr())); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// turnFrameSize returns the size of the STUN message or the ChannelData
+// message, padded like over TCP, at the start of b, -1 if it is neither.
+func turnFrameSize(b []byte) int {
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	switch {
+	case b[0]>>6 == 0:
+		return 20 + length
+	case b[0] >= 0x40 && b[0] <= 0x7f:
+		return (4 + length + 3) &^ 3
+	}
+	return -1
+}
+
+// turnRelayGenerator wraps the relay sockets of a RelayAddressGenerator for
+// the accounting and the inspector.
+type turnRelayGenerator struct {
+	turn.RelayAddressGenerator
+	acct *TurnAccounting
+	insp *TurnInspector
+}
+
+func (g *turnRelayGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, addr, err := g.RelayAddressGenerator.AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := &turnRelay{PacketConn: conn, acct: g.acct, insp: g.insp, key: addr.String()}
+	if a, ok := addr.(*net.UDPAddr); ok {
+		r.key, r.relayed = relayKey(a.IP, a.Port), a
+	}
+	g.acct.lock.Lock()
+	g.acct.relays[r.key] = r
+	g.acct.lock.Unlock()
+	return r, addr, nil
+}
+
+// relayKey is the key of a relay socket by its relayed address.
+func relayKey(ip net.IP, port int) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+// turnRelay is the relay socket of an allocation, accounted to its user.
+type turnRelay struct {
+	net.PacketConn
+	acct *TurnAccounting
+	insp *TurnInspector
+	// key is the relayed address IP:port, the IPv4 and IPv6 relays may share a port.
+	key string
+	// relayed is the relayed address of the allocation.
+	relayed *net.UDPAddr
+	// id is the user of the allocation, nil until it succeeds.
+	id atomic.Pointer[turnIdentity]
+	// client is the address of the client of the allocation, guarded by the accounting lock.
+	client      string
+	timer       *time.Timer
+	expired     atomic.Bool
+	releaseOnce sync.Once
+	closeOnce   sync.Once
+}
+
+func (r *turnRelay) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		if n, addr, err = r.PacketConn.ReadFrom(p); err != nil {
+			return n, addr, err
+		}
+		if r.acct.relay(r, n, "received") {
+			r.insp.relayed(r, addr, n, false)
+			return n, addr, nil
+		}
+	}
+}
+
+func (r *turnRelay) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !r.acct.relay(r, len(p), "sent") {
+		// Dropped, like the network would.
+		return len(p), nil
+	}
+	r.insp.relayed(r, addr, len(p), true)
+	return r.PacketConn.WriteTo(p, addr)
+}
+
+// Close is called by the server when the allocation is deleted or times out.
+func (r *turnRelay) Close() error {
+	r.closeOnce.Do(func() {
+		a := r.acct
+		a.lock.Lock()
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+		if a.relays[r.key] == r {
+			delete(a.relays, r.key)
+		}
+		if a.clients[r.client] == r {
+			delete(a.clients, r.client)
+		}
+		a.lock.Unlock()
+		a.release(r)
+	})
+	return r.PacketConn.Close()
+}
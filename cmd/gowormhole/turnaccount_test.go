@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/turn/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTurnLimits(t *testing.T) {
+	var l TurnLimits
+	assert.Nil(t, l.Set("allocations=2,bandwidth=1000,bytes=5000"))
+	assert.Equal(t, TurnLimits{Allocations: 2, Bandwidth: 1000, Bytes: 5000}, l)
+	assert.Equal(t, "allocations=2,bandwidth=1000,bytes=5000", l.String())
+	assert.NotNil(t, l.Set("conns=1"))
+	assert.Equal(t, turnIdentity{user: "123:team-a", tenant: "team-a"}, turnIdentityOf("123:team-a"))
+	assert.Equal(t, turnIdentity{user: "scott", tenant: defaultTenant}, turnIdentityOf("scott"))
+}
+
+func TestTurnQuotas(t *testing.T) {
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.Nil(t, err)
+	port := l.LocalAddr().(*net.UDPAddr).Port
+	_ = l.Close()
+
+	o := TurnOptions{
+		PublicIP:     "127.0.0.1",
+		Port:         port,
+		Realm:        "example.com",
+		AuthSecret:   "secret",
+		UserLimits:   TurnLimits{Allocations: 1},
+		TenantLimits: TurnLimits{Bytes: 1000},
+		QuotaPeriod:  time.Hour,
+	}
+	s, err := newTurnServer(o, nil)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	username, password := turnCredentials("secret", "quota", time.Hour, time.Now())
+	dial := func() *turn.Client {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.Nil(t, err)
+		c, err := turn.NewClient(&turn.ClientConfig{
+			TURNServerAddr: o.Addr(),
+			Conn:           conn,
+			Username:       username,
+			Password:       password,
+			Realm:          o.Realm,
+			LoggerFactory:  logging.NewDefaultLoggerFactory(),
+		})
+		assert.Nil(t, err)
+		assert.Nil(t, c.Listen())
+		t.Cleanup(func() { c.Close(); _ = conn.Close() })
+		return c
+	}
+
+	relay1, err := dial().Allocate()
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(turnAllocationsGauge.WithLabelValues("quota")))
+
+	// The user has one allocation at most.
+	c2 := dial()
+	_, err = c2.Allocate()
+	assert.ErrorContains(t, err, "486")
+	assert.Equal(t, 1.0, testutil.ToFloat64(turnQuotaCounter.WithLabelValues("user", "allocations")))
+
+	// The tenant relays 1000 bytes at most.
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer peer.Close()
+	_, err = relay1.WriteTo(make([]byte, 600), peer.LocalAddr())
+	assert.Nil(t, err)
+	buf := make([]byte, 1500)
+	_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := peer.ReadFrom(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 600, n)
+	assert.Equal(t, 600.0, testutil.ToFloat64(turnRelayedBytesCounter.WithLabelValues("sent", "quota")))
+
+	_, _ = relay1.WriteTo(make([]byte, 600), peer.LocalAddr())
+	_ = peer.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	_, _, err = peer.ReadFrom(buf)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(turnQuotaCounter.WithLabelValues("tenant", "bytes")))
+
+	// Deleting the allocation frees it for the user.
+	assert.Nil(t, relay1.Close())
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(turnAllocationsGauge.WithLabelValues("quota")) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	relay2, err := c2.Allocate()
+	assert.Nil(t, err)
+	defer relay2.Close()
+	assert.NotZero(t, testutil.ToFloat64(turnRequestCounter.WithLabelValues("allocate", "success")))
+	assert.NotZero(t, testutil.ToFloat64(turnRequestCounter.WithLabelValues("createpermission", "success")))
+}
+
+func TestTurnFrameSize(t *testing.T) {
+	assert.Equal(t, 28, turnFrameSize([]byte{0x00, 0x01, 0x00, 0x08})) // STUN header and 8 bytes
+	assert.Equal(t, 12, turnFrameSize([]byte{0x40, 0x00, 0x00, 0x05})) // ChannelData padded to 4
+	assert.Equal(t, -1, turnFrameSize([]byte{0x80, 0x00, 0x00, 0x05}))
+}
+
+// fixedRelayGenerator relays on a socket of its own, advertised as addr.
+type fixedRelayGenerator struct {
+	turn.RelayAddressGenerator
+	addr *net.UDPAddr
+}
+
+func (g fixedRelayGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	return conn, g.addr, err
+}
+
+func TestTurnRelaysByAddress(t *testing.T) {
+	acct := NewTurnAccounting(TurnLimits{}, TurnLimits{}, 0, 0, nil)
+	v4 := &turnRelayGenerator{RelayAddressGenerator: fixedRelayGenerator{addr: &net.UDPAddr{IP: net.ParseIP("203.0.113.9"), Port: 50000}}, acct: acct}
+	v6 := &turnRelayGenerator{RelayAddressGenerator: fixedRelayGenerator{addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::9"), Port: 50000}}, acct: acct}
+
+	c4, _, err := v4.AllocatePacketConn("udp4", 0)
+	assert.Nil(t, err)
+	c6, _, err := v6.AllocatePacketConn("udp6", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, c4, acct.relays["203.0.113.9:50000"])
+	assert.Equal(t, c6, acct.relays["[2001:db8::9]:50000"])
+
+	// Closing one relay on the port keeps the other.
+	assert.Nil(t, c4.Close())
+	assert.Equal(t, map[string]*turnRelay{"[2001:db8::9]:50000": c6.(*turnRelay)}, acct.relays)
+	assert.Nil(t, c6.Close())
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -45,7 +46,7 @@ func turnClientSubCmd(ctx context.Context, args ...string) {
 
 	if *tcp {
 		// Dial TURN Server
-		turnServerAddr := fmt.Sprintf("%s:%d", *host, *port)
+		turnServerAddr := net.JoinHostPort(*host, strconv.Itoa(*port))
 		c, err := net.Dial("tcp", turnServerAddr)
 		if err != nil {
 			panic(err)
@@ -66,7 +67,7 @@ func turnClientSubCmd(ctx context.Context, args ...string) {
 		}
 	}()
 
-	turnServerAddr := fmt.Sprintf("%s:%d", *host, *port)
+	turnServerAddr := net.JoinHostPort(*host, strconv.Itoa(*port))
 
 	cfg := &turn.ClientConfig{
 		STUNServerAddr: turnServerAddr,
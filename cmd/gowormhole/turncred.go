@@ -0,0 +1,59 @@
+package main
+
+// Ephemeral TURN credentials shared by the signalling server and the TURN server,
+// as described in https://tools.ietf.org/html/draft-uberti-behave-turn-rest-00
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/turn/v2"
+)
+
+// defaultTurnCredTTL is the default lifetime of the ephemeral TURN credentials,
+// the allocations can't be refreshed after, so it should outlive the transfers.
+const defaultTurnCredTTL = 24 * time.Hour
+
+// turnCredentials returns the ephemeral TURN credentials of the tenant, valid
+// until now+ttl. The username is expiry:tenant, where expiry is a unix timestamp,
+// and the credential is base64(HMAC-SHA1(secret, username)).
+func turnCredentials(secret, tenant string, ttl time.Duration, now time.Time) (username, credential string) {
+	username = strconv.FormatInt(now.Add(ttl).Unix(), 10) + ":" + tenant
+	return username, turnCredential(secret, username)
+}
+
+func turnCredential(secret, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// turnRESTAuthHandler validates the ephemeral credentials made by turnCredentials.
+// turn.NewLongTermAuthHandler only accepts a bare timestamp as the username,
+// so the usernames without a tenant are left to it.
+func turnRESTAuthHandler(secret string, logger logging.LeveledLogger) turn.AuthHandler {
+	longTerm := turn.NewLongTermAuthHandler(secret, logger)
+	return func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+		expiry, _, ok := strings.Cut(username, ":")
+		if !ok {
+			return longTerm(username, realm, srcAddr)
+		}
+
+		t, err := strconv.ParseInt(expiry, 10, 64)
+		if err != nil {
+			logger.Errorf("Invalid time-windowed username %q", username)
+			return nil, false
+		}
+		if time.Now().Unix() >= t {
+			logger.Errorf("Expired time-windowed username %q", username)
+			return nil, false
+		}
+		return turn.GenerateAuthKey(username, realm, turnCredential(secret, username)), true
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/turn/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTurnCredentials(t *testing.T) {
+	logger := logging.NewDefaultLoggerFactory().NewLogger("test")
+	handler := turnRESTAuthHandler("secret", logger)
+
+	username, credential := turnCredentials("secret", "team-a", time.Hour, time.Now())
+	key, ok := handler(username, "example.com", nil)
+	assert.True(t, ok)
+	assert.Equal(t, turn.GenerateAuthKey(username, "example.com", credential), key)
+
+	username, _ = turnCredentials("secret", "team-a", -time.Minute, time.Now())
+	_, ok = handler(username, "example.com", nil)
+	assert.False(t, ok)
+
+	// The bare timestamps of turn.GenerateLongTermCredentials are accepted too.
+	username, credential, _ = turn.GenerateLongTermCredentials("secret", time.Hour)
+	key, ok = handler(username, "example.com", nil)
+	assert.True(t, ok)
+	assert.Equal(t, turn.GenerateAuthKey(username, "example.com", credential), key)
+}
@@ -0,0 +1,403 @@
+package main
+
+// Inspection of the TURN server for debugging the NAT issues of the clients.
+// The STUN messages through the listeners are logged as JSON lines, e.g.
+//
+//	{"time":"2026-10-18T10:00:00Z","direction":"in","transport":"udp","local":"0.0.0.0:3478",
+//	 "remote":"198.51.100.7:51234","method":"allocate","class":"request",
+//	 "transaction":"8b1f0c5e7a2d4c6e9f1a3b5d","attributes":[{"type":"REQUESTED-TRANSPORT","length":4,"value":"udp"}]}
+//
+// and the packets of the relay sockets are captured in a pcap file, as made up
+// IP and UDP headers between the peers and the relayed addresses, without the
+// payloads. Both can be restricted to some clients and peers.
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/gowormhole/internal/util"
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2"
+)
+
+const (
+	// linkTypeRaw is the pcap link type of raw IPv4 and IPv6 packets.
+	linkTypeRaw = 101
+	// maxInspectKeys bounds the keys kept to sign the responses with the SOFTWARE attribute.
+	maxInspectKeys = 4096
+)
+
+// TurnInspector logs the STUN messages of the listeners, captures the packets
+// of the relay sockets, and adds the SOFTWARE attribute to the responses.
+// A nil TurnInspector does nothing.
+type TurnInspector struct {
+	// Peers restricts the logs and the captures to these clients or peers, all if empty.
+	Peers []*net.IPNet
+	// Software is the SOFTWARE attribute added to the STUN messages, none if empty.
+	Software string
+
+	// key returns the keys of the users, to sign the responses again once the
+	// SOFTWARE attribute added.
+	key turn.AuthHandler
+	// keys are the keys of the authenticated requests waiting for their response.
+	keys map[[stun.TransactionIDSize]byte]turnInspectKey
+
+	log     io.Writer
+	capture io.Writer
+	lock    sync.Mutex
+}
+
+type turnInspectKey struct {
+	key   []byte
+	since time.Time
+}
+
+// turnInspectEntry is a STUN message in the logs.
+type turnInspectEntry struct {
+	Time time.Time `json:"time"`
+	// Direction is in or out of the server.
+	Direction   string             `json:"direction"`
+	Transport   string             `json:"transport"`
+	Local       string             `json:"local"`
+	Remote      string             `json:"remote"`
+	Method      string             `json:"method"`
+	Class       string             `json:"class"`
+	Transaction string             `json:"transaction"`
+	Attributes  []turnInspectValue `json:"attributes"`
+}
+
+// turnInspectValue is an attribute of a STUN message in the logs, the value
+// of the secrets and the data is left out.
+type turnInspectValue struct {
+	Type   string `json:"type"`
+	Length int    `json:"length"`
+	Value  string `json:"value,omitempty"`
+}
+
+// NewTurnInspector creates the inspector of the options, nil if they inspect
+// nothing. The keys of the users are looked up by key.
+func NewTurnInspector(o TurnOptions, key turn.AuthHandler) (*TurnInspector, error) {
+	if !o.Inspect && o.Capture == "" && o.Software == "" {
+		return nil, nil
+	}
+
+	i := &TurnInspector{Software: o.Software, key: key, keys: map[[stun.TransactionIDSize]byte]turnInspectKey{}}
+	peers, err := parseIPNets(o.InspectPeers)
+	if err != nil {
+		return nil, err
+	}
+	i.Peers = peers
+	if o.Inspect {
+		i.log = os.Stdout
+		if o.InspectLog != "" {
+			if i.log, err = os.OpenFile(o.InspectLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if o.Capture != "" {
+		f, err := os.Create(o.Capture)
+		if err != nil {
+			return nil, err
+		}
+		// The pcap file header, in microseconds, with a snap length of the IPv6 and UDP headers.
+		header := make([]byte, 24)
+		binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+		binary.LittleEndian.PutUint16(header[4:], 2)
+		binary.LittleEndian.PutUint16(header[6:], 4)
+		binary.LittleEndian.PutUint32(header[16:], 48)
+		binary.LittleEndian.PutUint32(header[20:], linkTypeRaw)
+		if _, err := f.Write(header); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		i.capture = f
+	}
+	return i, nil
+}
+
+// parseIPNets parses the comma separated list of IPs and CIDRs.
+func parseIPNets(list string) (nets []*net.IPNet, err error) {
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("bad IP %q", s)
+			}
+			s += util.If(ip.To4() != nil, "/32", "/128")
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// matches tells whether one of the addresses is one of the Peers.
+func (i *TurnInspector) matches(addrs ...net.Addr) bool {
+	if len(i.Peers) == 0 {
+		return true
+	}
+	for _, addr := range addrs {
+		if addr == nil {
+			continue
+		}
+		ip := addrIP(addr)
+		for _, n := range i.Peers {
+			if ip != nil && n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	host, _, _ := net.SplitHostPort(addr.String())
+	return net.ParseIP(host)
+}
+
+// inbound inspects the frame p received by local from remote.
+func (i *TurnInspector) inbound(p []byte, local, remote net.Addr) {
+	if i == nil || !stun.IsMessage(p) {
+		return
+	}
+	m := &stun.Message{Raw: p}
+	if err := m.Decode(); err != nil {
+		return
+	}
+	i.logMessage("in", m, local, remote)
+
+	// Keep the key of the request to sign its response again.
+	var username stun.Username
+	var realm stun.Realm
+	if i.Software == "" || m.Type.Class != stun.ClassRequest || !m.Contains(stun.AttrMessageIntegrity) ||
+		username.GetFrom(m) != nil || realm.GetFrom(m) != nil {
+		return
+	}
+	key, ok := i.key(username.String(), realm.String(), remote)
+	if !ok {
+		return
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if len(i.keys) >= maxInspectKeys {
+		now := time.Now()
+		for txID, k := range i.keys {
+			if now.Sub(k.since) >= turnPendingTimeout {
+				delete(i.keys, txID)
+			}
+		}
+		if len(i.keys) >= maxInspectKeys {
+			return
+		}
+	}
+	i.keys[m.TransactionID] = turnInspectKey{key: key, since: time.Now()}
+}
+
+// outbound inspects the frame p sent by local to remote, and returns it with
+// the SOFTWARE attribute.
+func (i *TurnInspector) outbound(p []byte, local, remote net.Addr) []byte {
+	if i == nil || !stun.IsMessage(p) {
+		return p
+	}
+	m := &stun.Message{Raw: append([]byte(nil), p...)}
+	if err := m.Decode(); err != nil {
+		return p
+	}
+	if i.Software != "" && !m.Contains(stun.AttrSoftware) {
+		if software, ok := i.addSoftware(m); ok {
+			p, m = software.Raw, software
+		}
+	}
+	i.logMessage("out", m, local, remote)
+	return p
+}
+
+// addSoftware returns m with the SOFTWARE attribute before its
+// MESSAGE-INTEGRITY and FINGERPRINT, signed again by the key of its request.
+func (i *TurnInspector) addSoftware(m *stun.Message) (*stun.Message, bool) {
+	var key []byte
+	if m.Contains(stun.AttrMessageIntegrity) {
+		i.lock.Lock()
+		k, ok := i.keys[m.TransactionID]
+		delete(i.keys, m.TransactionID)
+		i.lock.Unlock()
+		if !ok {
+			return nil, false
+		}
+		key = k.key
+	}
+
+	out := &stun.Message{Type: m.Type, TransactionID: m.TransactionID}
+	out.WriteHeader()
+	for _, a := range m.Attributes {
+		if a.Type == stun.AttrMessageIntegrity || a.Type == stun.AttrFingerprint {
+			break
+		}
+		out.Add(a.Type, a.Value)
+	}
+	setters := []stun.Setter{stun.NewSoftware(i.Software)}
+	if key != nil {
+		setters = append(setters, stun.MessageIntegrity(key))
+	}
+	if m.Contains(stun.AttrFingerprint) {
+		setters = append(setters, stun.Fingerprint)
+	}
+	for _, s := range setters {
+		if err := s.AddTo(out); err != nil {
+			return nil, false
+		}
+	}
+	return out, true
+}
+
+func (i *TurnInspector) logMessage(direction string, m *stun.Message, local, remote net.Addr) {
+	if i.log == nil || !i.matches(remote) {
+		return
+	}
+
+	e := turnInspectEntry{
+		Time:        time.Now(),
+		Direction:   direction,
+		Transport:   remote.Network(),
+		Local:       local.String(),
+		Remote:      remote.String(),
+		Method:      turnMethodName(m.Type.Method),
+		Class:       m.Type.Class.String(),
+		Transaction: hex.EncodeToString(m.TransactionID[:]),
+		Attributes:  make([]turnInspectValue, 0, len(m.Attributes)),
+	}
+	for _, a := range m.Attributes {
+		e.Attributes = append(e.Attributes, turnInspectValue{Type: a.Type.String(), Length: int(a.Length), Value: inspectValue(m, a)})
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	_, _ = i.log.Write(append(line, '\n'))
+}
+
+// inspectValue returns the value of the attribute a of m for the logs.
+func inspectValue(m *stun.Message, a stun.RawAttribute) string {
+	switch a.Type {
+	case stun.AttrUsername, stun.AttrRealm, stun.AttrSoftware, stun.AttrNonce:
+		return string(a.Value)
+	case stun.AttrXORMappedAddress, stun.AttrXORPeerAddress, stun.AttrXORRelayedAddress:
+		var addr stun.XORMappedAddress
+		if addr.GetFromAs(m, a.Type) == nil {
+			return addr.String()
+		}
+	case stun.AttrErrorCode:
+		var code stun.ErrorCodeAttribute
+		if code.GetFrom(m) == nil {
+			return code.String()
+		}
+	case stun.AttrLifetime:
+		if len(a.Value) == 4 {
+			return (time.Duration(binary.BigEndian.Uint32(a.Value)) * time.Second).String()
+		}
+	case stun.AttrRequestedTransport:
+		if len(a.Value) == 4 {
+			return util.If(a.Value[0] == 17, "udp", strconv.Itoa(int(a.Value[0])))
+		}
+	case stun.AttrChannelNumber:
+		if len(a.Value) == 4 {
+			return strconv.Itoa(int(binary.BigEndian.Uint16(a.Value)))
+		}
+	}
+	return ""
+}
+
+// relayed captures a packet of n bytes between the relay socket r and peer,
+// sent to the peer or received from it.
+func (i *TurnInspector) relayed(r *turnRelay, peer net.Addr, n int, sent bool) {
+	if i == nil || i.capture == nil || r.relayed == nil {
+		return
+	}
+	peerAddr, ok := peer.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	if len(i.Peers) > 0 {
+		r.acct.lock.Lock()
+		client := r.client
+		r.acct.lock.Unlock()
+		host, _, _ := net.SplitHostPort(client)
+		if !i.matches(peer) && !i.matches(&net.UDPAddr{IP: net.ParseIP(host)}) {
+			return
+		}
+	}
+
+	src, dst := peerAddr, r.relayed
+	if sent {
+		src, dst = dst, src
+	}
+	header := udpIPHeader(src, dst, n)
+	now := time.Now()
+	record := make([]byte, 16, 16+len(header))
+	binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(header)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(header)+n))
+	record = append(record, header...)
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	_, _ = i.capture.Write(record)
+}
+
+// udpIPHeader returns the IP and UDP headers of a datagram of n bytes from src to dst.
+func udpIPHeader(src, dst *net.UDPAddr, n int) []byte {
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+n))
+
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		ip := make([]byte, 20)
+		ip[0], ip[8], ip[9] = 0x45, 64, 17
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+8+n))
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		var sum uint32
+		for j := 0; j < 20; j += 2 {
+			sum += uint32(binary.BigEndian.Uint16(ip[j:]))
+		}
+		for sum > 0xffff {
+			sum = sum&0xffff + sum>>16
+		}
+		binary.BigEndian.PutUint16(ip[10:], ^uint16(sum))
+		return append(ip, udp...)
+	}
+
+	ip := make([]byte, 40)
+	ip[0], ip[6], ip[7] = 0x60, 17, 64
+	binary.BigEndian.PutUint16(ip[4:], uint16(8+n))
+	copy(ip[8:], src.IP.To16())
+	copy(ip[24:], dst.IP.To16())
+	return append(ip, udp...)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTurnInspectorSoftware(t *testing.T) {
+	key := turn.GenerateAuthKey("scott", "example.com", "tiger")
+	i, err := NewTurnInspector(TurnOptions{Software: "gowormhole"}, func(username, realm string, _ net.Addr) ([]byte, bool) {
+		return key, username == "scott"
+	})
+	assert.Nil(t, err)
+	client := &net.UDPAddr{IP: net.ParseIP("198.51.100.7"), Port: 51234}
+
+	req := stun.MustBuild(stun.TransactionID, stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		stun.NewUsername("scott"), stun.NewRealm("example.com"), stun.MessageIntegrity(key))
+	i.inbound(req.Raw, client, client)
+	res := stun.MustBuild(req, stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse),
+		&stun.XORMappedAddress{IP: client.IP, Port: client.Port}, stun.MessageIntegrity(key), stun.Fingerprint)
+
+	// The response keeps a valid MESSAGE-INTEGRITY and FINGERPRINT after the SOFTWARE.
+	m := &stun.Message{Raw: i.outbound(res.Raw, client, client)}
+	assert.Nil(t, m.Decode())
+	var software stun.Software
+	assert.Nil(t, software.GetFrom(m))
+	assert.Equal(t, "gowormhole", software.String())
+	assert.Nil(t, stun.MessageIntegrity(key).Check(m))
+	assert.Nil(t, stun.Fingerprint.Check(m))
+
+	var nilInspector *TurnInspector
+	assert.Equal(t, res.Raw, nilInspector.outbound(res.Raw, client, client))
+
+	peers, err := parseIPNets("198.51.100.7, 203.0.113.0/24")
+	assert.Nil(t, err)
+	i.Peers = peers
+	assert.True(t, i.matches(&net.UDPAddr{IP: net.ParseIP("203.0.113.9")}))
+	assert.False(t, i.matches(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, nil))
+	_, err = parseIPNets("nowhere")
+	assert.NotNil(t, err)
+}
+
+func TestTurnInspector(t *testing.T) {
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.Nil(t, err)
+	port := l.LocalAddr().(*net.UDPAddr).Port
+	_ = l.Close()
+
+	dir := t.TempDir()
+	o := TurnOptions{
+		PublicIP:   "127.0.0.1",
+		Port:       port,
+		Realm:      "example.com",
+		AuthSecret: "secret",
+		Inspect:    true,
+		InspectLog: filepath.Join(dir, "inspect.log"),
+		Capture:    filepath.Join(dir, "relay.pcap"),
+		Software:   "gowormhole",
+	}
+	s, err := newTurnServer(o, nil)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	username, password := turnCredentials("secret", "", time.Hour, time.Now())
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+	c, err := turn.NewClient(&turn.ClientConfig{
+		TURNServerAddr: o.Addr(),
+		Conn:           conn,
+		Username:       username,
+		Password:       password,
+		Realm:          o.Realm,
+		LoggerFactory:  logging.NewDefaultLoggerFactory(),
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, c.Listen())
+	defer c.Close()
+	relay, err := c.Allocate()
+	assert.Nil(t, err)
+	defer relay.Close()
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer peer.Close()
+	_, err = relay.WriteTo(make([]byte, 100), peer.LocalAddr())
+	assert.Nil(t, err)
+	_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = peer.ReadFrom(make([]byte, 1500))
+	assert.Nil(t, err)
+
+	// The allocation is logged, its response with the SOFTWARE attribute.
+	f, err := os.Open(o.InspectLog)
+	assert.Nil(t, err)
+	defer f.Close()
+	var allocated *turnInspectEntry
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var e turnInspectEntry
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &e))
+		if e.Direction == "out" && e.Method == "allocate" && e.Class == "success response" {
+			allocated = &e
+		}
+	}
+	if assert.NotNil(t, allocated) {
+		assert.Equal(t, "udp", allocated.Transport)
+		assert.Equal(t, conn.LocalAddr().String(), allocated.Remote)
+		assert.Contains(t, allocated.Attributes, turnInspectValue{Type: "SOFTWARE", Length: len("gowormhole"), Value: "gowormhole"})
+	}
+
+	// The packet to the peer is captured, from the relayed address.
+	data, err := os.ReadFile(o.Capture)
+	assert.Nil(t, err)
+	if assert.Len(t, data, 24+16+28) {
+		assert.Equal(t, uint32(linkTypeRaw), binary.LittleEndian.Uint32(data[20:]))
+		assert.Equal(t, uint32(28+100), binary.LittleEndian.Uint32(data[24+12:]))
+		record := data[24+16:]
+		assert.Equal(t, relay.LocalAddr().(*net.UDPAddr).IP.To4(), net.IP(record[12:16]))
+		assert.Equal(t, uint16(peer.LocalAddr().(*net.UDPAddr).Port), binary.BigEndian.Uint16(record[22:]))
+	}
+}
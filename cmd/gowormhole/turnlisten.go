@@ -0,0 +1,351 @@
+package main
+
+// The listeners of the TURN server. One server may listen on UDP, TCP, TLS and
+// DTLS at once, e.g. UDP on 3478 for most clients and TLS on 443 for the ones
+// behind firewalls blocking UDP, with relay addresses in IPv4 and IPv6.
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/gg/pkg/ss"
+	"github.com/bingoohuang/gowormhole"
+	"github.com/bingoohuang/gowormhole/internal/util"
+	"github.com/pion/dtls/v2"
+	"github.com/pion/turn/v2"
+	"github.com/pion/udp"
+)
+
+const (
+	// defaultTurnsPort is the default port of the TLS and DTLS listeners.
+	defaultTurnsPort = 5349
+	// dtlsHandshakeTimeout bounds the DTLS handshakes.
+	dtlsHandshakeTimeout = 10 * time.Second
+)
+
+// TurnListenerConf is a listener of the TURN server, given as a URL
+// transport://host:port?cert=file&key=file&relay=ip, e.g.
+//
+//	udp://0.0.0.0:3478
+//	tcp://[::]:3478
+//	tls://:443?cert=turn.crt&key=turn.key
+//	dtls://:5349
+//
+// The transport is udp, tcp, tls or dtls. The TLS and DTLS listeners use the
+// -cert and -key of the server without cert and key. The relay is the public IP
+// of the relay sockets of the allocations made on the listener, by default the
+// one of -relay-ips in the address family of the listener.
+type TurnListenerConf struct {
+	Transport string
+	Addr      string
+	CertFile  string
+	KeyFile   string
+	Relay     net.IP
+}
+
+// parseTurnListener parses a listener URL.
+func parseTurnListener(s string) (c TurnListenerConf, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return c, err
+	}
+	switch u.Scheme {
+	case "udp", "tcp", "tls", "dtls":
+		c.Transport = u.Scheme
+	default:
+		return c, fmt.Errorf("bad TURN listener %q, should be udp, tcp, tls or dtls://host:port", s)
+	}
+
+	host, port := u.Hostname(), u.Port()
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	if port == "" {
+		port = strconv.Itoa(util.If(c.Transport == "tls" || c.Transport == "dtls", defaultTurnsPort, gowormhole.DefaultTurnPort))
+	}
+	c.Addr = net.JoinHostPort(host, port)
+
+	q := u.Query()
+	c.CertFile, c.KeyFile = q.Get("cert"), q.Get("key")
+	if relay := q.Get("relay"); relay != "" {
+		if c.Relay = net.ParseIP(relay); c.Relay == nil {
+			return c, fmt.Errorf("bad relay IP %q of TURN listener %q", relay, s)
+		}
+	}
+	return c, nil
+}
+
+// String returns the URL of the listener.
+func (c TurnListenerConf) String() string {
+	q := url.Values{}
+	if c.CertFile != "" {
+		q.Set("cert", c.CertFile)
+	}
+	if c.KeyFile != "" {
+		q.Set("key", c.KeyFile)
+	}
+	if c.Relay != nil {
+		q.Set("relay", c.Relay.String())
+	}
+	u := url.URL{Scheme: c.Transport, Host: c.Addr, RawQuery: q.Encode()}
+	return u.String()
+}
+
+// ipv6 tells whether the listener listens on IPv6.
+func (c TurnListenerConf) ipv6() bool {
+	host, _, _ := net.SplitHostPort(c.Addr)
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+// URL returns the ICE URL of the listener advertised at host, its relay IP if empty.
+func (c TurnListenerConf) URL(host string) string {
+	scheme, transport := "turn", "udp"
+	switch c.Transport {
+	case "tcp":
+		transport = "tcp"
+	case "tls":
+		scheme, transport = "turns", "tcp"
+	case "dtls":
+		scheme = "turns"
+	}
+	return scheme + ":" + c.advertised(host) + "?transport=" + transport
+}
+
+// advertised returns the host:port of the listener advertised at host, its relay IP if empty.
+func (c TurnListenerConf) advertised(host string) string {
+	_, port, _ := net.SplitHostPort(c.Addr)
+	if host == "" && c.Relay != nil {
+		host = c.Relay.String()
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// listen opens the listener, a PacketConn for udp and a Listener for the others.
+func (c TurnListenerConf) listen() (net.PacketConn, net.Listener, error) {
+	family := util.If(c.ipv6(), "6", "4")
+	switch c.Transport {
+	case "udp":
+		pc, err := net.ListenPacket("udp"+family, c.Addr)
+		return pc, nil, err
+	case "tcp":
+		l, err := net.Listen("tcp"+family, c.Addr)
+		return nil, l, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.Transport == "tls" {
+		l, err := tls.Listen("tcp"+family, c.Addr, &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{cert},
+		})
+		return nil, l, err
+	}
+
+	addr, err := net.ResolveUDPAddr("udp"+family, c.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	l, err := listenDTLS("udp"+family, addr, &dtls.Config{
+		Certificates:         []tls.Certificate{cert},
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+		ConnectContextMaker: func() (context.Context, func()) {
+			return context.WithTimeout(context.Background(), dtlsHandshakeTimeout)
+		},
+	})
+	return nil, l, err
+}
+
+// TurnListeners is the list of listeners of the TURN server, a flag.Value of
+// comma separated listener URLs.
+type TurnListeners []TurnListenerConf
+
+func (l *TurnListeners) String() string {
+	if l == nil {
+		return ""
+	}
+	urls := make([]string, len(*l))
+	for i, c := range *l {
+		urls[i] = c.String()
+	}
+	return strings.Join(urls, ",")
+}
+
+func (l *TurnListeners) Set(s string) error {
+	var listeners TurnListeners
+	for _, u := range strings.Split(s, ",") {
+		if u = strings.TrimSpace(u); u == "" {
+			continue
+		}
+		c, err := parseTurnListener(u)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, c)
+	}
+	*l = listeners
+	return nil
+}
+
+// listeners returns the listeners of the options with their certificates and
+// relay IPs, the one of -port and -tcp if none is given.
+func (o *TurnOptions) listeners() ([]TurnListenerConf, error) {
+	listeners := o.Listeners
+	if len(listeners) == 0 {
+		c := TurnListenerConf{Transport: "udp", Addr: "0.0.0.0:" + strconv.Itoa(o.Port)}
+		if o.TCP {
+			c.Transport = util.If(o.CertFile != "" && o.KeyFile != "", "tls", "tcp")
+		}
+		listeners = TurnListeners{c}
+	}
+
+	var relays []net.IP
+	for _, s := range strings.Split(ss.Or(o.RelayIPs, o.PublicIP), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("bad relay IP %q", s)
+		}
+		relays = append(relays, ip)
+	}
+
+	resolved := make([]TurnListenerConf, len(listeners))
+	for i, c := range listeners {
+		if c.Transport == "tls" || c.Transport == "dtls" {
+			c.CertFile, c.KeyFile = ss.Or(c.CertFile, o.CertFile), ss.Or(c.KeyFile, o.KeyFile)
+		}
+		for _, ip := range relays {
+			if c.Relay != nil {
+				break
+			}
+			if (ip.To4() == nil) == c.ipv6() {
+				c.Relay = ip
+			}
+		}
+		if c.Relay == nil {
+			return nil, fmt.Errorf("no relay IP for TURN listener %s, see -relay-ips", c)
+		}
+		resolved[i] = c
+	}
+	return resolved, nil
+}
+
+// URLs returns the TURN URLs of the listeners, and the STUN URLs of the UDP
+// ones, advertised at host, their relay IPs if empty.
+func (o *TurnOptions) URLs(host string) (turnURLs, stunURLs []string, err error) {
+	listeners, err := o.listeners()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, c := range listeners {
+		turnURLs = append(turnURLs, c.URL(host))
+		if c.Transport == "udp" {
+			stunURLs = append(stunURLs, "stun:"+c.advertised(host))
+		}
+	}
+	return turnURLs, stunURLs, nil
+}
+
+// relayGenerator returns the generator of the relay sockets of the allocations
+// made on the listener c.
+func (o *TurnOptions) relayGenerator(c TurnListenerConf) turn.RelayAddressGenerator {
+	ipv6 := c.Relay.To4() == nil
+	// Claim that we are listening on the relay IP (This should be your Public IP),
+	// but actually be listening on every interface of its family.
+	address := util.If(ipv6, "[::]", "0.0.0.0")
+
+	var g turn.RelayAddressGenerator
+	if o.PortRange == "" {
+		g = &turn.RelayAddressGeneratorStatic{RelayAddress: c.Relay, Address: address}
+	} else {
+		minPort, maxPort := SplitUint16(o.PortRange)
+		g = &turn.RelayAddressGeneratorPortRange{RelayAddress: c.Relay, Address: address, MinPort: minPort, MaxPort: maxPort}
+	}
+	if ipv6 {
+		g = &turnIPv6Generator{RelayAddressGenerator: g}
+	}
+	return g
+}
+
+// turnIPv6Generator allocates the relay sockets in IPv6, pion asks for udp4
+// whatever the relay address.
+type turnIPv6Generator struct {
+	turn.RelayAddressGenerator
+}
+
+func (g *turnIPv6Generator) AllocatePacketConn(_ string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	return g.RelayAddressGenerator.AllocatePacketConn("udp6", requestedPort)
+}
+
+// dtlsListener accepts DTLS connections, handshaking them concurrently: pion
+// stops accepting on the first failed handshake, and a slow one would hold the others.
+type dtlsListener struct {
+	net.Listener
+	config    *dtls.Config
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// listenDTLS listens for DTLS connections on laddr.
+func listenDTLS(network string, laddr *net.UDPAddr, config *dtls.Config) (net.Listener, error) {
+	lc := udp.ListenConfig{
+		// Only a DTLS handshake record opens a connection.
+		AcceptFilter: func(p []byte) bool { return len(p) > 0 && p[0] == 22 },
+	}
+	parent, err := lc.Listen(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &dtlsListener{Listener: parent, config: config, conns: make(chan net.Conn), done: make(chan struct{})}
+	go l.run()
+	return l, nil
+}
+
+func (l *dtlsListener) run() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			conn, err := dtls.Server(c, l.config)
+			if err != nil {
+				_ = c.Close()
+				return
+			}
+			select {
+			case l.conns <- conn:
+			case <-l.done:
+				_ = conn.Close()
+			}
+		}()
+	}
+}
+
+func (l *dtlsListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *dtlsListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bingoohuang/gowormhole/internal/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTurnListeners(t *testing.T) {
+	var l TurnListeners
+	assert.Nil(t, l.Set("udp://:3478, tls://[::]:443?cert=a.crt&key=a.key,dtls://10.0.0.1?relay=203.0.113.9"))
+	assert.Equal(t, TurnListeners{
+		{Transport: "udp", Addr: "0.0.0.0:3478"},
+		{Transport: "tls", Addr: "[::]:443", CertFile: "a.crt", KeyFile: "a.key"},
+		{Transport: "dtls", Addr: "10.0.0.1:5349", Relay: net.ParseIP("203.0.113.9")},
+	}, l)
+	assert.Equal(t, "udp://0.0.0.0:3478,tls://[::]:443?cert=a.crt&key=a.key,dtls://10.0.0.1:5349?relay=203.0.113.9", l.String())
+	assert.NotNil(t, l.Set("sctp://:3478"))
+	assert.NotNil(t, l.Set("udp://:3478?relay=nowhere"))
+
+	// The listeners take the certificate of the server and a relay IP of their family.
+	o := TurnOptions{PublicIP: "127.0.0.1", CertFile: "server.crt", KeyFile: "server.key", RelayIPs: "203.0.113.7,2001:db8::7"}
+	assert.Nil(t, o.Listeners.Set("udp://:3478,tcp://[::]:3478,tls://:443,dtls://10.0.0.1?relay=203.0.113.9"))
+	listeners, err := o.listeners()
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.7", listeners[0].Relay.String())
+	assert.Equal(t, "2001:db8::7", listeners[1].Relay.String())
+	assert.Equal(t, "server.crt", listeners[2].CertFile)
+	assert.Equal(t, "203.0.113.9", listeners[3].Relay.String())
+
+	turnURLs, stunURLs, err := o.URLs("")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"turn:203.0.113.7:3478?transport=udp",
+		"turn:[2001:db8::7]:3478?transport=tcp",
+		"turns:203.0.113.7:443?transport=tcp",
+		"turns:203.0.113.9:5349?transport=udp",
+	}, turnURLs)
+	assert.Equal(t, []string{"stun:203.0.113.7:3478"}, stunURLs)
+	turnURLs, _, _ = o.URLs("turn.example.com")
+	assert.Equal(t, "turns:turn.example.com:443?transport=tcp", turnURLs[2])
+
+	o.RelayIPs = "203.0.113.7"
+	_, err = o.listeners()
+	assert.NotNil(t, err)
+
+	// Without -listen, -port and -tcp make the listener.
+	o = TurnOptions{PublicIP: "127.0.0.1", Port: 3479, TCP: true}
+	assert.Equal(t, "127.0.0.1:3479", o.Addr())
+	turnURLs, _, _ = o.URLs("")
+	assert.Equal(t, []string{"turn:127.0.0.1:3479?transport=tcp"}, turnURLs)
+}
+
+func TestTurnServerListeners(t *testing.T) {
+	certFile, keyFile, roots := testCertificate(t)
+	freePort := func(network string) string {
+		if network == "udp" || network == "udp6" {
+			pc, err := net.ListenPacket(network, util.If(network == "udp", "127.0.0.1:0", "[::1]:0"))
+			assert.Nil(t, err)
+			defer pc.Close()
+			return strconv.Itoa(pc.LocalAddr().(*net.UDPAddr).Port)
+		}
+		l, err := net.Listen("tcp4", "127.0.0.1:0")
+		assert.Nil(t, err)
+		defer l.Close()
+		return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	}
+
+	o := TurnOptions{PublicIP: "127.0.0.1", Realm: "test", AuthSecret: "secret", CertFile: certFile, KeyFile: keyFile}
+	assert.Nil(t, o.Listeners.Set("udp://127.0.0.1:"+freePort("udp")+
+		",tcp://127.0.0.1:"+freePort("tcp")+
+		",tls://127.0.0.1:"+freePort("tcp")+
+		",dtls://127.0.0.1:"+freePort("udp")))
+	if pc, err := net.ListenPacket("udp6", "[::1]:0"); err == nil {
+		_ = pc.Close()
+		o.RelayIPs = "127.0.0.1,::1"
+		o.Listeners = append(o.Listeners, TurnListenerConf{Transport: "udp", Addr: "[::1]:" + freePort("udp6")})
+	}
+	s, err := newTurnServer(o, nil)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	turnURLs, _, err := o.URLs("")
+	assert.Nil(t, err)
+	username, password := turnCredentials("secret", "", time.Hour, time.Now())
+	for _, u := range turnURLs {
+		addr, err := checkICEServer("turn", u, username, password, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}, 5*time.Second)
+		if assert.Nil(t, err, u) {
+			assert.Contains(t, u, addr.(*net.UDPAddr).IP.String())
+		}
+	}
+}
+
+// testCertificate writes a self-signed certificate of 127.0.0.1 and returns
+// its files and the pool trusting it.
+func testCertificate(t *testing.T) (certFile, keyFile string, roots *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "turn.crt"), filepath.Join(dir, "turn.key")
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	roots = x509.NewCertPool()
+	roots.AddCert(cert)
+	return certFile, keyFile, roots
+}
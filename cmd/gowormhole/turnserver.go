@@ -2,22 +2,24 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/bingoohuang/gowormhole"
+	"github.com/bingoohuang/gowormhole/internal/util"
 	"github.com/pion/logging"
-	"github.com/pion/stun"
 	"github.com/pion/turn/v2"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 /**
@@ -26,6 +28,77 @@ https://github.com/pion/turn/blob/master/examples/README.md
 $ ./gowormwhole turn -public-ip 127.0.0.1
 */
 
+// TurnOptions is the configuration of a TURN server, shared by the turn command
+// and the TURN server embedded in the signalling server.
+type TurnOptions struct {
+	PublicIP string
+	Port     int
+	Users    string
+	// UsersFile is the file of the users, see TurnUsers, instead of Users.
+	UsersFile  string
+	Realm      string
+	PortRange  string
+	AuthSecret string
+	CertFile   string
+	KeyFile    string
+	TCP        bool
+	// Inspect logs the STUN messages as JSON lines to InspectLog, stdout if empty.
+	Inspect    bool
+	InspectLog string
+	// InspectPeers restricts the inspection and the capture to these comma
+	// separated IPs and CIDRs of the clients and the peers.
+	InspectPeers string
+	// Capture is the pcap file of the relayed packets, without their payloads.
+	Capture string
+	// Software is the SOFTWARE attribute of the STUN messages of the server.
+	Software string
+	// Listeners are the listeners of the server, -port and -tcp make one when empty.
+	Listeners TurnListeners
+	// RelayIPs are the comma separated public IPs of the relay sockets, one per
+	// address family, PublicIP when empty.
+	RelayIPs string
+	// UserLimits and TenantLimits are the quotas of each user and each tenant.
+	UserLimits, TenantLimits TurnLimits
+	// QuotaPeriod is the period of the bytes quotas.
+	QuotaPeriod time.Duration
+	// MaxLifetime caps the lifetime of the allocations, zero for unlimited.
+	MaxLifetime time.Duration
+}
+
+// Flags defines the flags of the options on set.
+func (o *TurnOptions) Flags(set *flag.FlagSet) {
+	set.StringVar(&o.PublicIP, "public-ip", "127.0.0.1", "IP Address that TURN can be contacted by.")
+	set.IntVar(&o.Port, "port", gowormhole.DefaultTurnPort, "Listening port, without -listen.")
+	set.StringVar(&o.Users, "users", "scott=tiger", `List of username and password (e.g. "user=pass,user=pass"), without -authSecret and -users-file`)
+	set.StringVar(&o.UsersFile, "users-file", "", "JSON file of the users and their keys, reloaded on change and written by the users API")
+	set.StringVar(&o.Realm, "realm", "pion.ly", `Realm (defaults to "pion.ly")`)
+	set.StringVar(&o.PortRange, "portRange", "", `turn.RelayAddressGeneratorPortRange, like 50000-55000`)
+	set.StringVar(&o.AuthSecret, "authSecret", "", "Shared secret for the Long Term Credential Mechanism, e.g. the -turn-secret of the signalling server")
+	set.StringVar(&o.CertFile, "cert", "server.crt", `Certificate of the TLS and DTLS listeners (defaults to "server.crt")`)
+	set.StringVar(&o.KeyFile, "key", "server.key", `Key of the TLS and DTLS listeners (defaults to "server.key")`)
+	set.BoolVar(&o.TCP, "tcp", false, `Listening on TCP, or TLS with -cert and -key, without -listen`)
+	set.Var(&o.Listeners, "listen", "listeners, e.g. udp://:3478,tls://:443?cert=turn.crt&key=turn.key,dtls://[::]:5349, see TurnListenerConf")
+	set.StringVar(&o.RelayIPs, "relay-ips", "", "public IPs of the relay sockets, one per address family, e.g. 203.0.113.7,2001:db8::7, defaults to -public-ip")
+	set.BoolVar(&o.Inspect, "inspect", false, `log the incoming/outgoing STUN messages as JSON lines`)
+	set.StringVar(&o.InspectLog, "inspect-log", "", "file of the -inspect logs, defaults to stdout")
+	set.StringVar(&o.InspectPeers, "inspect-peers", "", "IPs and CIDRs of the clients and peers to inspect and capture, e.g. 198.51.100.7,203.0.113.0/24, all if empty")
+	set.StringVar(&o.Capture, "capture", "", "pcap file of the headers of the relayed packets")
+	set.StringVar(&o.Software, "software", "", "SOFTWARE attribute of the STUN messages, e.g. gowormhole")
+	set.Var(&o.UserLimits, "user-limits", "quotas per user, e.g. allocations=5,bandwidth=1000000,bytes=10000000000 (bandwidth in bytes per second, bytes per -quota-period)")
+	set.Var(&o.TenantLimits, "tenant-limits", "quotas per tenant of the ephemeral credentials, same format as -user-limits")
+	set.DurationVar(&o.QuotaPeriod, "quota-period", defaultTurnQuotaPeriod, "period of the bytes quotas")
+	set.DurationVar(&o.MaxLifetime, "max-lifetime", 0, "max lifetime of an allocation however refreshed, 0 for unlimited")
+}
+
+// Addr returns the address the TURN server can be contacted by on its first listener.
+func (o *TurnOptions) Addr() string {
+	listeners, err := o.listeners()
+	if err != nil {
+		return net.JoinHostPort(o.PublicIP, strconv.Itoa(o.Port))
+	}
+	return listeners[0].advertised("")
+}
+
 func turnServerSubCmd(ctx context.Context, args ...string) {
 	set := flag.NewFlagSet(args[0], flag.ExitOnError)
 	set.Usage = func() {
@@ -35,150 +108,180 @@ func turnServerSubCmd(ctx context.Context, args ...string) {
 		set.PrintDefaults()
 	}
 
-	publicIP := set.String("public-ip", "127.0.0.1", "IP Address that TURN can be contacted by.")
-	port := set.Int("port", gowormhole.DefaultTurnPort, "Listening port.")
-	users := set.String("users", "scott=tiger", `List of username and password (e.g. "user=pass,user=pass")`)
-	realm := set.String("realm", "pion.ly", `Realm (defaults to "pion.ly")`)
-	portRange := set.String("portRange", "", `turn.RelayAddressGeneratorPortRange, like 50000-55000`)
-	authSecret := flag.String("authSecret", "", "Shared secret for the Long Term Credential Mechanism")
-	certFile := flag.String("cert", "server.crt", `Certificate (defaults to "server.crt")`)
-	keyFile := flag.String("key", "server.key", `Key (defaults to "server.key")`)
-	listeningOnTcp := set.Bool("tcp", false, `Listening on TCP`)
-	inspectStunPackets := set.Bool("inspect", false, `Inspect incoming/outgoing STUN packets`)
+	var o TurnOptions
+	o.Flags(set)
+	debugAddr := set.String("debug", "", "debug and metrics listen address")
+	adminToken := set.String("admin-token", "", "token to access the users API under /admin/api/ on the debug listener, the API is disabled if empty, the users API without -users-file")
 	_ = set.Parse(args[1:])
 
-	if len(*publicIP) == 0 {
+	// The flags given on the command line override the turn section of the config file.
+	explicit := explicitFlags(set)
+	if err := applyConfig(set, config.Turn, explicit); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(o.PublicIP) == 0 {
 		log.Fatalf("'public-ip' is required")
-	} else if len(*users) == 0 {
+	} else if len(o.Users) == 0 && o.AuthSecret == "" && o.UsersFile == "" {
 		log.Fatalf("'users' is required")
 	}
 
-	var packetConnConfigs []turn.PacketConnConfig
-	var listenerConfigs []turn.ListenerConfig
-	if *listeningOnTcp {
-		var tcpListener net.Listener
-		if *certFile != "" && *keyFile != "" {
-			cer, err := tls.LoadX509KeyPair(*certFile, *keyFile)
-			if err != nil {
-				log.Println(err)
-				return
-			}
+	// The users of -users are replaced when reloaded on SIGHUP, the ones of
+	// -users-file when the file is modified. The realm of a running server
+	// can't change, so the users keep the one it started with. The users API
+	// needs -users-file to keep its users, which SIGHUP would wipe otherwise.
+	serverRealm := o.Realm
+	users, err := NewTurnUsers(o.UsersFile, serverRealm)
+	if err != nil {
+		log.Fatalf("load TURN users failed: %v", err)
+	}
+	staticUsers := o.UsersFile == "" && o.AuthSecret == ""
+	if staticUsers {
+		users.Set(parseTurnUsers(o.Users, serverRealm))
+	} else if o.UsersFile != "" {
+		go users.Watch(ctx, 5*time.Second)
+	}
 
-			// Create a TLS listener to pass into pion/turn
-			// pion/turn itself doesn't allocate any TLS listeners, but lets the user pass them in
-			// this allows us to add logging, storage or modify inbound/outbound traffic
-			tcpListener, err = tls.Listen("tcp4", "0.0.0.0:"+strconv.Itoa(*port), &tls.Config{
-				MinVersion:   tls.VersionTLS12,
-				Certificates: []tls.Certificate{cer},
-			})
-			if err != nil {
-				log.Println(err)
-				return
-			}
-		} else {
-			var err error
-			// Create a TCP listener to pass into pion/turn
-			// pion/turn itself doesn't allocate any TCP listeners, but lets the user pass them in
-			// this allows us to add logging, storage or modify inbound/outbound traffic
-			tcpListener, err = net.Listen("tcp4", "0.0.0.0:"+strconv.Itoa(*port))
-			if err != nil {
-				log.Panicf("Failed to create TURN server listener: %s", err)
+	s, err := newTurnServer(o, users)
+	if err != nil {
+		log.Fatalf("start TURN server failed: %v", err)
+	}
+	turnURLs, _, _ := o.URLs("")
+	log.Printf("TURN server listening on %s", strings.Join(turnURLs, " "))
+
+	if *debugAddr != "" {
+		http.Handle("/metrics", promhttp.Handler())
+		if *adminToken != "" {
+			var apiUsers *TurnUsers
+			if o.UsersFile != "" {
+				apiUsers = users
+			} else {
+				log.Printf("the users API is disabled without -users-file")
 			}
+			registerTurnAdmin(http.DefaultServeMux, *adminToken, apiUsers, o.AuthSecret)
 		}
-		// ListenerConfig is a list of Listeners and the configuration around them
-		listenerConfigs = []turn.ListenerConfig{{
-			Listener: tcpListener,
-			RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
-				RelayAddress: net.ParseIP(*publicIP),
-				Address:      "0.0.0.0",
-			},
-		}}
-	} else {
-		// Create a UDP listener to pass into pion/turn
-		// pion/turn itself doesn't allocate any UDP sockets, but lets the user pass them in
-		// this allows us to add logging, storage or modify inbound/outbound traffic
-		udpListener, err := net.ListenPacket("udp4", "0.0.0.0:"+strconv.Itoa(*port))
-		if err != nil {
-			log.Panicf("Failed to create TURN server listener: %s", err)
-		}
+		go func() { log.Printf("debug listener failed: %v", http.ListenAndServe(*debugAddr, nil)) }()
+	}
 
-		if *inspectStunPackets {
-			udpListener = &stunLogger{PacketConn: udpListener}
+	// Block until user sends SIGINT or SIGTERM, reload the users on SIGHUP.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			break
 		}
 
-		var relayAddressGenerator turn.RelayAddressGenerator
-
-		if *portRange == "" {
-			relayAddressGenerator = &turn.RelayAddressGeneratorStatic{
-				// Claim that we are listening on IP passed by user (This should be your Public IP)
-				RelayAddress: net.ParseIP(*publicIP),
-				// But actually be listening on every interface
-				Address: "0.0.0.0",
-			}
-		} else {
-			minPort, maxPort := SplitUint16(*portRange)
-			relayAddressGenerator = &turn.RelayAddressGeneratorPortRange{
-				// Claim that we are listening on IP passed by user (This should be your Public IP)
-				RelayAddress: net.ParseIP(*publicIP),
-				// But actually be listening on every interface
-				Address: "0.0.0.0",
-				MinPort: minPort,
-				MaxPort: maxPort,
-			}
+		c, err := config.Reload()
+		if err == nil {
+			resetFlags(set, explicit)
+			err = applyConfig(set, c.Turn, explicit)
 		}
-
-		packetConnConfigs = []turn.PacketConnConfig{{
-			PacketConn:            udpListener,
-			RelayAddressGenerator: relayAddressGenerator,
-		}}
+		if err != nil {
+			log.Printf("reload config failed, keeping the current one: %v", err)
+			continue
+		}
+		config = c
+		if staticUsers {
+			users.Set(parseTurnUsers(o.Users, serverRealm))
+		}
+		log.Printf("config reloaded")
 	}
 
-	// Cache -users flag for easy lookup later
-	// If passwords are stored they should be saved to your DB hashed using turn.GenerateAuthKey
-	usersMap := map[string][]byte{}
-	for _, kv := range regexp.MustCompile(`(\w+)=(\w+)`).FindAllStringSubmatch(*users, -1) {
-		usersMap[kv[1]] = turn.GenerateAuthKey(kv[1], *realm, kv[2])
+	if err = s.Close(); err != nil {
+		log.Panic(err)
 	}
+}
 
+// newTurnServer starts a TURN server, which answers STUN binding requests too.
+// The users are looked up in users if not nil, then the ephemeral credentials
+// are validated by the AuthSecret if any.
+func newTurnServer(o TurnOptions, users *TurnUsers) (*turn.Server, error) {
 	var authHandler turn.AuthHandler
 
-	if *authSecret != "" {
+	if o.AuthSecret != "" {
 		// NewLongTermAuthHandler takes a pion.LeveledLogger. This allows you to intercept messages
 		// and process them yourself.
 		logger := logging.NewDefaultLeveledLoggerForScope("longterm-creds", logging.LogLevelTrace, os.Stdout)
 		// Set AuthHandler callback
 		// This is called everytime a user tries to authenticate with the TURN server
 		// Return the key for that user, or false when no user is found
-		authHandler = turn.NewLongTermAuthHandler(*authSecret, logger)
-	} else {
-		authHandler = func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
-			key, ok := usersMap[username]
-			return key, ok
+		authHandler = turnRESTAuthHandler(o.AuthSecret, logger)
+	}
+	if users != nil {
+		authHandler = users.AuthHandler(authHandler)
+	}
+	if authHandler == nil {
+		return nil, errors.New("no TURN users nor secret")
+	}
+
+	// The accounting and the inspector watch the listeners and the relay sockets.
+	acct := NewTurnAccounting(o.UserLimits, o.TenantLimits, o.QuotaPeriod, o.MaxLifetime, authHandler)
+	insp, err := NewTurnInspector(o, authHandler)
+	if err != nil {
+		return nil, err
+	}
+
+	listeners, err := o.listeners()
+	if err != nil {
+		return nil, err
+	}
+
+	var packetConnConfigs []turn.PacketConnConfig
+	var listenerConfigs []turn.ListenerConfig
+	closeAll := func() {
+		for _, c := range packetConnConfigs {
+			_ = c.PacketConn.Close()
+		}
+		for _, c := range listenerConfigs {
+			_ = c.Listener.Close()
+		}
+	}
+	for _, c := range listeners {
+		// pion/turn itself doesn't allocate any sockets or listeners, but lets the user pass them in
+		// this allows us to add logging, storage or modify inbound/outbound traffic
+		pc, l, err := c.listen()
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("failed to create TURN server listener %s: %w", c, err)
+		}
+
+		relayAddressGenerator := &turnRelayGenerator{RelayAddressGenerator: o.relayGenerator(c), acct: acct, insp: insp}
+		if pc != nil {
+			packetConnConfigs = append(packetConnConfigs, turn.PacketConnConfig{
+				PacketConn:            &turnPacketConn{PacketConn: pc, acct: acct, insp: insp},
+				RelayAddressGenerator: relayAddressGenerator,
+			})
+		} else {
+			listenerConfigs = append(listenerConfigs, turn.ListenerConfig{
+				Listener:              &turnListener{Listener: l, acct: acct, insp: insp},
+				RelayAddressGenerator: relayAddressGenerator,
+			})
 		}
 	}
 
 	s, err := turn.NewServer(turn.ServerConfig{
-		Realm: *realm,
+		Realm: o.Realm,
 		// Set AuthHandler callback
 		// This is called everytime a user tries to authenticate with the TURN server
 		// Return the key for that user, or false when no user is found
-		AuthHandler: authHandler,
+		AuthHandler: countTurnAuth(authHandler),
 		// PacketConnConfigs is a list of UDP Listeners and the configuration around them
 		PacketConnConfigs: packetConnConfigs,
 		// ListenerConfig is a list of Listeners and the configuration around them
 		ListenerConfigs: listenerConfigs,
 	})
 	if err != nil {
-		log.Panic(err)
+		closeAll()
 	}
+	return s, err
+}
 
-	// Block until user sends SIGINT or SIGTERM
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	<-sigs
-
-	if err = s.Close(); err != nil {
-		log.Panic(err)
+// countTurnAuth counts the results of the TURN authentications in turnAuthCounter.
+func countTurnAuth(handler turn.AuthHandler) turn.AuthHandler {
+	return func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+		key, ok := handler(username, realm, srcAddr)
+		turnAuthCounter.WithLabelValues(util.If(ok, "success", "failure")).Inc()
+		return key, ok
 	}
 }
 
@@ -188,59 +291,3 @@ func SplitUint16(portRange string) (uint16, uint16) {
 	to, _ := strconv.ParseUint(portRange[idx+1:], 10, 16)
 	return uint16(from), uint16(to)
 }
-
-// stunLogger wraps a PacketConn and prints incoming/outgoing STUN packets
-// This pattern could be used to capture/inspect/modify data as well
-type stunLogger struct {
-	net.PacketConn
-}
-
-func (s *stunLogger) WriteTo(p []byte, addr net.Addr) (n int, err error) {
-	if n, err = s.PacketConn.WriteTo(p, addr); err == nil && stun.IsMessage(p) {
-		msg := &stun.Message{Raw: p}
-		if err = msg.Decode(); err != nil {
-			return
-		}
-
-		fmt.Printf("Outbound STUN: %s \n", msg.String())
-	}
-
-	return
-}
-
-func (s *stunLogger) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	if n, addr, err = s.PacketConn.ReadFrom(p); err == nil && stun.IsMessage(p) {
-		msg := &stun.Message{Raw: p}
-		if err = msg.Decode(); err != nil {
-			return
-		}
-
-		fmt.Printf("Inbound STUN: %s \n", msg.String())
-	}
-
-	return
-}
-
-// attributeAdder wraps a PacketConn and appends the SOFTWARE attribute to STUN packets
-// This pattern could be used to capture/inspect/modify data as well
-type attributeAdder struct {
-	net.PacketConn
-}
-
-func (s *attributeAdder) WriteTo(p []byte, addr net.Addr) (n int, err error) {
-	if stun.IsMessage(p) {
-		m := &stun.Message{Raw: p}
-		if err = m.Decode(); err != nil {
-			return
-		}
-
-		if err = stun.NewSoftware("CustomTURNServer").AddTo(m); err != nil {
-			return
-		}
-
-		m.Encode()
-		p = m.Raw
-	}
-
-	return s.PacketConn.WriteTo(p, addr)
-}
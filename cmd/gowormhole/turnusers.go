@@ -0,0 +1,490 @@
+package main
+
+// The users of the TURN server, kept in a JSON file of their keys, never their passwords:
+//
+//	{"users": [{"name": "scott", "realm": "example.com", "key": "<hex of turn.GenerateAuthKey>",
+//	            "disabled": false, "expires": "2026-01-02T15:04:05Z"}],
+//	 "revoked": {"1767366245:team-a": "2026-01-02T15:04:05Z"}}
+//
+// The key of a user is only valid in its realm, the realm of the server if
+// empty. The revoked ephemeral credentials are kept until they expire. The file
+// is reloaded when modified, and written by the users API of the turn command,
+// served on its -debug listener with -admin-token:
+//
+//	GET    /admin/api/users                   lists the users, without their keys
+//	POST   /admin/api/users                   adds or replaces a user, see turnUserRequest
+//	PATCH  /admin/api/users/{name}            disables, enables or expires a user, see turnUserPatch
+//	DELETE /admin/api/users/{name}            removes a user
+//	POST   /admin/api/credentials             issues ephemeral credentials, see turnCredentialRequest
+//	DELETE /admin/api/credentials/{username}  revokes ephemeral credentials until they expire
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/gg/pkg/ss"
+	"github.com/bingoohuang/gowormhole/internal/util"
+	"github.com/pion/turn/v2"
+)
+
+// ErrNoSuchTurnUser is returned when updating or removing an unknown TURN user.
+var ErrNoSuchTurnUser = errors.New("no such TURN user")
+
+// TurnUser is a user of the TURN server.
+type TurnUser struct {
+	Name string `json:"name"`
+	// Realm is the realm of the key, the realm of the server if empty.
+	Realm string `json:"realm,omitempty"`
+	// Key is the hex of turn.GenerateAuthKey(name, realm, password).
+	Key      string `json:"key,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+	// Expires is when the user expires, never if nil.
+	Expires *time.Time `json:"expires,omitempty"`
+
+	key []byte
+}
+
+// TurnUsers are the users of the TURN server, and the revoked ephemeral credentials.
+// They are kept in memory only without a file.
+type TurnUsers struct {
+	// Realm is the realm of the users without one.
+	Realm string
+
+	file    string
+	modTime time.Time
+	users   map[string]*TurnUser
+	revoked map[string]time.Time
+	lock    sync.RWMutex
+}
+
+// NewTurnUsers loads the users file, created empty if it doesn't exist.
+func NewTurnUsers(file, realm string) (*TurnUsers, error) {
+	s := &TurnUsers{Realm: realm, file: file, users: map[string]*TurnUser{}, revoked: map[string]time.Time{}}
+	if file == "" {
+		return s, nil
+	}
+	if _, err := os.Stat(file); errors.Is(err, os.ErrNotExist) {
+		s.lock.Lock()
+		err = s.save()
+		s.lock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// parseTurnUsers parses the list of user=pass into the users of realm, the
+// passwords may hold anything but commas.
+func parseTurnUsers(list, realm string) map[string]*TurnUser {
+	users := map[string]*TurnUser{}
+	for _, kv := range strings.Split(list, ",") {
+		name, password, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok || name == "" {
+			continue
+		}
+		key := turn.GenerateAuthKey(name, realm, password)
+		users[name] = &TurnUser{Name: name, Key: hex.EncodeToString(key), key: key}
+	}
+	return users
+}
+
+// Set replaces the users, e.g. by the ones of parseTurnUsers.
+func (s *TurnUsers) Set(users map[string]*TurnUser) {
+	s.lock.Lock()
+	s.users = users
+	s.lock.Unlock()
+}
+
+// Reload reloads the users file if it is modified, and reports whether it was.
+func (s *TurnUsers) Reload() (bool, error) {
+	stat, err := os.Stat(s.file)
+	if err != nil {
+		return false, err
+	}
+
+	s.lock.RLock()
+	modified := !stat.ModTime().Equal(s.modTime)
+	s.lock.RUnlock()
+	if !modified {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(s.file)
+	if err != nil {
+		return false, err
+	}
+
+	var f struct {
+		Users   []*TurnUser          `json:"users"`
+		Revoked map[string]time.Time `json:"revoked"`
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return false, fmt.Errorf("parse TURN users %s: %w", s.file, err)
+	}
+
+	users := make(map[string]*TurnUser, len(f.Users))
+	for _, u := range f.Users {
+		if u.key, err = hex.DecodeString(u.Key); err != nil || len(u.key) == 0 || u.Name == "" {
+			return false, fmt.Errorf("TURN users %s: bad user %q", s.file, u.Name)
+		}
+		users[u.Name] = u
+	}
+	if f.Revoked == nil {
+		f.Revoked = map[string]time.Time{}
+	}
+
+	s.lock.Lock()
+	s.users, s.revoked, s.modTime = users, f.Revoked, stat.ModTime()
+	s.lock.Unlock()
+	return true, nil
+}
+
+// Watch reloads the users file every interval until ctx is done.
+func (s *TurnUsers) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if ok, err := s.Reload(); err != nil {
+				log.Printf("reload TURN users failed: %v", err)
+			} else if ok {
+				log.Printf("TURN users %s reloaded", s.file)
+			}
+		}
+	}
+}
+
+// save writes the users file, under the write lock.
+func (s *TurnUsers) save() error {
+	if s.file == "" {
+		return nil
+	}
+
+	now := time.Now()
+	for username, expires := range s.revoked {
+		if !now.Before(expires) {
+			delete(s.revoked, username)
+		}
+	}
+	f := struct {
+		Users   []*TurnUser          `json:"users"`
+		Revoked map[string]time.Time `json:"revoked,omitempty"`
+	}{Users: s.list(), Revoked: s.revoked}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write a temporary file renamed over the file, not to reload it half written.
+	tmp, err := os.CreateTemp(filepath.Dir(s.file), filepath.Base(s.file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.file); err != nil {
+		return err
+	}
+	if stat, err := os.Stat(s.file); err == nil {
+		s.modTime = stat.ModTime()
+	}
+	return nil
+}
+
+// list returns the users sorted by name, under the lock.
+func (s *TurnUsers) list() []*TurnUser {
+	users := make([]*TurnUser, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+// List returns the users sorted by name, without their keys.
+func (s *TurnUsers) List() []TurnUser {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	users := make([]TurnUser, 0, len(s.users))
+	for _, u := range s.list() {
+		users = append(users, TurnUser{Name: u.Name, Realm: u.Realm, Disabled: u.Disabled, Expires: u.Expires})
+	}
+	return users
+}
+
+// Add adds or replaces the user name with password in realm, expiring after
+// ttl unless zero, and returns it.
+func (s *TurnUsers) Add(name, realm, password string, ttl time.Duration, disabled bool) (*TurnUser, error) {
+	if name == "" || strings.Contains(name, ",") {
+		return nil, fmt.Errorf("bad TURN user name %q", name)
+	}
+
+	key := turn.GenerateAuthKey(name, ss.Or(realm, s.Realm), password)
+	u := &TurnUser{Name: name, Realm: realm, Key: hex.EncodeToString(key), Disabled: disabled, key: key}
+	if ttl > 0 {
+		expires := time.Now().Add(ttl)
+		u.Expires = &expires
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.users[name] = u
+	return u, s.save()
+}
+
+// Update disables or enables the user name, and sets it to expire after ttl,
+// now if zero, unless they are nil.
+func (s *TurnUsers) Update(name string, disabled *bool, ttl *time.Duration) (*TurnUser, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	old, ok := s.users[name]
+	if !ok {
+		return nil, ErrNoSuchTurnUser
+	}
+	// The users are read without the lock by the lookups, so they are replaced.
+	u := *old
+	if disabled != nil {
+		u.Disabled = *disabled
+	}
+	if ttl != nil {
+		expires := time.Now().Add(*ttl)
+		u.Expires = &expires
+	}
+	s.users[name] = &u
+	return &u, s.save()
+}
+
+// Remove removes the user name.
+func (s *TurnUsers) Remove(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.users[name]; !ok {
+		return ErrNoSuchTurnUser
+	}
+	delete(s.users, name)
+	return s.save()
+}
+
+// Revoke revokes the ephemeral credentials of username until they expire.
+func (s *TurnUsers) Revoke(username string, expires time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.revoked[username] = expires
+	return s.save()
+}
+
+// lookup returns the key of the user username in realm, known tells whether
+// the user is in the users, valid or not.
+func (s *TurnUsers) lookup(username, realm string, now time.Time) (key []byte, known, ok bool) {
+	s.lock.RLock()
+	u, known := s.users[username]
+	s.lock.RUnlock()
+
+	switch {
+	case !known:
+		return nil, false, false
+	case u.Disabled, u.Expires != nil && !now.Before(*u.Expires), realm != ss.Or(u.Realm, s.Realm):
+		return nil, true, false
+	}
+	return u.key, true, true
+}
+
+// revokedCredentials tells whether the ephemeral credentials of username are revoked.
+func (s *TurnUsers) revokedCredentials(username string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	_, ok := s.revoked[username]
+	return ok
+}
+
+// AuthHandler returns the keys of the users, then of the ephemeral credentials
+// by next if not nil and not revoked.
+func (s *TurnUsers) AuthHandler(next turn.AuthHandler) turn.AuthHandler {
+	return func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+		if key, known, ok := s.lookup(username, realm, time.Now()); known {
+			return key, ok
+		}
+		if next == nil || s.revokedCredentials(username) {
+			return nil, false
+		}
+		return next(username, realm, srcAddr)
+	}
+}
+
+// turnUserRequest is the body of POST /admin/api/users. A random password is
+// generated and answered if Password is empty, and the user expires after TTL
+// unless zero.
+type turnUserRequest struct {
+	Name     string        `json:"name"`
+	Password string        `json:"password"`
+	Realm    string        `json:"realm"`
+	TTL      util.Duration `json:"ttl"`
+	Disabled bool          `json:"disabled"`
+}
+
+// turnUserPatch is the body of PATCH /admin/api/users/{name}, a TTL of 0 expires the user now.
+type turnUserPatch struct {
+	Disabled *bool          `json:"disabled"`
+	TTL      *util.Duration `json:"ttl"`
+}
+
+// turnCredentialRequest is the body of POST /admin/api/credentials, issuing
+// credentials of the tenant valid for TTL, defaultTurnCredTTL if zero.
+type turnCredentialRequest struct {
+	Tenant string        `json:"tenant"`
+	TTL    util.Duration `json:"ttl"`
+}
+
+// registerTurnAdmin registers the users API on mux, authenticated by token like
+// the admin API of the signalling server. The users API is registered only if
+// users is not nil, the ephemeral credentials are issued by secret, which may
+// be empty.
+func registerTurnAdmin(mux *http.ServeMux, token string, users *TurnUsers, secret string) {
+	if users != nil {
+		registerTurnUsersAdmin(mux, token, users)
+	}
+
+	mux.Handle("/admin/api/credentials", adminAuth(token, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if secret == "" {
+			adminError(w, http.StatusNotFound, "no ephemeral credentials without -authSecret")
+			return
+		}
+		var req turnCredentialRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			adminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		ttl := req.TTL.D()
+		if ttl <= 0 {
+			ttl = defaultTurnCredTTL
+		}
+		now := time.Now()
+		username, credential := turnCredentials(secret, ss.Or(req.Tenant, defaultTenant), ttl, now)
+		adminJSON(w, http.StatusCreated, map[string]interface{}{
+			"username": username, "credential": credential, "expires": now.Add(ttl).Truncate(time.Second),
+		})
+	})))
+
+	mux.Handle("/admin/api/credentials/", adminAuth(token, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		username := strings.TrimPrefix(r.URL.Path, "/admin/api/credentials/")
+		expiry, _, _ := strings.Cut(username, ":")
+		t, err := strconv.ParseInt(expiry, 10, 64)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, "bad ephemeral username")
+			return
+		}
+		if err := users.Revoke(username, time.Unix(t, 0)); err != nil {
+			adminError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})))
+}
+
+// registerTurnUsersAdmin registers the API managing the users on mux.
+func registerTurnUsersAdmin(mux *http.ServeMux, token string, users *TurnUsers) {
+	mux.Handle("/admin/api/users", adminAuth(token, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			adminJSON(w, http.StatusOK, users.List())
+		case http.MethodPost:
+			var req turnUserRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				adminError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			password := req.Password
+			if password == "" {
+				b := make([]byte, 18)
+				util.RandFull(b)
+				password = base64.RawURLEncoding.EncodeToString(b)
+			}
+			u, err := users.Add(req.Name, req.Realm, password, req.TTL.D(), req.Disabled)
+			if err != nil {
+				adminError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			result := map[string]interface{}{"name": u.Name, "realm": ss.Or(u.Realm, users.Realm), "expires": u.Expires}
+			if req.Password == "" {
+				result["password"] = password
+			}
+			adminJSON(w, http.StatusCreated, result)
+		default:
+			adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	})))
+
+	mux.Handle("/admin/api/users/", adminAuth(token, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/admin/api/users/")
+		var err error
+		switch r.Method {
+		case http.MethodPatch:
+			var req turnUserPatch
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				adminError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			var ttl *time.Duration
+			if req.TTL != nil {
+				d := req.TTL.D()
+				ttl = &d
+			}
+			var u *TurnUser
+			if u, err = users.Update(name, req.Disabled, ttl); err == nil {
+				adminJSON(w, http.StatusOK, TurnUser{Name: u.Name, Realm: u.Realm, Disabled: u.Disabled, Expires: u.Expires})
+				return
+			}
+		case http.MethodDelete:
+			if err = users.Remove(name); err == nil {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		default:
+			adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		adminError(w, util.If(errors.Is(err, ErrNoSuchTurnUser), http.StatusNotFound, http.StatusInternalServerError), err.Error())
+	})))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/turn/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTurnUsers(t *testing.T) {
+	users := parseTurnUsers("scott=tiger, bob=p@ss=w0rd!,broken", "example.com")
+	assert.Len(t, users, 2)
+	assert.Equal(t, turn.GenerateAuthKey("bob", "example.com", "p@ss=w0rd!"), users["bob"].key)
+}
+
+func TestTurnUsers(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users.json")
+	s, err := NewTurnUsers(file, "example.com")
+	assert.Nil(t, err)
+	handler := s.AuthHandler(turnRESTAuthHandler("secret", logging.NewDefaultLoggerFactory().NewLogger("test")))
+
+	_, err = s.Add("scott", "", "tiger!", 0, false)
+	assert.Nil(t, err)
+	_, err = s.Add("alice", "other.org", "secret", time.Hour, false)
+	assert.Nil(t, err)
+	data, err := os.ReadFile(file)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), "tiger")
+
+	key, ok := handler("scott", "example.com", nil)
+	assert.True(t, ok)
+	assert.Equal(t, turn.GenerateAuthKey("scott", "example.com", "tiger!"), key)
+	// The key of a user is only valid in its realm.
+	_, ok = handler("alice", "example.com", nil)
+	assert.False(t, ok)
+	_, ok = handler("alice", "other.org", nil)
+	assert.True(t, ok)
+
+	disabled, expired := true, time.Duration(0)
+	_, err = s.Update("scott", &disabled, nil)
+	assert.Nil(t, err)
+	_, ok = handler("scott", "example.com", nil)
+	assert.False(t, ok)
+	_, err = s.Update("alice", nil, &expired)
+	assert.Nil(t, err)
+	_, ok = handler("alice", "other.org", nil)
+	assert.False(t, ok)
+	assert.Equal(t, ErrNoSuchTurnUser, s.Remove("bob"))
+
+	// The ephemeral credentials are valid until revoked.
+	username, password := turnCredentials("secret", "team-a", time.Hour, time.Now())
+	key, ok = handler(username, "example.com", nil)
+	assert.True(t, ok)
+	assert.Equal(t, turn.GenerateAuthKey(username, "example.com", password), key)
+	assert.Nil(t, s.Revoke(username, time.Now().Add(time.Hour)))
+	_, ok = handler(username, "example.com", nil)
+	assert.False(t, ok)
+
+	// Another server sees the changes of the file.
+	other, err := NewTurnUsers(file, "example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []TurnUser{{Name: "alice", Realm: "other.org", Expires: other.List()[0].Expires}, {Name: "scott", Disabled: true}}, other.List())
+	assert.True(t, other.revokedCredentials(username))
+	assert.Nil(t, s.Remove("scott"))
+	// Both writes may fall in the same tick of the file times.
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(file, later, later))
+	reloaded, err := other.Reload()
+	assert.Nil(t, err)
+	assert.True(t, reloaded)
+	assert.Len(t, other.List(), 1)
+}
+
+func TestTurnUsersAPI(t *testing.T) {
+	s, err := NewTurnUsers("", "example.com")
+	assert.Nil(t, err)
+	mux := http.NewServeMux()
+	registerTurnAdmin(mux, "admin", s, "secret")
+	handler := s.AuthHandler(turnRESTAuthHandler("secret", logging.NewDefaultLoggerFactory().NewLogger("test")))
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request(http.MethodPost, "/admin/api/users", `{"name": "scott", "ttl": "1h"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var added struct {
+		Password string     `json:"password"`
+		Expires  *time.Time `json:"expires"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &added))
+	assert.NotEmpty(t, added.Password)
+	assert.NotNil(t, added.Expires)
+	key, ok := handler("scott", "example.com", nil)
+	assert.True(t, ok)
+	assert.Equal(t, turn.GenerateAuthKey("scott", "example.com", added.Password), key)
+
+	w = request(http.MethodGet, "/admin/api/users", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), `"key"`)
+
+	assert.Equal(t, http.StatusOK, request(http.MethodPatch, "/admin/api/users/scott", `{"disabled": true}`).Code)
+	_, ok = handler("scott", "example.com", nil)
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, "/admin/api/users/scott", "").Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, "/admin/api/users/scott", "").Code)
+
+	w = request(http.MethodPost, "/admin/api/credentials", `{"tenant": "team-a", "ttl": "10m"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var cred struct {
+		Username   string `json:"username"`
+		Credential string `json:"credential"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &cred))
+	assert.True(t, strings.HasSuffix(cred.Username, ":team-a"))
+	_, ok = handler(cred.Username, "example.com", nil)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, "/admin/api/credentials/"+cred.Username, "").Code)
+	_, ok = handler(cred.Username, "example.com", nil)
+	assert.False(t, ok)
+
+	r := httptest.NewRequest(http.MethodGet, "/admin/api/users", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bingoohuang/gg/pkg/backoff"
+	"github.com/bingoohuang/gowormhole/internal/util"
+	"github.com/bingoohuang/gowormhole/wormhole"
+)
+
+// The events posted to the webhooks.
+const (
+	// EventSlotReserved is posted when a code is reserved.
+	EventSlotReserved = "slot.reserved"
+	// EventPeerJoined is posted when a peer joins a slot, with its mode.
+	EventPeerJoined = "peer.joined"
+	// EventKeyMismatch is posted when the peers used different passwords.
+	EventKeyMismatch = "key.mismatch"
+	// EventWebRTCSuccess is posted when the peers connected, with the method.
+	EventWebRTCSuccess = "webrtc.success"
+	// EventSlotExpired is posted when a slot outlives its TTL before the peers paired.
+	EventSlotExpired = "slot.expired"
+)
+
+const (
+	// WebhookSignatureHeader carries the signature of a webhook:
+	// t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>" by the secret of the target>.
+	WebhookSignatureHeader = "GoWormhole-Signature"
+	// WebhookEventHeader carries the event of a webhook.
+	WebhookEventHeader = "GoWormhole-Event"
+
+	webhookQueueSize = 1024
+	webhookWorkers   = 4
+	// defaultWebhookRetry is how long a failing delivery is retried.
+	defaultWebhookRetry = 10 * time.Minute
+)
+
+// WebhookTarget is a URL the events are posted to.
+type WebhookTarget struct {
+	URL string `json:"url"`
+	// Secret signs the events, they are not signed if empty.
+	Secret string `json:"secret,omitempty"`
+}
+
+// WebhookEvent is the body of a webhook.
+type WebhookEvent struct {
+	// ID identifies the event, the same on the retries of a delivery.
+	ID     string    `json:"id"`
+	Event  string    `json:"event"`
+	Time   time.Time `json:"time"`
+	SlotID uint64    `json:"slotId"`
+	Slot   string    `json:"slot"`
+	Tenant string    `json:"tenant"`
+	// Mode is the mode of the slot once joined or expired: reserved, peer1 or peer2.
+	Mode string `json:"mode,omitempty"`
+	// Method is direct, relay or unknown on webrtc.success.
+	Method string `json:"method,omitempty"`
+	// Expires is when a reserved slot expires.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+type webhookDelivery struct {
+	target  WebhookTarget
+	event   string
+	body    []byte
+	backoff backoff.BackOff
+	attempt int
+}
+
+// Webhooks posts the events of the slots to the targets of the server and of
+// their tenant in the background, retrying with exponential backoff.
+type Webhooks struct {
+	// Targets receive the events of all the tenants.
+	Targets []WebhookTarget
+	// Retry is how long a failing delivery is retried.
+	Retry time.Duration
+
+	client *http.Client
+	queue  chan *webhookDelivery
+	done   chan struct{}
+	closed bool
+	lock   sync.RWMutex
+	wg     sync.WaitGroup
+}
+
+// webhooks posts the events of the signalling server, nil when not serving.
+var webhooks *Webhooks
+
+// parseWebhookTargets parses the comma separated list of webhook URLs, all signed by secret.
+func parseWebhookTargets(list, secret string) (targets []WebhookTarget, err error) {
+	for _, u := range strings.Split(list, ",") {
+		if u = strings.TrimSpace(u); u == "" {
+			continue
+		}
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return nil, fmt.Errorf("bad webhook URL %q", u)
+		}
+		targets = append(targets, WebhookTarget{URL: u, Secret: secret})
+	}
+	return targets, nil
+}
+
+// NewWebhooks creates and starts the webhooks.
+func NewWebhooks(targets []WebhookTarget, retry time.Duration) *Webhooks {
+	w := &Webhooks{
+		Targets: targets,
+		Retry:   retry,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan *webhookDelivery, webhookQueueSize),
+		done:    make(chan struct{}),
+	}
+	for i := 0; i < webhookWorkers; i++ {
+		w.wg.Add(1)
+		go w.run()
+	}
+	return w
+}
+
+// Emit queues the event of the slot to the targets of the server and of the
+// tenant of the slot, it never blocks.
+func (w *Webhooks) Emit(event string, item *SlotItem, set func(e *WebhookEvent)) {
+	if w == nil {
+		return
+	}
+	targets := w.Targets
+	if item.Tenant != nil {
+		targets = append(targets[:len(targets):len(targets)], item.Tenant.Webhooks...)
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	id := make([]byte, 12)
+	util.RandFull(id)
+	e := WebhookEvent{
+		ID:     base64.RawURLEncoding.EncodeToString(id),
+		Event:  event,
+		Time:   time.Now(),
+		SlotID: item.ID,
+		Slot:   item.SlotKey,
+		Tenant: item.Tenant.Label(),
+	}
+	if set != nil {
+		set(&e)
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("marshal webhook event failed: %v", err)
+		return
+	}
+
+	for _, t := range targets {
+		b := &backoff.ExponentialBackOff{
+			InitialInterval:     time.Second,
+			RandomizationFactor: backoff.DefaultRandomizationFactor,
+			Multiplier:          2,
+			MaxInterval:         time.Minute,
+			MaxElapsedTime:      w.Retry,
+			Stop:                backoff.Stop,
+			Clock:               backoff.SystemClock,
+		}
+		b.Reset()
+		w.enqueue(&webhookDelivery{target: t, event: event, body: body, backoff: b})
+	}
+}
+
+func (w *Webhooks) enqueue(d *webhookDelivery) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	if w.closed {
+		webhookCounter.WithLabelValues("dropped").Inc()
+		return
+	}
+	select {
+	case w.queue <- d:
+	default:
+		webhookCounter.WithLabelValues("dropped").Inc()
+		log.Printf("webhook queue full, dropped %s to %s", d.event, d.target.URL)
+	}
+}
+
+func (w *Webhooks) run() {
+	defer w.wg.Done()
+
+	for d := range w.queue {
+		err := w.post(d)
+		if err == nil {
+			webhookCounter.WithLabelValues("delivered").Inc()
+			continue
+		}
+
+		next := d.backoff.NextBackOff()
+		if next == backoff.Stop {
+			webhookCounter.WithLabelValues("failed").Inc()
+			log.Printf("webhook %s to %s failed after %d attempts: %v", d.event, d.target.URL, d.attempt, err)
+			continue
+		}
+		webhookCounter.WithLabelValues("retried").Inc()
+		// Retry later, without holding a worker meanwhile.
+		time.AfterFunc(next, func() {
+			select {
+			case <-w.done:
+				webhookCounter.WithLabelValues("dropped").Inc()
+			default:
+				w.enqueue(d)
+			}
+		})
+	}
+}
+
+func (w *Webhooks) post(d *webhookDelivery) error {
+	d.attempt++
+	req, err := http.NewRequest(http.MethodPost, d.target.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, d.event)
+	if d.target.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, signWebhook(d.target.Secret, time.Now(), d.body))
+	}
+
+	rsp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, rsp.Body)
+	if rsp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s: %s", d.target.URL, rsp.Status)
+	}
+	return nil
+}
+
+// signWebhook returns the signature header of the body sent at t.
+func signWebhook(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks the signature header of a webhook body by the secret,
+// rejecting the ones signed more than tolerance ago, for the receivers in Go.
+func VerifyWebhook(secret, header string, body []byte, tolerance time.Duration, now time.Time) bool {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(part, "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sig = v
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || now.Sub(time.Unix(unix, 0)) > tolerance {
+		return false
+	}
+	want := signWebhook(secret, time.Unix(unix, 0), body)
+	return hmac.Equal([]byte(want), []byte("t="+ts+",v1="+sig))
+}
+
+// Close stops the webhooks, the queued deliveries are attempted but not retried.
+func (w *Webhooks) Close() {
+	if w == nil {
+		return
+	}
+
+	w.lock.Lock()
+	w.closed = true
+	close(w.done)
+	close(w.queue)
+	w.lock.Unlock()
+
+	w.wg.Wait()
+}
+
+// webrtcMethod returns the method of a WebRTC success outcome.
+func webrtcMethod(outcome string) string {
+	return util.If(outcome == "success", "unknown", outcome)
+}
+
+// modeName returns the name of the mode of a slot in the events.
+func modeName(mode wormhole.SlotItemMode) string {
+	switch mode {
+	case wormhole.ModeNone:
+		return "reserved"
+	case wormhole.ModePeer1:
+		return "peer1"
+	default:
+		return "peer2"
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{"event":"slot.reserved"}`)
+	sig := signWebhook("secret", now, body)
+
+	assert.True(t, VerifyWebhook("secret", sig, body, time.Minute, now))
+	assert.False(t, VerifyWebhook("other", sig, body, time.Minute, now))
+	assert.False(t, VerifyWebhook("secret", sig, []byte(`{}`), time.Minute, now))
+	assert.False(t, VerifyWebhook("secret", sig, body, time.Minute, now.Add(2*time.Minute)))
+}
+
+func TestWebhooksRetryAndTenantTargets(t *testing.T) {
+	var calls atomic.Int32
+	events := make(chan WebhookEvent, 4)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !VerifyWebhook("tenant-secret", r.Header.Get(WebhookSignatureHeader), body, time.Minute, time.Now()) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		// Fail the first attempt.
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e WebhookEvent
+		_ = json.Unmarshal(body, &e)
+		events <- e
+	}))
+	defer s.Close()
+
+	w := NewWebhooks(nil, time.Minute)
+	defer w.Close()
+	webhooks = w
+	defer func() { webhooks = nil }()
+
+	tenant := &Tenant{Name: "hooked", Webhooks: []WebhookTarget{{URL: s.URL, Secret: "tenant-secret"}}}
+	sl := NewSlots(SlotTTLs{Reserved: time.Minute, Waiting: time.Hour, Expired: time.Hour})
+	item, err := sl.Reserve(tenant, "", 0)
+	assert.Nil(t, err)
+	// Other tenants don't go to the tenant's targets.
+	_, err = sl.Reserve(nil, "", 0)
+	assert.Nil(t, err)
+
+	select {
+	case e := <-events:
+		assert.Equal(t, EventSlotReserved, e.Event)
+		assert.Equal(t, item.SlotKey, e.Slot)
+		assert.Equal(t, "hooked", e.Tenant)
+		assert.NotNil(t, e.Expires)
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not retried")
+	}
+	assert.Equal(t, int32(2), calls.Load())
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bingoohuang/gowormhole"
+)
+
+const (
+	// webIndexTemplate is the optional template of index.html in the web directory.
+	webIndexTemplate = "index.html.tmpl"
+	// webGzipMinSize is the min size of the assets worth compressing.
+	webGzipMinSize = 1 << 10
+)
+
+// webAsset is a file of the web UI, loaded in memory with its precompressed variants.
+type webAsset struct {
+	name    string
+	content []byte
+	gz, br  []byte
+	hash    string
+	modTime time.Time
+}
+
+// WebIndex is the data of the template of index.html.
+type WebIndex struct {
+	ServerName  string
+	StunServers []string
+	TurnServers []string
+}
+
+// WebSite serves the web UI, the embedded one overlaid or replaced by a directory.
+//
+// Each asset is also served under a content-hashed name, e.g. main.0123456789.js
+// for main.js, cached as immutable. The plain names are revalidated by ETag. The
+// .br and .gz variants of the files are served to the clients accepting them,
+// and the compressible files without a .gz variant are gzipped on load.
+type WebSite struct {
+	assets map[string]*webAsset
+	hashed map[string]*webAsset
+	index  *template.Template
+	data   WebIndex
+}
+
+// NewWebSite loads the web UI, from the embedded one overlaid by the files of
+// dir, or from dir only if replace.
+func NewWebSite(dir string, replace bool, data WebIndex) (*WebSite, error) {
+	var layers []fs.FS
+	if dir == "" || !replace {
+		layers = append(layers, gowormhole.Web)
+	}
+	if dir != "" {
+		if _, err := os.Stat(dir); err != nil {
+			return nil, err
+		}
+		layers = append(layers, os.DirFS(dir))
+	}
+
+	files := make(map[string]*webAsset)
+	for _, layer := range layers {
+		if err := loadWebFiles(layer, files); err != nil {
+			return nil, err
+		}
+		// An index.html overlaid without its template replaces the template below.
+		if _, err := fs.Stat(layer, webIndexTemplate); err != nil {
+			if _, err := fs.Stat(layer, "index.html"); err == nil {
+				delete(files, webIndexTemplate)
+			}
+		}
+	}
+
+	s := &WebSite{assets: make(map[string]*webAsset), hashed: make(map[string]*webAsset), data: data}
+	for name, a := range files {
+		switch {
+		case name == webIndexTemplate:
+			continue
+		case strings.HasSuffix(name, ".br") && files[strings.TrimSuffix(name, ".br")] != nil:
+			continue
+		case strings.HasSuffix(name, ".gz") && files[strings.TrimSuffix(name, ".gz")] != nil:
+			continue
+		}
+		if v := files[name+".br"]; v != nil {
+			a.br = v.content
+		}
+		if v := files[name+".gz"]; v != nil {
+			a.gz = v.content
+		} else if len(a.content) >= webGzipMinSize && compressible(name) {
+			a.gz = gzipBytes(a.content)
+		}
+		sum := sha256.Sum256(a.content)
+		a.hash = hex.EncodeToString(sum[:5])
+		s.assets[name] = a
+		s.hashed[hashedName(name, a.hash)] = a
+	}
+
+	if t := files[webIndexTemplate]; t != nil {
+		index, err := template.New(webIndexTemplate).Funcs(template.FuncMap{"asset": s.Asset}).Parse(string(t.content))
+		if err != nil {
+			return nil, err
+		}
+		s.index = index
+	}
+	return s, nil
+}
+
+func loadWebFiles(fsys fs.FS, files map[string]*webAsset) error {
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[name] = &webAsset{name: name, content: content, modTime: info.ModTime()}
+		return nil
+	})
+}
+
+// Asset returns the content-hashed name of the asset, or the name itself if there is no such asset.
+func (s *WebSite) Asset(name string) string {
+	if a := s.assets[strings.TrimPrefix(name, "/")]; a != nil {
+		return hashedName(name, a.hash)
+	}
+	return name
+}
+
+func hashedName(name, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+func (s *WebSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+	if name == "" {
+		name = "index.html"
+	}
+
+	if name == "index.html" && s.index != nil {
+		var b bytes.Buffer
+		if err := s.index.Execute(&b, s.data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(b.Bytes()))
+		return
+	}
+
+	a, immutable := s.hashed[name], true
+	if a == nil {
+		a, immutable = s.assets[name], false
+	}
+	if a == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if immutable {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	if ctype := mime.TypeByExtension(path.Ext(a.name)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+
+	content, etag := a.content, a.hash
+	if a.br != nil || a.gz != nil {
+		w.Header().Add("Vary", "Accept-Encoding")
+		switch accepts := r.Header.Get("Accept-Encoding"); {
+		case a.br != nil && acceptsEncoding(accepts, "br"):
+			content, etag = a.br, etag+"-br"
+			w.Header().Set("Content-Encoding", "br")
+		case a.gz != nil && acceptsEncoding(accepts, "gzip"):
+			content, etag = a.gz, etag+"-gz"
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+	http.ServeContent(w, r, a.name, a.modTime, bytes.NewReader(content))
+}
+
+// acceptsEncoding tells if the Accept-Encoding header accepts the coding, ignoring the other q values than 0.
+func acceptsEncoding(header, coding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		c, params, _ := strings.Cut(part, ";")
+		if strings.EqualFold(strings.TrimSpace(c), coding) {
+			q := strings.ReplaceAll(params, " ", "")
+			return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+		}
+	}
+	return false
+}
+
+func compressible(name string) bool {
+	switch path.Ext(name) {
+	case ".html", ".js", ".css", ".svg", ".json", ".wasm", ".ts", ".go", ".txt", ".map":
+		return true
+	}
+	return false
+}
+
+func gzipBytes(p []byte) []byte {
+	var b bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&b, gzip.BestCompression)
+	_, _ = zw.Write(p)
+	_ = zw.Close()
+	return b.Bytes()
+}
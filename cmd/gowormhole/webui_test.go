@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func serveWeb(s *WebSite, path string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestWebSiteOverlay(t *testing.T) {
+	dir := t.TempDir()
+	css := strings.Repeat("body { color: red; }\n", 100)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "style.css"), []byte(css), 0o644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "style.css.br"), []byte("brotli"), 0o644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, webIndexTemplate),
+		[]byte(`<title>{{.ServerName}}</title><link href="{{asset "style.css"}}">{{range .StunServers}}<i>{{.}}</i>{{end}}`), 0o644))
+
+	s, err := NewWebSite(dir, false, WebIndex{ServerName: "Acme <Wormhole>", StunServers: []string{"stun:stun.example.com:3478"}})
+	assert.Nil(t, err)
+
+	// The overlay wins, served precompressed under a content-hashed name.
+	hashed := s.Asset("style.css")
+	assert.NotEqual(t, "style.css", hashed)
+	w := serveWeb(s, "/"+hashed, "Accept-Encoding", "gzip, br")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "br", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "brotli", w.Body.String())
+	assert.Contains(t, w.Header().Get("Cache-Control"), "immutable")
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+
+	w = serveWeb(s, "/style.css", "Accept-Encoding", "gzip, br;q=0")
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+
+	w = serveWeb(s, "/style.css")
+	assert.Equal(t, css, w.Body.String())
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/css"))
+	w = serveWeb(s, "/style.css", "If-None-Match", w.Header().Get("ETag"))
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	// The embedded files are still there.
+	assert.Equal(t, http.StatusOK, serveWeb(s, "/icon.svg").Code)
+	assert.Equal(t, http.StatusNotFound, serveWeb(s, "/style.css.br").Code)
+	assert.Equal(t, http.StatusNotFound, serveWeb(s, "/"+webIndexTemplate).Code)
+
+	w = serveWeb(s, "/")
+	assert.Equal(t, `<title>Acme &lt;Wormhole&gt;</title><link href="`+hashed+`"><i>stun:stun.example.com:3478</i>`, w.Body.String())
+}
+
+func TestWebSiteReplace(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte("hotfix"), 0o644))
+
+	s, err := NewWebSite(dir, true, WebIndex{})
+	assert.Nil(t, err)
+	assert.Equal(t, "hotfix", serveWeb(s, "/").Body.String())
+	assert.Equal(t, http.StatusNotFound, serveWeb(s, "/icon.svg").Code)
+
+	_, err = NewWebSite(filepath.Join(dir, "missing"), false, WebIndex{})
+	assert.NotNil(t, err)
+}
+
+func TestWebSiteEmbeddedHashedAssets(t *testing.T) {
+	s, err := NewWebSite("", false, WebIndex{})
+	assert.Nil(t, err)
+
+	index := serveWeb(s, "/").Body.String()
+	for _, name := range []string{"main.js", "ww.js", "style.css"} {
+		hashed := s.Asset(name)
+		assert.NotEqual(t, name, hashed)
+		assert.Contains(t, index, `"`+hashed+`"`)
+		assert.Contains(t, serveWeb(s, "/"+hashed).Header().Get("Cache-Control"), "immutable")
+	}
+
+	// An overlaid index.html wins over the embedded template.
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte("hotfix"), 0o644))
+	s, err = NewWebSite(dir, false, WebIndex{})
+	assert.Nil(t, err)
+	assert.Equal(t, "hotfix", serveWeb(s, "/").Body.String())
+}
@@ -8,7 +8,6 @@ go 1.19
 
 require (
 	filippo.io/cpace v0.0.0-20210101143347-24d601e2e469
-	github.com/NYTimes/gziphandler v1.1.1
 	github.com/OneOfOne/xxhash v1.2.2
 	github.com/bingoohuang/gg v0.0.0-20221013063601-18ab764eda41
 	github.com/bingoohuang/godaemon v0.0.0-20221104024058-3bf8b9130635
@@ -17,14 +16,18 @@ require (
 	github.com/bingoohuang/pb v0.0.0-20221013134435-b2ba3ccc5001
 	github.com/go-playground/assert/v2 v2.0.1
 	github.com/go-resty/resty/v2 v2.7.0
+	github.com/pion/dtls/v2 v2.1.5
 	github.com/pion/logging v0.2.2
 	github.com/pion/stun v0.3.6-0.20220524134636-7e647ef6201c
 	github.com/pion/turn/v2 v2.0.8
+	github.com/pion/udp v0.1.1
 	github.com/pion/webrtc/v3 v3.1.47
 	github.com/prometheus/client_golang v1.13.0
+	github.com/sirupsen/logrus v1.8.1
 	github.com/stretchr/testify v1.8.0
 	golang.org/x/crypto v0.0.0-20221012134737-56aed061732a
 	golang.org/x/net v0.4.0
+	gopkg.in/yaml.v3 v3.0.1
 	nhooyr.io/websocket v1.8.7
 	rsc.io/qr v0.2.0
 )
@@ -51,7 +54,6 @@ require (
 	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/pbnjay/pixfont v0.0.0-20200714042608-33b744692567 // indirect
 	github.com/pion/datachannel v1.5.2 // indirect
-	github.com/pion/dtls/v2 v2.1.5 // indirect
 	github.com/pion/ice/v2 v2.2.11 // indirect
 	github.com/pion/interceptor v0.1.11 // indirect
 	github.com/pion/mdns v0.0.5 // indirect
@@ -62,7 +64,6 @@ require (
 	github.com/pion/sdp/v3 v3.0.6 // indirect
 	github.com/pion/srtp/v2 v2.0.10 // indirect
 	github.com/pion/transport v0.13.1 // indirect
-	github.com/pion/udp v0.1.1 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/prometheus/client_model v0.2.0 // indirect
@@ -70,10 +71,8 @@ require (
 	github.com/prometheus/procfs v0.8.0 // indirect
 	github.com/rivo/uniseg v0.2.0 // indirect
 	github.com/rogpeppe/go-internal v1.9.0 // indirect
-	github.com/sirupsen/logrus v1.8.1 // indirect
 	golang.org/x/sys v0.3.0 // indirect
 	golang.org/x/term v0.3.0 // indirect
 	golang.org/x/text v0.5.0 // indirect
 	google.golang.org/protobuf v1.28.1 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/url"
 	"os"
 	"strconv"
@@ -111,12 +112,16 @@ func Prefix(prefix, addr string) string {
 // e.g. AppendPort(`124.223.81.61:3478?transport=udp`, 3478) => 124.223.81.61:3478?transport=udp
 // e.g. AppendPort(`124.223.81.61?transport=udp`, 3478)      => 124.223.81.61:3478?transport=udp
 // e.g. AppendPort(`124.223.81.61`, 3478)                    => 124.223.81.61:3478
+// e.g. AppendPort(`124.223.81.61:5349`, 3478)               => 124.223.81.61:5349
 func AppendPort(addr string, defaultPort int) string {
 	query := ""
 	if p := strings.Index(addr, "?"); p >= 0 {
 		query = addr[p:]
 		addr = addr[:p]
 	}
+	if _, _, err := net.SplitHostPort(strings.TrimPrefix(strings.TrimPrefix(addr, "turn:"), "stun:")); err == nil {
+		return addr + query
+	}
 	port := fmt.Sprintf(":%d", defaultPort)
 	return Postfix(addr, port) + query
 }
@@ -565,7 +565,7 @@ function codechange() {
     }
 }
 function autocompletehint() {
-    const words = phraseInput.value.split("-");
+    const words = phraseInput.value.split(/[-+]/);
     const prefix = words[words.length - 1];
     const hint = webwormhole.match(prefix);
     autocompleteBox.innerText = hint;
@@ -574,7 +574,7 @@ function autocomplete(e) {
     // TODO more stateful autocomplete, i.e. repeated tabs cycle through matches.
     if (e.keyCode === 9) {
         e.preventDefault(); // Prevent tabs from doing tab things.
-        const words = phraseInput.value.split("-");
+        const words = phraseInput.value.split(/[-+]/);
         const prefix = words[words.length - 1];
         const hint = webwormhole.match(prefix);
         if (hint === "") {
@@ -140,22 +140,26 @@ func qrencode(_ js.Value, args []js.Value) interface{} {
 	return dst
 }
 
-// encode(int, uint8array) (string)
+// encode(string|int, uint8array) (string)
 func encode(_ js.Value, args []js.Value) interface{} {
-	slot := args[0].Int()
+	// The slot is a number, or a string holding a number or the name of a room.
+	slot := args[0].String()
+	if args[0].Type() == js.TypeNumber {
+		slot = strconv.Itoa(args[0].Int())
+	}
 	pass := make([]byte, args[1].Length())
 	js.CopyBytesToGo(pass, args[1])
-	return wordlist.Encode(slot, pass)
+	return wordlist.EncodeSlot(slot, pass)
 }
 
-// decode(string) (int, uint8array)
+// decode(string) (string, uint8array)
 func decode(_ js.Value, args []js.Value) interface{} {
 	code := args[0].String()
-	slot, pass := wordlist.Decode(code)
+	slot, pass := wordlist.DecodeSlot(code)
 	dst := js.Global().Get("Uint8Array").New(len(pass))
 	js.CopyBytesToJS(dst, pass)
 	return []interface{}{
-		strconv.Itoa(slot),
+		slot,
 		dst,
 	}
 }
@@ -50,12 +50,13 @@ class Wormhole {
     async statePlayer1(data) {
         const msg = JSON.parse(data);
         console.log("assigned slot:", msg.slot);
-        this.slot = parseInt(msg.slot, 10);
-        if (!Number.isSafeInteger(this.slot)) {
+        this.slot = msg.slot;
+        const code = webwormhole.encode(this.slot, this.pass);
+        if (code === "") {
             return this.fail("invalid slot");
         }
         this.pc = this.makePeerConnection(msg.iceServers);
-        this.callback(this.pc, webwormhole.encode(this.slot, this.pass));
+        this.callback(this.pc, code);
         return this.stateWaitForPAKEA;
     }
     async statePlayer2(data) {
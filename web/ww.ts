@@ -3,8 +3,8 @@
 
 // Declare WASM symbols.
 declare var webwormhole: {
-	decode(code: string): [number, Uint8Array];
-	encode(slot: number, pass: Uint8Array): string;
+	decode(code: string): [string, Uint8Array];
+	encode(slot: string | number, pass: Uint8Array): string;
 	start(pass: Uint8Array): string;
 	exchange(pass: Uint8Array, msg: string): [Uint8Array, string];
 	finish(msg: string): Uint8Array;
@@ -44,7 +44,8 @@ class Wormhole {
 
 	pass: Uint8Array;
 	signalserver: string;
-	slot?: number;
+	// slot is the number of the slot, or the name of a room.
+	slot?: string;
 	pc?: RTCPeerConnection;
 	ws?: WebSocket;
 	key?: Uint8Array;
@@ -92,12 +93,13 @@ class Wormhole {
 		const msg: { slot: string; iceServers: RTCIceServer[] } = JSON.parse(data);
 
 		console.log("assigned slot:", msg.slot);
-		this.slot = parseInt(msg.slot, 10);
-		if (!Number.isSafeInteger(this.slot)) {
+		this.slot = msg.slot;
+		const code = webwormhole.encode(this.slot, this.pass);
+		if (code === "") {
 			return this.fail("invalid slot");
 		}
 		this.pc = this.makePeerConnection(msg.iceServers);
-		this.callback(this.pc, webwormhole.encode(this.slot, this.pass));
+		this.callback(this.pc, code);
 		return this.stateWaitForPAKEA;
 	}
 
@@ -407,7 +409,7 @@ class Wormhole {
 	}
 
 	// wsserver creates a WebSocket scheme (ws: or wss:) URL from an HTTP one.
-	static wsserver(url: string, slot?: number) {
+	static wsserver(url: string, slot?: string) {
 		const u = new URL(url);
 		let protocol = "wss:";
 		if (u.protocol === "http:") {
@@ -33,6 +33,76 @@ func Decode(code string) (slot int, pass []byte) {
 	return 0, nil
 }
 
+// NameSep separates the name of a named slot from the words of the password in
+// its codes, e.g. build-farm+acorn-acre.
+const NameSep = "+"
+
+// ValidName tells if name is a valid name of a slot: 2 to 32 lowercase letters,
+// digits and -, starting with a letter and not ending with -.
+func ValidName(name string) bool {
+	if len(name) < 2 || len(name) > 32 || name[0] < 'a' || name[0] > 'z' || name[len(name)-1] == '-' {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// EncodeNamed returns the code of the named slot and pass, the name followed by
+// NameSep and a word for each byte of pass. It returns the empty string if name
+// is not valid.
+func EncodeNamed(name string, pass []byte) string {
+	if !ValidName(name) || len(pass) == 0 {
+		return ""
+	}
+	words := make([]string, len(pass))
+	for i := range pass {
+		words[i] = enWords[int(pass[i])*2+i%2]
+	}
+	return name + NameSep + strings.Join(words, "-")
+}
+
+// DecodeNamed returns the name and pass encoded by a code of EncodeNamed, trying
+// all supported word lists. Invalid codes return an empty name and a nil pass.
+func DecodeNamed(code string) (name string, pass []byte) {
+	name, words, ok := strings.Cut(strings.TrimSpace(code), NameSep)
+	if !ok || strings.Contains(words, NameSep) || !ValidName(name) {
+		return "", nil
+	}
+	for _, list := range [][]string{enWords, pgpWords} {
+		// The words of the password are the ones of a numeric code after its slot.
+		if _, p := magicWormholeEncoding(list).Decode("0-" + words); p != nil {
+			return name, p
+		}
+	}
+	return "", nil
+}
+
+// EncodeSlot returns the code of slot and pass, slot being either a number or a name.
+func EncodeSlot(slot string, pass []byte) string {
+	if n, err := strconv.Atoi(slot); err == nil && n >= 0 {
+		return Encode(n, pass)
+	}
+	return EncodeNamed(slot, pass)
+}
+
+// DecodeSlot returns the slot, a number or a name, and the pass encoded by code.
+// Invalid codes return an empty slot and a nil pass.
+func DecodeSlot(code string) (slot string, pass []byte) {
+	// The parity of the first word of the password tells the named codes from the
+	// numeric ones whose first separator became a + in a URL.
+	if name, p := DecodeNamed(code); p != nil {
+		return name, p
+	}
+	if n, p := Decode(code); p != nil {
+		return strconv.Itoa(n), p
+	}
+	return "", nil
+}
+
 // Match returns the first word in the word list that has prefix prefix, trying all
 // supported word lists the default order. It returns the empty string if none match.
 func Match(prefix string) string {
@@ -55,3 +55,43 @@ func TestMatch(t *testing.T) {
 		}
 	}
 }
+
+func TestNamedEncodeDecode(t *testing.T) {
+	cases := []struct {
+		slot string
+		pass []byte
+		code string
+	}{
+		{"build-farm", []byte{0, 0}, "build-farm+acorn-acre"},
+		{"b2", []byte{8}, "b2+aloe"},
+		{"2", []byte{0}, "affix-acre"},
+		{"Build", []byte{0}, ""},
+		{"build-", []byte{0}, ""},
+		{"build-farm", nil, ""},
+	}
+	for i, c := range cases {
+		if code := EncodeSlot(c.slot, c.pass); code != c.code {
+			t.Errorf("encode testcase %v got %v want %v", i, code, c.code)
+		}
+	}
+	for i, c := range cases {
+		if c.code == "" {
+			continue
+		}
+		if slot, pass := DecodeSlot(c.code); slot != c.slot || !reflect.DeepEqual(pass, c.pass) {
+			t.Errorf("decode testcase %v got %v,%v want %v,%v", i, slot, pass, c.slot, c.pass)
+		}
+	}
+
+	// Numeric codes whose first - became a + in a URL are not named ones.
+	if slot, pass := DecodeSlot("affix+acre"); slot != "2" || !reflect.DeepEqual(pass, []byte{0}) {
+		t.Errorf("decode affix+acre got %v,%v", slot, pass)
+	}
+	// PGP words are accepted too.
+	if slot, pass := DecodeSlot("room+aardvark-adroitness"); slot != "room" || !reflect.DeepEqual(pass, []byte{0, 0}) {
+		t.Errorf("decode pgp got %v,%v", slot, pass)
+	}
+	if slot, pass := DecodeSlot("room+acre+acorn"); slot != "" || pass != nil {
+		t.Errorf("decode two separators got %v,%v", slot, pass)
+	}
+}
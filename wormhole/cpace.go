@@ -10,7 +10,7 @@ import (
 	"nhooyr.io/websocket"
 )
 
-func exchangeKeySideA(ctx context.Context, ws *websocket.Conn, pass string) (key *[32]byte, err error) {
+func exchangeKeySideA(ctx context.Context, ws signalConn, pass string) (key *[32]byte, err error) {
 	// The identity arguments are to bind endpoint identities in PAKE. Cf. Unknown
 	// Key-Share Attack. https://tools.ietf.org/html/draft-ietf-mmusic-sdp-uks-03
 	//
@@ -49,7 +49,7 @@ func exchangeKeySideA(ctx context.Context, ws *websocket.Conn, pass string) (key
 	return &k, nil
 }
 
-func exhangeKeySideB(ctx context.Context, ws *websocket.Conn, pass string) (key *[32]byte, err error) {
+func exhangeKeySideB(ctx context.Context, ws signalConn, pass string) (key *[32]byte, err error) {
 	msgA, err := readBase64(ctx, ws)
 	if err != nil {
 		return nil, err
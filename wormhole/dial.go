@@ -37,8 +37,9 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"strconv"
+	"net"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/bingoohuang/gg/pkg/defaults"
@@ -47,7 +48,6 @@ import (
 	"github.com/pion/webrtc/v3"
 	"golang.org/x/net/proxy"
 	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 )
 
 // Protocol is an identifier for the current signalling scheme. It's
@@ -91,6 +91,14 @@ const (
 
 	// CloseWebRTCFailed we couldn't establish a WebRTC connection.
 	CloseWebRTCFailed
+
+	// CloseSlotClosed is the WebSocket status returned when the slot has been
+	// closed by the signalling server operator.
+	CloseSlotClosed
+
+	// CloseServerRestarting is the WebSocket status returned when the signalling
+	// server is shutting down. Clients should reconnect to the same slot.
+	CloseServerRestarting
 )
 
 var (
@@ -103,21 +111,76 @@ var (
 
 	// ErrTimedOut indicates signalling has timed out.
 	ErrTimedOut = errors.New("timed out")
+
+	// ErrNoSuchSlot is returned when the slot is not valid, e.g. a reserved code has expired.
+	ErrNoSuchSlot = errors.New("no such slot")
+
+	// ErrUnauthorized is returned when the signalling server rejects the bearer.
+	ErrUnauthorized = errors.New("unauthorized")
 )
 
 // Verbose logging.
 var Verbose = false
 
+// ForceRelay makes the peer connections only use TURN relays, i.e. the relay ICE transport policy.
+var ForceRelay = false
+
 func logf(format string, v ...interface{}) {
 	if Verbose {
 		log.Printf(format, v...)
 	}
 }
 
+// restartRetries is the number of times to reconnect when the signalling server restarts.
+const restartRetries = 5
+
+// Setup connects to the slot on the signalling server sigserv, a new slot is allocated
+// if slot is empty, then does the handshake with the peer on the same slot.
+// It reconnects to the same slot when the signalling server is restarting.
 func Setup(ctx context.Context, slot, pass, sigserv, bearer string, timeouts *Timeouts) (*Wormhole, error) {
-	ir, err := initPeerConnection(ctx, slot, pass, sigserv, bearer, timeouts)
+	return SetupRelay(ctx, slot, pass, sigserv, bearer, timeouts, ForceRelay)
+}
+
+// SetupRelay is Setup with the peer connection only using TURN relays if
+// relay, whatever ForceRelay.
+func SetupRelay(ctx context.Context, slot, pass, sigserv, bearer string, timeouts *Timeouts, relay bool) (*Wormhole, error) {
+	restarting := false
+	for i := 1; ; i++ {
+		w, slotKey, err := setup(ctx, slot, pass, sigserv, bearer, timeouts, relay)
+		restarting = restarting || websocket.CloseStatus(err) == CloseServerRestarting
+		if !restarting || !restartRetryable(err) || i > restartRetries {
+			return w, err
+		}
+
+		delay := time.Duration(i) * time.Second
+		log.Printf("signalling server restarting (%v), reconnect to slot %s in %s", err, util.If(slotKey != "", slotKey, slot), delay)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		slot = util.If(slotKey != "", slotKey, slot)
+	}
+}
+
+// restartRetryable tells whether the error of an attempt of Setup may go away
+// on the next one while the signalling server restarts: the old instance is
+// draining and closes or rejects the connections, and the new one may not
+// listen yet.
+func restartRetryable(err error) bool {
+	switch websocket.CloseStatus(err) {
+	case CloseServerRestarting, CloseNoMoreSlots:
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// setup does one attempt of Setup, it returns the slot assigned by the signalling server.
+func setup(ctx context.Context, slot, pass, sigserv, bearer string, timeouts *Timeouts, relay bool) (*Wormhole, string, error) {
+	ir, err := initPeerConnection(ctx, slot, pass, sigserv, bearer, timeouts, relay)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	if ir.Mode == ModePeer1 {
 		err = newWormhole(ctx, ir, pass)
@@ -126,10 +189,11 @@ func Setup(ctx context.Context, slot, pass, sigserv, bearer string, timeouts *Ti
 	}
 
 	if err != nil {
-		return nil, err
+		_ = ir.Wormhole.pc.Close()
+		return nil, ir.Slot, err
 	}
 
-	return ir.Wormhole, nil
+	return ir.Wormhole, ir.Slot, nil
 }
 
 // A Wormhole is a WebRTC connection established via the WebWormhole signalling
@@ -248,7 +312,7 @@ type InitMsg struct {
 // handleRemoteCandidates waits for remote candidate to trickle in. We close
 // the websocket when we get a successful connection so this should fail and
 // exit at some point.
-func (c *Wormhole) handleRemoteCandidates(ctx context.Context, ws *websocket.Conn, key *[32]byte) {
+func (c *Wormhole) handleRemoteCandidates(ctx context.Context, ws signalConn, key *[32]byte) {
 	for {
 		var candidate webrtc.ICECandidateInit
 		if _, err := readEncJSON(ctx, ws, key, &candidate); err != nil {
@@ -282,7 +346,8 @@ type Timeouts struct {
 	RwTimeout util.Duration `json:"rwTimeout" default:"10s"`
 }
 
-func (c *Wormhole) newPeerConnection(ice []webrtc.ICEServer) (err error) {
+// newPeerConnection creates the peer connection, only using TURN relays if relay.
+func (c *Wormhole) newPeerConnection(ice []webrtc.ICEServer, relay bool) (err error) {
 	// Accessing pion/webrtc APIs like DataChannel.Detach() requires that we do this voodoo.
 	s := webrtc.SettingEngine{}
 	s.SetICETimeouts(c.Timeouts.DisconnectedTimeout.D(), c.Timeouts.FailedTimeout.D(), c.Timeouts.KeepAliveInterval.D())
@@ -290,7 +355,11 @@ func (c *Wormhole) newPeerConnection(ice []webrtc.ICEServer) (err error) {
 	s.SetICEProxyDialer(proxy.FromEnvironment())
 	rtcapi := webrtc.NewAPI(webrtc.WithSettingEngine(s))
 
-	if c.pc, err = rtcapi.NewPeerConnection(webrtc.Configuration{ICEServers: ice}); err != nil {
+	policy := webrtc.ICETransportPolicyAll
+	if relay {
+		policy = webrtc.ICETransportPolicyRelay
+	}
+	if c.pc, err = rtcapi.NewPeerConnection(webrtc.Configuration{ICEServers: ice, ICETransportPolicy: policy}); err != nil {
 		return err
 	}
 
@@ -488,7 +557,7 @@ func recvAnwser(ctx context.Context, ir *initPeerConnectionResult, key *[32]byte
 	return nil
 }
 
-func waitDataChannelOpen(ctx context.Context, c *Wormhole, ws *websocket.Conn, key *[32]byte) error {
+func waitDataChannelOpen(ctx context.Context, c *Wormhole, ws signalConn, key *[32]byte) error {
 	go c.handleRemoteCandidates(ctx, ws, key)
 
 	timeout := 15 * time.Second
@@ -510,14 +579,40 @@ func waitDataChannelOpen(ctx context.Context, c *Wormhole, ws *websocket.Conn, k
 	}
 }
 
+// Probe connects to the signalling server sigserv for a new slot, reads its
+// InitMsg and hangs up, to check the server without a peer. It returns the
+// transport of the signalling, websocket or long-poll.
+func Probe(ctx context.Context, sigserv, bearer string) (*InitMsg, string, error) {
+	ws, err := dialSignal(ctx, "", sigserv, bearer)
+	if err != nil {
+		return nil, "", err
+	}
+	transport := "websocket"
+	if _, ok := ws.(*pollConn); ok {
+		transport = "long-poll"
+	}
+
+	initMsg := &InitMsg{}
+	if err := readJSON(ctx, ws, initMsg); err != nil {
+		if websocket.CloseStatus(err) == CloseWrongProto {
+			err = ErrBadVersion
+		}
+		return nil, transport, fmt.Errorf("read InitMsg failed: %w", err)
+	}
+	// The server may answer the close handshake late, don't wait for it.
+	go func() { _ = ws.Close(websocket.StatusNormalClosure, "probe") }()
+	return initMsg, transport, nil
+}
+
 type initPeerConnectionResult struct {
-	Ws       *websocket.Conn
+	Ws       signalConn
 	Wormhole *Wormhole
 	Mode     SlotItemMode
+	Slot     string
 }
 
-func initPeerConnection(ctx context.Context, slot, pass, sigserv, bearer string, timeouts *Timeouts) (*initPeerConnectionResult, error) {
-	ws, err := dialWebsocket(ctx, slot, sigserv, bearer)
+func initPeerConnection(ctx context.Context, slot, pass, sigserv, bearer string, timeouts *Timeouts, relay bool) (*initPeerConnectionResult, error) {
+	ws, err := dialSignal(ctx, slot, sigserv, bearer)
 	if err != nil {
 		return nil, err
 	}
@@ -525,17 +620,20 @@ func initPeerConnection(ctx context.Context, slot, pass, sigserv, bearer string,
 	// reads the first message the signalling server sends overthe WebSocket connection,
 	// which has metadata includign assigned slot and ICE servers to use.
 	initMsg := &InitMsg{}
-	if err := wsjson.Read(ctx, ws, initMsg); err != nil {
-		if websocket.CloseStatus(err) == CloseWrongProto {
+	if err := readJSON(ctx, ws, initMsg); err != nil {
+		switch websocket.CloseStatus(err) {
+		case CloseWrongProto:
 			err = ErrBadVersion
+		case CloseNoSuchSlot:
+			err = ErrNoSuchSlot
 		}
 		return nil, fmt.Errorf("read InitMsg failed: %w", err)
 	}
 
 	logf("connected to signalling server, got %s slot: %v", initMsg.Mode, initMsg.Slot)
 
-	slotNum, err := strconv.Atoi(initMsg.Slot)
-	if err != nil {
+	code := wordlist.EncodeSlot(initMsg.Slot, []byte(pass))
+	if code == "" {
 		return nil, fmt.Errorf("got invalid slot %q from signalling server", initMsg.Slot)
 	}
 
@@ -547,14 +645,14 @@ func initPeerConnection(ctx context.Context, slot, pass, sigserv, bearer string,
 		opened:   make(chan struct{}),
 		err:      make(chan error),
 		flushc:   sync.NewCond(&sync.Mutex{}),
-		Code:     wordlist.Encode(slotNum, []byte(pass)),
+		Code:     code,
 		Timeouts: timeouts,
 	}
 	log.Printf("Wormhole code: %s", c.Code)
 
-	if err := c.newPeerConnection(initMsg.ICEServers); err != nil {
+	if err := c.newPeerConnection(initMsg.ICEServers, relay); err != nil {
 		return nil, err
 	}
 
-	return &initPeerConnectionResult{Ws: ws, Wormhole: c, Mode: initMsg.Mode}, nil
+	return &initPeerConnectionResult{Ws: ws, Wormhole: c, Mode: initMsg.Mode, Slot: initMsg.Slot}, nil
 }
@@ -1,22 +1,32 @@
 package wormhole
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/bingoohuang/gg/pkg/defaults"
+	"github.com/bingoohuang/gowormhole/internal/util"
 	"github.com/go-playground/assert/v2"
+	"nhooyr.io/websocket"
 )
 
 func TestICETimeoutsDefaults(t *testing.T) {
 	var it Timeouts
 	defaults.Set(&it)
 	assert.Equal(t, Timeouts{
-		DisconnectedTimeout: 5 * time.Second,
-		FailedTimeout:       10 * time.Second,
-		KeepAliveInterval:   2 * time.Second,
-		CloseTimeout:        10 * time.Second,
-		RwTimeout:           10 * time.Second,
+		DisconnectedTimeout: util.Duration(5 * time.Second),
+		FailedTimeout:       util.Duration(10 * time.Second),
+		KeepAliveInterval:   util.Duration(2 * time.Second),
+		CloseTimeout:        util.Duration(10 * time.Second),
+		RwTimeout:           util.Duration(10 * time.Second),
 	}, it)
 
 	var (
@@ -38,3 +48,26 @@ type Wrap struct {
 type Wrap2 struct {
 	Timeouts *Timeouts `default:"{}"`
 }
+
+func TestSetupRetriesWhileRestarting(t *testing.T) {
+	// The server restarts, then drains, then runs another protocol version.
+	codes := []websocket.StatusCode{CloseServerRestarting, CloseNoMoreSlots, CloseWrongProto}
+	var attempts atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: []string{Protocol}})
+		if err != nil {
+			return
+		}
+		_ = ws.Close(codes[attempts.Add(1)-1], "")
+	}))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := Setup(ctx, "", "pass", s.URL+"/", "", nil)
+	assert.Equal(t, true, errors.Is(err, ErrBadVersion))
+	assert.Equal(t, int32(3), attempts.Load())
+
+	assert.Equal(t, true, restartRetryable(fmt.Errorf("dial: %w", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED})))
+	assert.Equal(t, false, restartRetryable(ErrBadKey))
+}
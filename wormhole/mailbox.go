@@ -0,0 +1,189 @@
+package wormhole
+
+// The bundles of the mailbox mode, for receivers offline when sending. There is
+// no PAKE round trip, so the key is derived from the password of the wormhole
+// code by a slow KDF, and the signalling server only stores the ciphertext.
+//
+// A bundle is the header, i.e. mailboxMagic and a random nonce prefix, then the
+// plaintext in chunks of mailboxChunkSize sealed by secretbox. The nonce of each
+// chunk is the prefix and the chunk counter, whose high bit marks the last chunk,
+// so that a truncated bundle doesn't open.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+
+	"github.com/bingoohuang/gowormhole/internal/util"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	// MailboxPath is the path prefix of the mailbox on the signalling server:
+	//
+	//	POST mailbox/       reserves a mailbox, answers {"id": "...", "expires": "..."}
+	//	PUT  mailbox/{id}   uploads the bundle, with the MailboxTokenHeader holding MailboxTokenHash
+	//	GET  mailbox/{id}   downloads the bundle once, with the MailboxTokenHeader holding the token
+	MailboxPath = "mailbox/"
+
+	// MailboxTokenHeader is the header carrying the token to fetch a bundle.
+	MailboxTokenHeader = "GoWormhole-Mailbox-Token"
+
+	mailboxMagic     = "GWMBOX01"
+	mailboxChunkSize = 64 << 10
+	mailboxLastChunk = 1 << 63
+
+	// MailboxMinBundle is the size of the smallest bundle, the header and an empty last chunk.
+	MailboxMinBundle = len(mailboxMagic) + 16 + secretbox.Overhead
+)
+
+// ErrTruncated is returned when a bundle ends before its last chunk.
+var ErrTruncated = errors.New("truncated bundle")
+
+// MailboxKeys derives the key of the bundle in the mailbox id, and the token to
+// fetch it, from the password of the wormhole code by argon2id.
+func MailboxKeys(id string, pass []byte) (key *[32]byte, token string) {
+	k := argon2.IDKey(pass, []byte("gowormhole mailbox "+id), 3, 64<<10, 4, 64)
+	key = new([32]byte)
+	copy(key[:], k[:32])
+	return key, base64.RawURLEncoding.EncodeToString(k[32:])
+}
+
+// MailboxTokenHash returns the hash of the token the server checks on fetch,
+// so that it can't fetch by itself.
+func MailboxTokenHash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// SealBundle returns a writer sealing the plaintext written into a bundle on w,
+// it must be closed to write the last chunk.
+func SealBundle(w io.Writer, key *[32]byte) (io.WriteCloser, error) {
+	s := &bundleSealer{w: w, key: key, buf: make([]byte, 0, mailboxChunkSize)}
+	util.RandFull(s.prefix[:])
+	if _, err := w.Write(append([]byte(mailboxMagic), s.prefix[:]...)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type bundleSealer struct {
+	w      io.Writer
+	key    *[32]byte
+	prefix [16]byte
+	n      uint64
+	buf    []byte
+}
+
+func (s *bundleSealer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		k := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf = s.buf[:len(s.buf)+k]
+		p = p[k:]
+		written += k
+
+		// Keep a full chunk until more comes, it may be the last one.
+		if len(s.buf) == cap(s.buf) && len(p) > 0 {
+			if err := s.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (s *bundleSealer) seal(last bool) error {
+	nonce := chunkNonce(s.prefix, s.n, last)
+	_, err := s.w.Write(secretbox.Seal(nil, s.buf, &nonce, s.key))
+	s.n++
+	s.buf = s.buf[:0]
+	return err
+}
+
+// Close seals the last chunk.
+func (s *bundleSealer) Close() error { return s.seal(true) }
+
+func chunkNonce(prefix [16]byte, n uint64, last bool) (nonce [24]byte) {
+	copy(nonce[:], prefix[:])
+	if last {
+		n |= mailboxLastChunk
+	}
+	binary.BigEndian.PutUint64(nonce[16:], n)
+	return nonce
+}
+
+// OpenBundle returns a reader of the plaintext of the bundle read from r.
+// Reading fails with ErrBadKey if the key is wrong or the bundle was tampered
+// with, and with ErrTruncated if it ends early.
+func OpenBundle(r io.Reader, key *[32]byte) (io.Reader, error) {
+	header := make([]byte, len(mailboxMagic)+16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrTruncated
+	}
+	if !bytes.Equal(header[:len(mailboxMagic)], []byte(mailboxMagic)) {
+		return nil, errors.New("not a mailbox bundle")
+	}
+
+	o := &bundleOpener{r: r, key: key, chunk: make([]byte, mailboxChunkSize+secretbox.Overhead)}
+	copy(o.prefix[:], header[len(mailboxMagic):])
+	return o, nil
+}
+
+type bundleOpener struct {
+	r      io.Reader
+	key    *[32]byte
+	prefix [16]byte
+	n      uint64
+	chunk  []byte
+	plain  []byte
+	last   bool
+}
+
+func (o *bundleOpener) Read(p []byte) (int, error) {
+	for len(o.plain) == 0 {
+		if o.last {
+			return 0, io.EOF
+		}
+		if err := o.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, o.plain)
+	o.plain = o.plain[n:]
+	return n, nil
+}
+
+// open opens the next chunk, a full chunk may be the last one too.
+func (o *bundleOpener) open() error {
+	n, err := io.ReadFull(o.r, o.chunk)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	} else if err != nil {
+		return err
+	}
+
+	sealed := o.chunk[:n]
+	nonce := chunkNonce(o.prefix, o.n, false)
+	plain, ok := secretbox.Open(nil, sealed, &nonce, o.key)
+	if !ok {
+		nonce = chunkNonce(o.prefix, o.n, true)
+		if plain, ok = secretbox.Open(nil, sealed, &nonce, o.key); !ok {
+			if n < len(o.chunk) && o.n > 0 {
+				return ErrTruncated
+			}
+			return ErrBadKey
+		}
+		o.last = true
+	}
+
+	o.n++
+	o.plain = plain
+	return nil
+}
@@ -0,0 +1,51 @@
+package wormhole
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func sealBundle(t *testing.T, key *[32]byte, plain []byte) []byte {
+	var b bytes.Buffer
+	w, err := SealBundle(&b, key)
+	assert.Equal(t, nil, err)
+	_, err = w.Write(plain)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, w.Close())
+	return b.Bytes()
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	key, _ := MailboxKeys("42", []byte("pass"))
+	for _, size := range []int{0, 1, mailboxChunkSize, mailboxChunkSize + 1, 3 * mailboxChunkSize} {
+		plain := bytes.Repeat([]byte{'x'}, size)
+		r, err := OpenBundle(bytes.NewReader(sealBundle(t, key, plain)), key)
+		assert.Equal(t, nil, err)
+		got, err := io.ReadAll(r)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, plain, got)
+	}
+}
+
+func TestBundleWrongKeyOrTruncated(t *testing.T) {
+	key, token := MailboxKeys("42", []byte("pass"))
+	other, otherToken := MailboxKeys("42", []byte("word"))
+	assert.NotEqual(t, token, otherToken)
+
+	bundle := sealBundle(t, key, bytes.Repeat([]byte{'x'}, 2*mailboxChunkSize+1))
+
+	r, err := OpenBundle(bytes.NewReader(bundle), other)
+	assert.Equal(t, nil, err)
+	_, err = io.ReadAll(r)
+	assert.Equal(t, ErrBadKey, err)
+
+	// Cut after the first chunk.
+	cut := len(mailboxMagic) + 16 + mailboxChunkSize + 16
+	r, err = OpenBundle(bytes.NewReader(bundle[:cut]), key)
+	assert.Equal(t, nil, err)
+	_, err = io.ReadAll(r)
+	assert.Equal(t, ErrTruncated, err)
+}
@@ -0,0 +1,248 @@
+package wormhole
+
+// The HTTP long-poll fallback of the signalling WebSocket, for networks whose
+// proxies strip the WebSocket upgrade.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+const (
+	// PollPath is the path prefix of the long-poll binding on the signalling server:
+	//
+	//	POST poll/open/{slot}?protocol=4  opens a session, answers {"token": "..."}
+	//	POST poll/send                    sends the frame in the body
+	//	GET  poll/recv?ack=               answers the next frame, 204 if none came in time
+	//	POST poll/close?code=&reason=     closes the session
+	//
+	// The requests but open carry the token in the PollSessionHeader. Once the
+	// session is closed, send and recv answer 410 Gone with a PollClose.
+	//
+	// The frames answered by recv are numbered from 1 in the PollSeqHeader, and
+	// recv acknowledges the last one received by ack, 0 for none. Until then the
+	// server answers the same frame again, so that a response lost on the way
+	// loses no frame.
+	PollPath = "poll/"
+
+	// PollSessionHeader is the header carrying the token of a long-poll session.
+	PollSessionHeader = "GoWormhole-Session"
+	// PollSeqHeader is the header carrying the sequence number of a frame answered by recv.
+	PollSeqHeader = "GoWormhole-Seq"
+
+	// pollRetries is the number of times a failed recv is retried in a row.
+	pollRetries = 3
+	// pollRetryDelay is the delay before retrying a failed recv.
+	pollRetryDelay = time.Second
+)
+
+// PollClose is the close code of a closed long-poll session.
+type PollClose struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// signalConn is the connection to the signalling server, a WebSocket or a long-poll session.
+type signalConn interface {
+	Read(ctx context.Context) (websocket.MessageType, []byte, error)
+	Write(ctx context.Context, typ websocket.MessageType, p []byte) error
+	Close(code websocket.StatusCode, reason string) error
+}
+
+// dialSignal connects to the slot on the signalling server by WebSocket, and
+// falls back to long-poll when the WebSocket upgrade fails.
+func dialSignal(ctx context.Context, slot, sigserv, bearer string) (signalConn, error) {
+	ws, rsp, err := dialWebsocket(ctx, slot, sigserv, bearer)
+	if err == nil {
+		return ws, nil
+	}
+	if ctx.Err() != nil || !upgradeStripped(rsp) {
+		return nil, err
+	}
+
+	logf("websocket failed: %v, falling back to long-poll", err)
+	c, perr := dialPoll(ctx, slot, sigserv, bearer)
+	if perr != nil {
+		return nil, fmt.Errorf("dial websocket: %w, dial long-poll: %v", err, perr)
+	}
+	return c, nil
+}
+
+// upgradeStripped reports whether the server answered the WebSocket handshake
+// without upgrading, as the proxies stripping the upgrade do. The unreachable
+// servers and the rejections, which the long-poll would get too, are not.
+func upgradeStripped(rsp *http.Response) bool {
+	if rsp == nil {
+		return false
+	}
+	switch rsp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return false
+	}
+	return true
+}
+
+// pollConn is a long-poll session on the signalling server.
+type pollConn struct {
+	base   string
+	token  string
+	bearer string
+	client *http.Client
+	// ack is the sequence number of the last frame received.
+	ack uint64
+}
+
+func dialPoll(ctx context.Context, slot, sigserv, bearer string) (*pollConn, error) {
+	u, err := url.Parse(sigserv)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	c := &pollConn{base: u.String(), bearer: bearer, client: http.DefaultClient}
+
+	rsp, err := c.do(ctx, http.MethodPost, PollPath+"open/"+slot+"?protocol="+Protocol, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("open long-poll session: %w", ErrUnauthorized)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("open long-poll session: %s", rsp.Status)
+	}
+	var session struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(&session); err != nil {
+		return nil, fmt.Errorf("open long-poll session: %w", err)
+	}
+	c.token = session.Token
+	return c, nil
+}
+
+func (c *pollConn) do(ctx context.Context, method, path, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.bearer)
+	if c.token != "" {
+		req.Header.Set(PollSessionHeader, c.token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return c.client.Do(req)
+}
+
+// Read waits for the next frame, polling until one comes. The failed polls,
+// e.g. by a proxy timing out, are retried, the server then answers again the
+// frame whose response was lost.
+func (c *pollConn) Read(ctx context.Context) (websocket.MessageType, []byte, error) {
+	failures := 0
+	for {
+		rsp, p, err := c.recv(ctx)
+		if err == nil && (rsp.StatusCode == http.StatusBadGateway || rsp.StatusCode == http.StatusGatewayTimeout) {
+			err = pollError(rsp, p)
+		}
+		if err != nil {
+			if ctx.Err() != nil || failures == pollRetries {
+				return 0, nil, err
+			}
+			failures++
+			select {
+			case <-time.After(pollRetryDelay):
+			case <-ctx.Done():
+				return 0, nil, ctx.Err()
+			}
+			continue
+		}
+		failures = 0
+
+		switch rsp.StatusCode {
+		case http.StatusOK:
+			seq, _ := strconv.ParseUint(rsp.Header.Get(PollSeqHeader), 10, 64)
+			if seq != 0 && seq <= c.ack {
+				// Received already, answered again as the ack got lost.
+				continue
+			}
+			c.ack = seq
+			if rsp.Header.Get("Content-Type") == "application/octet-stream" {
+				return websocket.MessageBinary, p, nil
+			}
+			return websocket.MessageText, p, nil
+		case http.StatusNoContent:
+			continue
+		default:
+			return 0, nil, pollError(rsp, p)
+		}
+	}
+}
+
+func (c *pollConn) recv(ctx context.Context) (*http.Response, []byte, error) {
+	rsp, err := c.do(ctx, http.MethodGet, PollPath+"recv?ack="+strconv.FormatUint(c.ack, 10), "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rsp.Body.Close()
+
+	p, err := io.ReadAll(rsp.Body)
+	return rsp, p, err
+}
+
+// Write sends a frame.
+func (c *pollConn) Write(ctx context.Context, typ websocket.MessageType, p []byte) error {
+	contentType := "text/plain"
+	if typ == websocket.MessageBinary {
+		contentType = "application/octet-stream"
+	}
+	rsp, err := c.do(ctx, http.MethodPost, PollPath+"send", contentType, p)
+	if err != nil {
+		return err
+	}
+	body, _ := io.ReadAll(rsp.Body)
+	_ = rsp.Body.Close()
+	if rsp.StatusCode != http.StatusNoContent {
+		return pollError(rsp, body)
+	}
+	return nil
+}
+
+// Close closes the session with code.
+func (c *pollConn) Close(code websocket.StatusCode, reason string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	q := url.Values{"code": {strconv.Itoa(int(code))}, "reason": {reason}}
+	rsp, err := c.do(ctx, http.MethodPost, PollPath+"close?"+q.Encode(), "", nil)
+	if err != nil {
+		return err
+	}
+	_ = rsp.Body.Close()
+	return nil
+}
+
+// pollError returns the error of a failed request, a websocket.CloseError if
+// the session is closed, so that websocket.CloseStatus works as on WebSockets.
+func pollError(rsp *http.Response, body []byte) error {
+	if rsp.StatusCode == http.StatusGone {
+		var pc PollClose
+		if err := json.Unmarshal(body, &pc); err == nil {
+			return fmt.Errorf("received close frame: %w", websocket.CloseError{Code: websocket.StatusCode(pc.Code), Reason: pc.Reason})
+		}
+	}
+	return fmt.Errorf("long-poll %s: %s", rsp.Request.URL.Path, rsp.Status)
+}
@@ -0,0 +1,84 @@
+package wormhole
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+	"nhooyr.io/websocket"
+)
+
+func TestDialSignalFallsBackToPoll(t *testing.T) {
+	// A proxy stripping the upgrade, in front of the long-poll binding.
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + PollPath + "open/":
+			_ = json.NewEncoder(w).Encode(map[string]string{"token": "t"})
+		case "/" + PollPath + "recv":
+			if r.Header.Get(PollSessionHeader) != "t" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusGone)
+			_ = json.NewEncoder(w).Encode(PollClose{Code: CloseNoSuchSlot, Reason: "no such slot"})
+		default:
+			_, _ = w.Write([]byte("upgrade stripped"))
+		}
+	}))
+	defer s.Close()
+
+	c, err := dialSignal(context.Background(), "", s.URL+"/", "")
+	assert.Equal(t, nil, err)
+	_, ok := c.(*pollConn)
+	assert.Equal(t, true, ok)
+
+	_, _, err = c.Read(context.Background())
+	assert.Equal(t, websocket.StatusCode(CloseNoSuchSlot), websocket.CloseStatus(err))
+}
+
+func TestDialSignalNoFallbackOnRejection(t *testing.T) {
+	opened := false
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/"+PollPath+"open/" {
+			opened = true
+		}
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer s.Close()
+
+	_, err := dialSignal(context.Background(), "", s.URL+"/", "")
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, false, opened)
+}
+
+func TestPollReadRetriesAndSkipsDuplicates(t *testing.T) {
+	var acks []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acks = append(acks, r.URL.Query().Get("ack"))
+		switch len(acks) {
+		case 1:
+			// A proxy timing out.
+			w.WriteHeader(http.StatusGatewayTimeout)
+		case 2, 3:
+			// The ack of the first answer got lost, it comes again.
+			w.Header().Set(PollSeqHeader, "1")
+			_, _ = w.Write([]byte("a"))
+		default:
+			w.Header().Set(PollSeqHeader, "2")
+			_, _ = w.Write([]byte("b"))
+		}
+	}))
+	defer s.Close()
+
+	c := &pollConn{base: s.URL + "/", client: http.DefaultClient}
+	_, p, err := c.Read(context.Background())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "a", string(p))
+	_, p, err = c.Read(context.Background())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "b", string(p))
+	assert.Equal(t, []string{"0", "0", "1", "1"}, acks)
+}
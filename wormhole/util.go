@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/url"
 
@@ -13,10 +14,10 @@ import (
 	"nhooyr.io/websocket"
 )
 
-func dialWebsocket(ctx context.Context, slot, sigserv, bearer string) (*websocket.Conn, error) {
+func dialWebsocket(ctx context.Context, slot, sigserv, bearer string) (*websocket.Conn, *http.Response, error) {
 	u, err := url.Parse(sigserv)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	u.Scheme = util.If(ss.AnyOf(u.Scheme, "http", "ws"), "ws", "wss")
 	if slot != "" {
@@ -29,11 +30,22 @@ func dialWebsocket(ctx context.Context, slot, sigserv, bearer string) (*websocke
 		Subprotocols: []string{Protocol},
 		HTTPHeader:   http.Header{"Authorization": {"Bearer " + bearer}},
 	}
-	ws, _, err := websocket.Dial(ctx, wsaddr, d)
-	return ws, err
+	ws, rsp, err := websocket.Dial(ctx, wsaddr, d)
+	if err != nil && rsp != nil && rsp.StatusCode == http.StatusUnauthorized {
+		err = fmt.Errorf("dial websocket: %w", ErrUnauthorized)
+	}
+	return ws, rsp, err
+}
+
+func readJSON(ctx context.Context, ws signalConn, v interface{}) error {
+	_, buf, err := ws.Read(ctx)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
 }
 
-func readEncJSON(ctx context.Context, ws *websocket.Conn, key *[32]byte, v interface{}) ([]byte, error) {
+func readEncJSON(ctx context.Context, ws signalConn, key *[32]byte, v interface{}) ([]byte, error) {
 	encrypted, err := readBase64(ctx, ws)
 	if err != nil {
 		return nil, err
@@ -48,7 +60,7 @@ func readEncJSON(ctx context.Context, ws *websocket.Conn, key *[32]byte, v inter
 	return j, json.Unmarshal(j, v)
 }
 
-func writeEncJSON(ctx context.Context, ws *websocket.Conn, key *[32]byte, v interface{}) ([]byte, error) {
+func writeEncJSON(ctx context.Context, ws signalConn, key *[32]byte, v interface{}) ([]byte, error) {
 	j, err := json.Marshal(v)
 	if err != nil {
 		return nil, err
@@ -59,7 +71,7 @@ func writeEncJSON(ctx context.Context, ws *websocket.Conn, key *[32]byte, v inte
 	return j, writeBase64(ctx, ws, data)
 }
 
-func readBase64(ctx context.Context, ws *websocket.Conn) ([]byte, error) {
+func readBase64(ctx context.Context, ws signalConn) ([]byte, error) {
 	_, buf, err := ws.Read(ctx)
 	if err != nil {
 		return nil, err
@@ -67,6 +79,6 @@ func readBase64(ctx context.Context, ws *websocket.Conn) ([]byte, error) {
 	return base64.URLEncoding.DecodeString(string(buf))
 }
 
-func writeBase64(ctx context.Context, ws *websocket.Conn, p []byte) error {
+func writeBase64(ctx context.Context, ws signalConn, p []byte) error {
 	return ws.Write(ctx, websocket.MessageText, []byte(base64.URLEncoding.EncodeToString(p)))
 }